@@ -0,0 +1,222 @@
+package messenger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// ErrQueueFull is returned when a message is dropped because
+// the queue is full.
+var ErrQueueFull = errors.New("Queue is full")
+
+// OverflowPolicy decides what happens to a message that is put
+// in a full queue.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks until there is room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest message in the queue.
+	OverflowDropOldest
+	// OverflowDropNewest discards the message being queued.
+	OverflowDropNewest
+	// OverflowError discards the message being queued, and reports
+	// ErrQueueFull. It's returned to the sender of an outgoing message,
+	// and passed to the error handler for an incoming message.
+	OverflowError
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowError:
+		return "error"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// QueueInfo describes the state of a queue.
+type QueueInfo struct {
+	Name    string // "inbound", "recv" or "outbound".
+	Peer    string // The destination of an outbound queue.
+	Len     int
+	Cap     int
+	Policy  OverflowPolicy
+	Dropped uint64 // Number of the discarded messages.
+}
+
+// SetInboundPolicy sets the overflow policy of the inbound queue,
+// which holds the messages from the wire until they are handled.
+// When it blocks, the transporter stops reading from the wire, and
+// the remote senders are blocked. Otherwise, a transporter that
+// implements transporter.Rejecter tells the remote senders to back
+// off while the inbound queue is full, the messages that still
+// don't fit are discarded by the policy.
+func (m *Messenger) SetInboundPolicy(policy OverflowPolicy) {
+	m.mu.Lock()
+	m.inPolicy = policy
+	m.mu.Unlock()
+	if r, ok := m.tr.(transporter.Rejecter); ok {
+		if policy == OverflowBlock {
+			r.SetOverloaded(nil)
+		} else {
+			r.SetOverloaded(m.inboundFull)
+		}
+	}
+}
+
+// inboundFull tells whether the inbound queue is full.
+func (m *Messenger) inboundFull() bool {
+	return len(m.inQueue) >= cap(m.inQueue)
+}
+
+// SetRecvPolicy sets the overflow policy of the receive queue,
+// which holds the messages until they are consumed by Recv().
+// When it blocks, the handlers are stalled as well.
+func (m *Messenger) SetRecvPolicy(policy OverflowPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recvPolicy = policy
+}
+
+// Queues returns the state of the inbound, receive and
+// per-peer outbound queues.
+func (m *Messenger) Queues() []QueueInfo {
+	m.mu.RLock()
+	inPolicy, recvPolicy := m.inPolicy, m.recvPolicy
+	m.mu.RUnlock()
+	sess := m.current()
+
+	queues := []QueueInfo{
+		{"inbound", "", len(m.inQueue), cap(m.inQueue), inPolicy, atomic.LoadUint64(&m.inDropped)},
+		{"recv", "", len(sess.recvQueue), cap(sess.recvQueue), recvPolicy, atomic.LoadUint64(&m.recvDropped)},
+	}
+
+	m.outMu.Lock()
+	var peers []string
+	for hostport := range m.outQueues {
+		peers = append(peers, hostport)
+	}
+	sort.Strings(peers)
+	for _, hostport := range peers {
+		q := m.outQueues[hostport]
+		queues = append(queues, QueueInfo{
+			"outbound", hostport, len(q.ch), cap(q.ch), m.overflowPolicy, atomic.LoadUint64(&q.dropped),
+		})
+	}
+	m.outMu.Unlock()
+	return queues
+}
+
+// pushInbound puts the message from the wire in the inbound queue,
+// the overflow policy is applied if the queue is full.
+// It returns false if the messenger is stopped.
+func (m *Messenger) pushInbound(mr *messageReceived) bool {
+	m.mu.RLock()
+	policy := m.inPolicy
+	m.mu.RUnlock()
+	sess := m.current()
+
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case m.inQueue <- mr:
+				return true
+			default:
+			}
+			select {
+			case old := <-m.inQueue:
+				m.dropInbound(old)
+			default:
+			}
+		}
+	case OverflowDropNewest, OverflowError:
+		select {
+		case m.inQueue <- mr:
+		default:
+			m.dropInbound(mr)
+			if policy == OverflowError {
+				m.reportError(fmt.Errorf("Inbound queue is full, dropped message from %v", mr.from))
+			}
+		}
+		return true
+	}
+	select {
+	case m.inQueue <- mr:
+		return true
+	case <-sess.stop:
+		return false
+	}
+}
+
+func (m *Messenger) dropInbound(mr *messageReceived) {
+	atomic.AddUint64(&m.inDropped, 1)
+	m.logger.Warningf("Inbound queue is full, dropped message from %v\n", mr.from)
+	m.deadLetter(Inbound, mr.from, mr.data, mr.msg, ErrQueueFull)
+}
+
+// pushRecv puts the message in the receive queue,
+// the overflow policy is applied if the queue is full.
+func (m *Messenger) pushRecv(from string, msg interface{}) error {
+	sess := m.current()
+	sess.recvMu.RLock()
+	defer sess.recvMu.RUnlock()
+	if sess.recvClosed {
+		return ErrStopped
+	}
+
+	m.mu.RLock()
+	policy := m.recvPolicy
+	m.mu.RUnlock()
+
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case sess.recvQueue <- msg:
+				return nil
+			default:
+			}
+			select {
+			case old := <-sess.recvQueue:
+				m.dropRecv("", old)
+			default:
+			}
+		}
+	case OverflowDropNewest, OverflowError:
+		select {
+		case sess.recvQueue <- msg:
+			return nil
+		default:
+		}
+		atomic.AddUint64(&m.recvDropped, 1)
+		if policy == OverflowError {
+			m.reportError(fmt.Errorf("Receive queue is full, dropped message from %v", from))
+		}
+		return ErrQueueFull
+	}
+	select {
+	case sess.recvQueue <- msg:
+		return nil
+	case <-sess.stop:
+		return ErrStopped
+	}
+}
+
+// dropRecv discards a message that doesn't fit in a receive queue.
+func (m *Messenger) dropRecv(from string, msg interface{}) {
+	atomic.AddUint64(&m.recvDropped, 1)
+	// Encode it again, so it can be reinjected.
+	b, _ := m.codec.Marshal(msg)
+	m.deadLetter(Inbound, from, b, msg, ErrQueueFull)
+}
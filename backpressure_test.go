@@ -0,0 +1,198 @@
+package messenger
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the overflow policies of the receive queue.
+func TestRecvQueuePolicy(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	m.sess.recvQueue = make(chan interface{}, 2)
+
+	var errs []error
+	m.SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+
+	msgs := make([]*example.GoGoProtobufTestMessage1, 3)
+	for i := range msgs {
+		msgs[i] = &example.GoGoProtobufTestMessage1{}
+	}
+
+	m.SetRecvPolicy(OverflowError)
+	assert.NoError(t, m.deliver(context.Background(), "a:8000", msgs[0]))
+	assert.NoError(t, m.deliver(context.Background(), "a:8000", msgs[1]))
+	assert.Equal(t, ErrQueueFull, m.deliver(context.Background(), "a:8000", msgs[2]))
+	assert.Equal(t, 1, len(errs))
+
+	m.SetRecvPolicy(OverflowDropNewest)
+	assert.Equal(t, ErrQueueFull, m.deliver(context.Background(), "a:8000", msgs[2]))
+	assert.Equal(t, 1, len(errs))
+
+	m.SetRecvPolicy(OverflowDropOldest)
+	assert.NoError(t, m.deliver(context.Background(), "a:8000", msgs[2]))
+	assert.Equal(t, 1, m.DeadLetters().Len())
+	for _, expected := range msgs[1:] {
+		msg, err := m.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, msg)
+	}
+
+	info := m.Queues()[1]
+	assert.Equal(t, "recv", info.Name)
+	assert.Equal(t, 0, info.Len)
+	assert.Equal(t, 2, info.Cap)
+	assert.Equal(t, OverflowDropOldest, info.Policy)
+	assert.Equal(t, uint64(3), info.Dropped)
+
+	// Block until the messenger is stopped.
+	m.SetRecvPolicy(OverflowBlock)
+	assert.NoError(t, m.deliver(context.Background(), "a:8000", msgs[0]))
+	assert.NoError(t, m.deliver(context.Background(), "a:8000", msgs[1]))
+	done := make(chan error)
+	go func() {
+		done <- m.deliver(context.Background(), "a:8000", msgs[2])
+	}()
+	select {
+	case <-done:
+		t.Fatal("deliver() should block")
+	case <-time.After(time.Millisecond * 50):
+	}
+	assert.NoError(t, m.Stop())
+	assert.Error(t, <-done)
+}
+
+// Test the overflow policies of the inbound queue.
+func TestInboundQueuePolicy(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	m.inQueue = make(chan *messageReceived, 1)
+
+	mr1 := &messageReceived{from: "a:8000", data: []byte{1}}
+	mr2 := &messageReceived{from: "b:8000", data: []byte{2}}
+
+	m.SetInboundPolicy(OverflowDropNewest)
+	assert.True(t, m.pushInbound(mr1))
+	assert.True(t, m.pushInbound(mr2))
+	assert.Equal(t, mr1, <-m.inQueue)
+
+	m.SetInboundPolicy(OverflowDropOldest)
+	assert.True(t, m.pushInbound(mr1))
+	assert.True(t, m.pushInbound(mr2))
+	assert.Equal(t, mr2, <-m.inQueue)
+
+	var hostports []string
+	for it := m.DeadLetters(); it.Next(); {
+		assert.Equal(t, ErrQueueFull, it.DeadLetter().Reason)
+		hostports = append(hostports, it.DeadLetter().Hostport)
+	}
+	assert.Equal(t, []string{"b:8000", "a:8000"}, hostports)
+
+	// The queues are introspected.
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.Send("c:8000", &example.GoGoProtobufTestMessage1{}))
+	assert.Equal(t, []QueueInfo{
+		{"inbound", "", 0, 1, OverflowDropOldest, 2},
+		{"recv", "", 0, defaultQueueSize, OverflowBlock, 0},
+		{"outbound", "c:8000", 1, defaultQueueSize, OverflowBlock, 0},
+	}, m.Queues())
+
+	m.SetInboundPolicy(OverflowBlock)
+	assert.True(t, m.pushInbound(mr1))
+	assert.NoError(t, m.Stop())
+	assert.False(t, m.pushInbound(mr2))
+}
+
+// A transporter that records whether it rejects the messages.
+type rejectingTransporter struct {
+	*fakeTransporter
+	overloaded func() bool
+}
+
+func (r *rejectingTransporter) SetOverloaded(overloaded func() bool) {
+	r.overloaded = overloaded
+}
+
+// Test the transporter only rejects the messages if the inbound
+// policy doesn't block.
+func TestInboundPolicyRejects(t *testing.T) {
+	tr := &rejectingTransporter{fakeTransporter: newFakeTransporter()}
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr, WithQueueSizes(1, 1, 1))
+	assert.NoError(t, err)
+	assert.Nil(t, tr.overloaded)
+	m.SetInboundPolicy(OverflowDropOldest)
+	assert.NotNil(t, tr.overloaded)
+	// Overloaded when the inbound queue is full.
+	assert.False(t, tr.overloaded())
+	assert.True(t, m.pushInbound(&messageReceived{from: "a:8000"}))
+	assert.True(t, tr.overloaded())
+	m.SetInboundPolicy(OverflowBlock)
+	assert.Nil(t, tr.overloaded)
+
+	_, err = NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithOverflowPolicies(OverflowError, OverflowBlock, OverflowBlock))
+	assert.NoError(t, err)
+	assert.NotNil(t, tr.overloaded)
+}
+
+// Test a node under a non-blocking inbound policy tells the remote
+// senders to back off, instead of discarding the messages.
+func TestInboundOverloadedHTTP(t *testing.T) {
+	receiverAddr, senderAddr := freePort(t), freePort(t)
+	receiverTr := transporter.NewHTTPTransporter(receiverAddr)
+	receiver, err := NewWithOptions(codec.NewGoGoProtobufCodec(), receiverTr,
+		WithRecv(false), WithHandler(true), WithQueueSizes(1, 1, 1),
+		WithOverflowPolicies(OverflowDropNewest, OverflowBlock, OverflowBlock), WithPreparePeriod(time.Millisecond*100))
+	assert.NoError(t, err)
+	var handled int32
+	assert.NoError(t, receiver.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, receiver.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		time.Sleep(time.Millisecond * 5)
+		atomic.AddInt32(&handled, 1)
+	}))
+
+	senderTr := transporter.NewHTTPTransporter(senderAddr)
+	senderTr.SetOverloadRetries(0)
+	sender, err := NewWithOptions(codec.NewGoGoProtobufCodec(), senderTr,
+		WithRecv(false), WithQueueSizes(1, 1, 100), WithPreparePeriod(time.Millisecond*100))
+	assert.NoError(t, err)
+	assert.NoError(t, sender.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	sender.SetBreakerConfig(BreakerConfig{})
+
+	assert.NoError(t, receiver.Start())
+	defer receiver.Destroy()
+	assert.NoError(t, sender.Start())
+	defer sender.Destroy()
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		assert.NoError(t, sender.Send(receiverAddr, &example.GoGoProtobufTestMessage1{}))
+	}
+	countOverloaded := func() int {
+		count := 0
+		for it := sender.DeadLetters(); it.Next(); {
+			if it.DeadLetter().Reason == transporter.ErrOverloaded {
+				count++
+			}
+		}
+		return count
+	}
+	// Every message is either handled, discarded by the receiver,
+	// or rejected.
+	waitFor(t, time.Second*10, func() bool {
+		return int(atomic.LoadInt32(&handled))+receiver.DeadLetters().Len()+countOverloaded() == n
+	})
+	assert.True(t, countOverloaded() > 0)
+	assert.True(t, receiver.DeadLetters().Len() < countOverloaded(),
+		"%d discarded, %d rejected", receiver.DeadLetters().Len(), countOverloaded())
+}
@@ -0,0 +1,212 @@
+package messenger
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+const defaultBreakerThreshold = 5
+const defaultBreakerTimeout = time.Second * 5
+
+// ErrBreakerOpen is returned when sending to a peer whose
+// circuit breaker is open.
+var ErrBreakerOpen = errors.New("Circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets the messages through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the messages fast.
+	BreakerOpen
+	// BreakerHalfOpen lets one trial message through, the breaker
+	// is closed if it succeeds, or opened again if it fails.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// BreakerConfig configures the per-peer circuit breakers.
+type BreakerConfig struct {
+	// Number of consecutive failures that opens the breaker,
+	// 0 disables the breakers.
+	Threshold int
+	// How long the breaker stays open before a trial message.
+	Timeout time.Duration
+}
+
+// BreakerEvent is emitted when a breaker changes its state.
+type BreakerEvent struct {
+	Hostport string
+	From     BreakerState
+	To       BreakerState
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool // A trial message is in flight.
+}
+
+// breakers holds a circuit breaker for each peer.
+type breakers struct {
+	mu       sync.Mutex
+	config   BreakerConfig
+	peers    map[string]*breaker
+	onChange func(BreakerEvent)
+	logger   Logger
+}
+
+func newBreakers(logger Logger) *breakers {
+	return &breakers{
+		config: BreakerConfig{defaultBreakerThreshold, defaultBreakerTimeout},
+		peers:  make(map[string]*breaker),
+		logger: logger,
+	}
+}
+
+func (bs *breakers) get(hostport string) *breaker {
+	b, ok := bs.peers[hostport]
+	if !ok {
+		b = &breaker{}
+		bs.peers[hostport] = b
+	}
+	return b
+}
+
+// allow tells whether a message can be sent to the peer.
+func (bs *breakers) allow(hostport string) bool {
+	bs.mu.Lock()
+	if bs.config.Threshold <= 0 {
+		bs.mu.Unlock()
+		return true
+	}
+	b := bs.get(hostport)
+	var e *BreakerEvent
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < bs.config.Timeout {
+			bs.mu.Unlock()
+			return false
+		}
+		e = bs.transit(hostport, b, BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if b.trial {
+			bs.mu.Unlock()
+			return false
+		}
+	}
+	if b.state == BreakerHalfOpen {
+		b.trial = true
+	}
+	bs.mu.Unlock()
+	bs.emit(e)
+	return true
+}
+
+// record the result of sending a message to the peer. An overloaded
+// peer is reachable, so it doesn't count as a failure.
+func (bs *breakers) record(hostport string, err error) {
+	bs.mu.Lock()
+	if bs.config.Threshold <= 0 {
+		// The trial may have been let through before the
+		// breakers were disabled.
+		if b, ok := bs.peers[hostport]; ok {
+			b.trial = false
+		}
+		bs.mu.Unlock()
+		return
+	}
+	b := bs.get(hostport)
+	var e *BreakerEvent
+	if err == nil || err == transporter.ErrOverloaded {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			e = bs.transit(hostport, b, BreakerClosed)
+		}
+	} else {
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= bs.config.Threshold {
+			b.openedAt = time.Now()
+			if b.state != BreakerOpen {
+				e = bs.transit(hostport, b, BreakerOpen)
+			}
+		}
+	}
+	b.trial = false
+	bs.mu.Unlock()
+	bs.emit(e)
+}
+
+func (bs *breakers) transit(hostport string, b *breaker, to BreakerState) *BreakerEvent {
+	e := &BreakerEvent{hostport, b.state, to}
+	b.state = to
+	return e
+}
+
+func (bs *breakers) emit(e *BreakerEvent) {
+	if e == nil {
+		return
+	}
+	bs.logger.Infof("Circuit breaker of %v: %v -> %v\n", e.Hostport, e.From, e.To)
+	bs.mu.Lock()
+	onChange := bs.onChange
+	bs.mu.Unlock()
+	if onChange != nil {
+		onChange(*e)
+	}
+}
+
+// SetBreakerConfig configures the per-peer circuit breakers.
+// By default, a breaker opens after 5 consecutive failures,
+// and lets a trial message through after 5 seconds.
+func (m *Messenger) SetBreakerConfig(config BreakerConfig) {
+	m.breakers.mu.Lock()
+	defer m.breakers.mu.Unlock()
+	m.breakers.config = config
+}
+
+// SetBreakerHandler sets a callback that is called when a
+// circuit breaker changes its state.
+func (m *Messenger) SetBreakerHandler(h func(BreakerEvent)) {
+	m.breakers.mu.Lock()
+	defer m.breakers.mu.Unlock()
+	m.breakers.onChange = h
+}
+
+// BreakerState returns the state of the peer's circuit breaker.
+func (m *Messenger) BreakerState(hostport string) BreakerState {
+	m.breakers.mu.Lock()
+	defer m.breakers.mu.Unlock()
+	if b, ok := m.breakers.peers[hostport]; ok {
+		return b.state
+	}
+	return BreakerClosed
+}
+
+// BreakerStates returns the states of all the known peers' breakers.
+func (m *Messenger) BreakerStates() map[string]BreakerState {
+	m.breakers.mu.Lock()
+	defer m.breakers.mu.Unlock()
+	states := make(map[string]BreakerState)
+	for hostport, b := range m.breakers.peers {
+		states[hostport] = b.state
+	}
+	return states
+}
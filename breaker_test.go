@@ -0,0 +1,107 @@
+package messenger
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the per-peer circuit breakers.
+func TestCircuitBreaker(t *testing.T) {
+	tr := newFakeTransporter()
+	m := New(codec.NewGoGoProtobufCodec(), tr, true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	m.SetBreakerConfig(BreakerConfig{Threshold: 2, Timeout: time.Millisecond * 50})
+
+	var mu sync.Mutex
+	var events []BreakerEvent
+	m.SetBreakerHandler(func(e BreakerEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+
+	send := func(hostport string) error {
+		return m.send(&messageToSend{ctx: context.Background(), hostport: hostport, msg: &example.GoGoProtobufTestMessage1{}})
+	}
+
+	tr.setDown("a:8000", true)
+	assert.Equal(t, BreakerClosed, m.BreakerState("a:8000"))
+	assert.Error(t, send("a:8000"))
+	assert.Equal(t, BreakerClosed, m.BreakerState("a:8000"))
+	assert.Error(t, send("a:8000"))
+	assert.Equal(t, BreakerOpen, m.BreakerState("a:8000"))
+
+	// Fail fast while it's open, the other peers are not affected.
+	tr.setDown("a:8000", false)
+	assert.Equal(t, ErrBreakerOpen, send("a:8000"))
+	assert.Equal(t, 0, len(tr.out))
+	assert.NoError(t, send("b:8000"))
+	assert.Equal(t, 1, len(tr.out))
+	<-tr.out
+	assert.Equal(t, map[string]BreakerState{
+		"a:8000": BreakerOpen,
+		"b:8000": BreakerClosed,
+	}, m.BreakerStates())
+
+	// A failed trial opens the breaker again.
+	time.Sleep(time.Millisecond * 60)
+	tr.setDown("a:8000", true)
+	assert.Error(t, send("a:8000"))
+	assert.Equal(t, BreakerOpen, m.BreakerState("a:8000"))
+	assert.Equal(t, ErrBreakerOpen, send("a:8000"))
+
+	// A successful trial closes it.
+	time.Sleep(time.Millisecond * 60)
+	tr.setDown("a:8000", false)
+	assert.NoError(t, send("a:8000"))
+	assert.Equal(t, BreakerClosed, m.BreakerState("a:8000"))
+	<-tr.out
+
+	mu.Lock()
+	assert.Equal(t, []BreakerEvent{
+		{"a:8000", BreakerClosed, BreakerOpen},
+		{"a:8000", BreakerOpen, BreakerHalfOpen},
+		{"a:8000", BreakerHalfOpen, BreakerOpen},
+		{"a:8000", BreakerOpen, BreakerHalfOpen},
+		{"a:8000", BreakerHalfOpen, BreakerClosed},
+	}, events)
+	mu.Unlock()
+
+	// The messages failed fast are dead-lettered.
+	n := 0
+	for it := m.DeadLetters(); it.Next(); {
+		if it.DeadLetter().Reason == ErrBreakerOpen {
+			n++
+		}
+	}
+	assert.Equal(t, 2, n)
+
+	// Disable the breakers.
+	m.SetBreakerConfig(BreakerConfig{})
+	tr.setDown("a:8000", true)
+	for i := 0; i < 3; i++ {
+		assert.NotEqual(t, ErrBreakerOpen, send("a:8000"))
+	}
+}
+
+// Test disabling the breakers while a trial is in flight doesn't
+// leave the breaker rejecting every message once it's enabled again.
+func TestCircuitBreakerDisabledDuringTrial(t *testing.T) {
+	bs := newBreakers(glogLogger{})
+	bs.config = BreakerConfig{Threshold: 1, Timeout: time.Millisecond * 10}
+	bs.record("a:8000", ErrStopped)
+	time.Sleep(time.Millisecond * 20)
+	assert.True(t, bs.allow("a:8000"))
+
+	bs.config = BreakerConfig{}
+	bs.record("a:8000", nil)
+	bs.config = BreakerConfig{Threshold: 1, Timeout: time.Millisecond * 10}
+	assert.True(t, bs.allow("a:8000"))
+}
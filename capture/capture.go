@@ -0,0 +1,179 @@
+// Package capture records the messages on the wire to a capture
+// file, and replays them later, e.g. to reproduce an incident
+// against the handlers deterministically.
+//
+// A capture file has one JSON object per line, which is a Record.
+// The raw bytes are the messages encoded by the codec, in base64.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger"
+)
+
+// Record is a message captured on the wire.
+type Record struct {
+	Time      time.Time
+	Direction messenger.Direction
+	Peer      string // The destination, or the sender if known.
+	Data      []byte // Encoded by the codec.
+}
+
+// Recorder writes the messages to a capture, it implements the
+// messenger.WireTap, so it can be set on a messenger:
+//
+//	r, err := capture.Create("incident.capture")
+//	m.SetWireTap(r)
+//	...
+//	m.SetWireTap(nil)
+//	r.Close()
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	enc    *json.Encoder
+	closer io.Closer
+	count  int
+	err    error // The first write error.
+}
+
+// NewRecorder creates a recorder that writes to the w.
+func NewRecorder(w io.Writer) *Recorder {
+	bw := bufio.NewWriter(w)
+	return &Recorder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Create creates a recorder that writes to a new file at the path,
+// an existing file is truncated.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+// Tap records the message, it stops recording after a write error,
+// which is returned by Err() and Close().
+func (r *Recorder) Tap(d messenger.Direction, peer string, b []byte) {
+	r.Record(&Record{time.Now(), d, peer, b})
+}
+
+// Record writes the record.
+func (r *Recorder) Record(rec *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if r.err = r.enc.Encode(rec); r.err == nil {
+		r.count++
+	}
+}
+
+// Count returns the number of the recorded messages.
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// Err returns the first write error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Flush writes the buffered records.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// Close flushes the buffered records, and closes the file
+// if the recorder is created by Create.
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Reader reads the records from a capture.
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader creates a reader that reads from the r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{json.NewDecoder(r)}
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (r *Reader) Next() (*Record, error) {
+	rec := new(Record)
+	if err := r.dec.Decode(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// ReadAll returns the remaining records.
+func (r *Reader) ReadAll() ([]*Record, error) {
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// ReadFile returns the records in the capture file at the path.
+func ReadFile(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReader(f).ReadAll()
+}
+
+// Filter returns the records that the keep function returns true for.
+func Filter(records []*Record, keep func(*Record) bool) []*Record {
+	var kept []*Record
+	for _, rec := range records {
+		if keep(rec) {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// Inbound returns the inbound records, which are the ones to replay
+// to reproduce what a node has received.
+func Inbound(records []*Record) []*Record {
+	return Filter(records, func(rec *Record) bool {
+		return rec.Direction == messenger.Inbound
+	})
+}
@@ -0,0 +1,148 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+func newNode(t *testing.T, network *transporter.LocalNetwork, addr string, received chan interface{}) *messenger.Messenger {
+	m, err := messenger.NewWithOptions(codec.NewGoGoProtobufCodec(), transporter.NewLocalTransporter(network, addr),
+		messenger.WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		received <- msg
+	}))
+	assert.NoError(t, m.Start())
+	return m
+}
+
+// Test the captured traffic is replayed to another messenger.
+func TestCaptureReplay(t *testing.T) {
+	network := transporter.NewLocalNetwork()
+	received := make(chan interface{}, 10)
+	a := newNode(t, network, "a:8000", received)
+	defer a.Destroy()
+	b := newNode(t, network, "b:8000", received)
+	defer b.Destroy()
+
+	path := filepath.Join(t.TempDir(), "b.capture")
+	r, err := Create(path)
+	assert.NoError(t, err)
+	b.SetWireTap(r)
+
+	var sent []interface{}
+	for i := 0; i < 3; i++ {
+		msg := &example.GoGoProtobufTestMessage1{F0: proto.Int32(int32(i))}
+		sent = append(sent, msg)
+		assert.NoError(t, a.Send("b:8000", msg))
+		assert.Equal(t, msg, <-received)
+	}
+	// Reply, so there is an outbound record as well.
+	assert.NoError(t, b.Send("a:8000", sent[0]))
+	<-received
+	waitFor(t, func() bool { return r.Count() == 4 })
+	b.SetWireTap(nil)
+	assert.NoError(t, r.Close())
+
+	records, err := ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(records))
+	inbound := Inbound(records)
+	assert.Equal(t, 3, len(inbound))
+	for _, rec := range inbound {
+		assert.Equal(t, "a:8000", rec.Peer)
+	}
+	outbound := Filter(records, func(rec *Record) bool { return rec.Direction == messenger.Outbound })
+	assert.Equal(t, "a:8000", outbound[0].Peer)
+
+	// Replay into a fresh node.
+	c := newNode(t, network, "c:8000", received)
+	defer c.Destroy()
+	assert.NoError(t, ReplayFile(context.Background(), path, MessengerTarget(c), 0))
+	for i := range sent {
+		assert.Equal(t, sent[i], <-received)
+	}
+
+	// A damaged record stops the replay with an error.
+	damaged := []*Record{{Direction: messenger.Inbound, Peer: "a:8000"}, inbound[0]}
+	err = Replay(context.Background(), damaged, MessengerTarget(c), 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), messenger.ErrEmptyMessage.Error())
+	assert.Equal(t, 0, len(received))
+
+	// Replay over the transporter.
+	tr := transporter.NewLocalTransporter(network, "d:8000")
+	assert.NoError(t, Replay(context.Background(), inbound, TransporterTarget(tr, "c:8000"), 0))
+	for i := range sent {
+		assert.Equal(t, sent[i], <-received)
+	}
+}
+
+// Test the replay keeps the intervals, scaled by the speed.
+func TestReplaySpeed(t *testing.T) {
+	now := time.Now()
+	var records []*Record
+	for i := 0; i < 3; i++ {
+		records = append(records, &Record{Time: now.Add(time.Duration(i) * time.Second), Data: []byte{byte(i)}})
+	}
+
+	var offsets []time.Duration
+	start := time.Now()
+	target := TargetFunc(func(rec *Record) error {
+		offsets = append(offsets, time.Since(start))
+		return nil
+	})
+	assert.NoError(t, Replay(context.Background(), records, target, 10))
+	assert.Equal(t, 3, len(offsets))
+	assert.True(t, offsets[1] >= time.Millisecond*100, offsets[1])
+	assert.True(t, offsets[2] >= time.Millisecond*200, offsets[2])
+	assert.True(t, offsets[2] < time.Second, offsets[2])
+
+	// It's interrupted by the ctx.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, Replay(ctx, records, target, 1))
+	assert.Error(t, Replay(context.Background(), records, target, -1))
+}
+
+// Test the records survive the round trip through a capture.
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	r.Tap(messenger.Inbound, "a:8000", []byte{1, 2, 3})
+	r.Tap(messenger.Outbound, "b:8000", []byte{4})
+	assert.NoError(t, r.Close())
+	assert.Equal(t, 2, r.Count())
+
+	records, err := NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, messenger.Inbound, records[0].Direction)
+	assert.Equal(t, "a:8000", records[0].Peer)
+	assert.Equal(t, []byte{1, 2, 3}, records[0].Data)
+	assert.Equal(t, messenger.Outbound, records[1].Direction)
+
+	_, err = NewReader(bytes.NewBufferString(`{"Direction":"sideways"}`)).ReadAll()
+	assert.Error(t, err)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// Target receives the replayed records.
+type Target interface {
+	Replay(rec *Record) error
+}
+
+// TargetFunc is a function that receives the replayed records.
+type TargetFunc func(rec *Record) error
+
+// Replay calls the function.
+func (f TargetFunc) Replay(rec *Record) error {
+	return f(rec)
+}
+
+// MessengerTarget injects the records into the messenger, as if
+// they were received from their peers. The messenger must be running,
+// and the message types must be registered in the same order as the
+// captured node, so the codec decodes them the same way.
+func MessengerTarget(m *messenger.Messenger) Target {
+	return TargetFunc(func(rec *Record) error {
+		return m.Inject(rec.Peer, rec.Data)
+	})
+}
+
+// TransporterTarget sends the records to the host:port through
+// the transporter, e.g. to replay them to a node over the network.
+func TransporterTarget(tr transporter.Transporter, hostport string) Target {
+	return TargetFunc(func(rec *Record) error {
+		return tr.Send(hostport, rec.Data)
+	})
+}
+
+// Replay passes the records to the target in order. The speed
+// scales the intervals between the records: 1 replays at the
+// original speed, 10 replays ten times as fast, and 0 replays
+// as fast as possible. It stops at the first error, or when the
+// ctx is done.
+func Replay(ctx context.Context, records []*Record, target Target, speed float64) error {
+	if speed < 0 {
+		return fmt.Errorf("Invalid speed: %v", speed)
+	}
+	start := time.Now()
+	for i, rec := range records {
+		if speed > 0 && i > 0 {
+			// Schedule against the start rather than the previous
+			// record, so the delays don't add up.
+			offset := time.Duration(float64(rec.Time.Sub(records[0].Time)) / speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := target.Replay(rec); err != nil {
+			return fmt.Errorf("Failed to replay record %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// ReplayFile replays the inbound records in the capture file at the
+// path to the target, see Replay.
+func ReplayFile(ctx context.Context, path string, target Target, speed float64) error {
+	records, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return Replay(ctx, Inbound(records), target, speed)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/capture"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// send encodes the message in the protobuf text format, and sends
+// it to the node at the host:port.
+func send(r *registry, tr transporter.Transporter, to, typeName, text string) error {
+	b, err := r.encode(typeName, text)
+	if err != nil {
+		return err
+	}
+	return tr.Send(to, b)
+}
+
+// listen prints the messages received by the transporter,
+// until the ctx is done.
+func listen(ctx context.Context, r *registry, tr transporter.ContextTransporter, w io.Writer) error {
+	for {
+		from, b, err := tr.RecvFromContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		printFrame(w, r, time.Now(), fmt.Sprintf("from %v", from), b)
+	}
+}
+
+// decode prints the frames in the capture.
+func decode(r *registry, in io.Reader, w io.Writer) error {
+	reader := capture.NewReader(in)
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		prep := "to"
+		if rec.Direction == messenger.Inbound {
+			prep = "from"
+		}
+		printFrame(w, r, rec.Time, fmt.Sprintf("%v %v %v", rec.Direction, prep, rec.Peer), rec.Data)
+	}
+}
+
+// decodeHex prints a frame given in hex.
+func decodeHex(r *registry, s string, w io.Writer) error {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return err
+	}
+	printFrame(w, r, time.Time{}, "frame", b)
+	return nil
+}
+
+// printFrame prints a header line, and the decoded message in the
+// protobuf text format. A message that has neither a Go type nor a
+// schema is dumped in the wire format, and a frame that can't be
+// decoded is dumped in hex.
+func printFrame(w io.Writer, r *registry, t time.Time, header string, b []byte) {
+	if !t.IsZero() {
+		header = t.Format(time.RFC3339Nano) + " " + header
+	}
+	name, text, raw, err := r.decode(b)
+	if err != nil {
+		fmt.Fprintf(w, "%v: undecodable %d bytes: %v\n%s\n", header, len(b), err, hex.Dump(b))
+		return
+	}
+	if raw {
+		name += " (wire format)"
+	}
+	fmt.Fprintf(w, "%v: %v\n%v\n", header, name, text)
+}
+
+// readText returns the text of the message, from the args if
+// there is any, otherwise from the stdin.
+func readText(args []string) (string, error) {
+	if len(args) > 0 {
+		return strings.Join(args, " "), nil
+	}
+	b, err := ioutil.ReadAll(os.Stdin)
+	return string(b), err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/capture"
+	"github.com/go-distributed/messenger/membership"
+	"github.com/go-distributed/messenger/pubsub"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+func newPubSubRegistry(t *testing.T) *registry {
+	r, err := newRegistry([]string{"pubsub.Subscribe", "pubsub.Unsubscribe", "pubsub.Sync", "pubsub.Publication"}, nil)
+	assert.NoError(t, err)
+	return r
+}
+
+// Test a message in the text format is sent, and printed by listen.
+func TestSendListen(t *testing.T) {
+	r := newPubSubRegistry(t)
+	network := transporter.NewLocalNetwork()
+	sender := transporter.NewLocalTransporter(network, "wishmess:1")
+	receiver := transporter.NewLocalTransporter(network, "node:1")
+	go receiver.Start()
+	defer receiver.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	assert.NoError(t, send(r, sender, "node:1", "pubsub.Subscribe", `From: "wishmess:1" Topics: "news" Topics: "sports"`))
+	assert.Error(t, send(r, sender, "node:1", "pubsub.Subscribe", `Bogus: 1`))
+	assert.Error(t, send(r, sender, "node:1", "pubsub.Unknown", ``))
+
+	var out bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.NoError(t, listen(ctx, r, receiver, &out))
+	assert.Contains(t, out.String(), "from wishmess:1: pubsub.Subscribe\n")
+	assert.Contains(t, out.String(), "From: \"wishmess:1\"\nTopics: \"news\"\nTopics: \"sports\"\n")
+}
+
+// Test a message that only has a schema is sent, and printed by listen.
+func TestSendListenSchema(t *testing.T) {
+	r, err := newRegistry([]string{"pubsub.Sync", "custom.Event"}, newCustomSchema(t))
+	assert.NoError(t, err)
+	network := transporter.NewLocalNetwork()
+	sender := transporter.NewLocalTransporter(network, "wishmess:1")
+	receiver := transporter.NewLocalTransporter(network, "node:1")
+	go receiver.Start()
+	defer receiver.Stop()
+	time.Sleep(time.Millisecond * 100)
+
+	assert.NoError(t, send(r, sender, "node:1", "custom.Event", `name: "restart" level: INFO tags { key: "host" }`))
+	assert.Error(t, send(r, sender, "node:1", "custom.Event", `level: INFO`))
+	assert.Error(t, send(r, sender, "node:1", "custom.Event.Tag", `key: "host"`))
+
+	var out bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.NoError(t, listen(ctx, r, receiver, &out))
+	assert.Contains(t, out.String(), " from wishmess:1: custom.Event\nname: \"restart\"\nlevel: INFO\ntags: <\n  key: \"host\"\n>\n\n")
+}
+
+// Test the captured frames are decoded.
+func TestDecode(t *testing.T) {
+	r := newPubSubRegistry(t)
+	b, err := r.marshal(&pubsub.Sync{From: proto.String("a:8000"), Reply: proto.Bool(true)})
+	assert.NoError(t, err)
+
+	var in bytes.Buffer
+	rec := capture.NewRecorder(&in)
+	rec.Tap(messenger.Inbound, "a:8000", b)
+	rec.Tap(messenger.Outbound, "b:8000", []byte{0xff})
+	assert.NoError(t, rec.Close())
+
+	var out bytes.Buffer
+	assert.NoError(t, decode(r, &in, &out))
+	assert.Contains(t, out.String(), "inbound from a:8000: pubsub.Sync\nFrom: \"a:8000\"\nReply: true\n")
+	assert.Contains(t, out.String(), "outbound to b:8000: undecodable 1 bytes: Unknown message type: 255\n")
+
+	out.Reset()
+	assert.NoError(t, decodeHex(r, "0a 06 61 3a 38 30 30 30 02", &out))
+	assert.Equal(t, "frame: pubsub.Sync\nFrom: \"a:8000\"\n\n", out.String())
+	assert.Error(t, decodeHex(r, "zz", &out))
+}
+
+// Test the messages of unknown types are dumped in the wire format.
+func TestDecodeWire(t *testing.T) {
+	r, err := newRegistry([]string{"example.Custom"}, nil)
+	assert.NoError(t, err)
+	b, err := proto.Marshal(&membership.Sync{
+		From:    proto.String("a:8000"),
+		Updates: []*membership.Update{{Addr: proto.String("b:8000"), State: proto.Uint32(1), Incarnation: proto.Uint64(3)}},
+	})
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	printFrame(&out, r, time.Time{}, "frame", append(b, 0))
+	assert.Equal(t, "frame: example.Custom (wire format)\n1: \"a:8000\"\n2 {\n  1: \"b:8000\"\n  2: 1\n  3: 3\n}\n\n", out.String())
+
+	out.Reset()
+	printFrame(&out, r, time.Time{}, "frame", []byte{0x0a, 0x05, 0})
+	assert.Contains(t, out.String(), "frame: undecodable 3 bytes: Truncated bytes of field 1\n")
+}
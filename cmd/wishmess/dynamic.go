@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// decodeMessage prints the encoded message in the protobuf text
+// format, the same way proto.MarshalTextString prints a Go message.
+func decodeMessage(d *messageDesc, b []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, d, b, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type wireValue struct {
+	x uint64
+	v []byte
+}
+
+func writeMessage(buf *bytes.Buffer, d *messageDesc, b []byte, indent string) error {
+	values := make(map[*fieldDesc][]wireValue)
+	var unknown []byte
+	for len(b) > 0 {
+		number, wire, x, v, n, err := readField(b)
+		if err != nil {
+			return err
+		}
+		f := d.field(number)
+		switch {
+		case f == nil:
+			unknown = append(unknown, b[:n]...)
+		case wire == f.wireType():
+			values[f] = append(values[f], wireValue{x, v})
+		case wire == wireBytes:
+			// A packed repeated field.
+			packed, err := unpack(f, v)
+			if err != nil {
+				return err
+			}
+			values[f] = append(values[f], packed...)
+		default:
+			return fmt.Errorf("Wrong wire type %d of field %v.%v", wire, d.name, f.name)
+		}
+		b = b[n:]
+	}
+
+	// The fields are printed in the order of declaration, like
+	// the fields of the generated Go structs.
+	for _, f := range d.fields {
+		vs := values[f]
+		if len(vs) == 0 {
+			continue
+		}
+		if !f.repeated {
+			if f.message != nil {
+				// The occurrences of a message are merged.
+				var merged []byte
+				for _, v := range vs {
+					merged = append(merged, v.v...)
+				}
+				vs = []wireValue{{v: merged}}
+			} else {
+				vs = vs[len(vs)-1:]
+			}
+		}
+		for _, v := range vs {
+			if f.message == nil {
+				fmt.Fprintf(buf, "%s%s: %s\n", indent, f.name, formatValue(f, v))
+				continue
+			}
+			fmt.Fprintf(buf, "%s%s: <\n", indent, f.name)
+			if err := writeMessage(buf, f.message, v.v, indent+"  "); err != nil {
+				return err
+			}
+			fmt.Fprintf(buf, "%s>\n", indent)
+		}
+	}
+	if len(unknown) > 0 {
+		fmt.Fprintf(buf, "%s/* %d unknown bytes */\n", indent, len(unknown))
+		return dumpFields(buf, unknown, indent)
+	}
+	return nil
+}
+
+// unpack splits the values of a packed repeated field.
+func unpack(f *fieldDesc, b []byte) ([]wireValue, error) {
+	wire := f.wireType()
+	if wire == wireBytes {
+		return nil, fmt.Errorf("Wrong wire type %d of field %v", wireBytes, f.name)
+	}
+	var values []wireValue
+	for len(b) > 0 {
+		// Read the value as if it was a field, to share the decoding.
+		key := proto.EncodeVarint(f.number<<3 | wire)
+		_, _, x, _, n, err := readField(append(key, b...))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, wireValue{x: x})
+		b = b[n-len(key):]
+	}
+	return values, nil
+}
+
+// formatValue formats a scalar or an enum value like the text format.
+func formatValue(f *fieldDesc, v wireValue) string {
+	if f.enum != nil {
+		if name, ok := f.enum.names[int32(v.x)]; ok {
+			return name
+		}
+		return strconv.FormatInt(int64(int32(v.x)), 10)
+	}
+	x := v.x
+	switch f.scalar {
+	case "int32", "sfixed32":
+		return strconv.FormatInt(int64(int32(x)), 10)
+	case "int64", "sfixed64":
+		return strconv.FormatInt(int64(x), 10)
+	case "uint32", "fixed32":
+		return strconv.FormatUint(uint64(uint32(x)), 10)
+	case "sint32":
+		return strconv.FormatInt(int64(int32(uint32(x)>>1)^-int32(x&1)), 10)
+	case "sint64":
+		return strconv.FormatInt(int64(x>>1)^-int64(x&1), 10)
+	case "bool":
+		return strconv.FormatBool(x != 0)
+	case "float":
+		return formatFloat(float64(math.Float32frombits(uint32(x))), 32)
+	case "double":
+		return formatFloat(math.Float64frombits(x), 64)
+	case "string", "bytes":
+		return quote(v.v)
+	}
+	return strconv.FormatUint(x, 10)
+}
+
+func formatFloat(x float64, bits int) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "inf"
+	case math.IsInf(x, -1):
+		return "-inf"
+	case math.IsNaN(x):
+		return "nan"
+	}
+	return strconv.FormatFloat(x, 'g', -1, bits)
+}
+
+// quote quotes the bytes like the text format, with the C escapes.
+func quote(b []byte) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, c := range b {
+		switch c {
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		default:
+			if c >= 0x20 && c < 0x7f {
+				buf.WriteByte(c)
+			} else {
+				fmt.Fprintf(&buf, "\\%03o", c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// encodeMessage parses the message in the protobuf text format,
+// and encodes it.
+func encodeMessage(d *messageDesc, text string) ([]byte, error) {
+	toks, err := tokenize(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	p := &protoParser{toks: toks}
+	return p.parseText(d, "")
+}
+
+// parseText parses the fields of the message up to the end token,
+// or up to the end of the text if the end is empty.
+func (p *protoParser) parseText(d *messageDesc, end string) ([]byte, error) {
+	var b []byte
+	set := make(map[*fieldDesc]bool)
+	for end != "" || p.pos < len(p.toks) {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == end {
+			break
+		}
+		if tok == "," || tok == ";" {
+			continue
+		}
+		f := d.fieldByName(tok)
+		if f == nil {
+			return nil, fmt.Errorf("Unknown field %v in %v", tok, d.name)
+		}
+		if set[f] && !f.repeated {
+			return nil, fmt.Errorf("Non-repeated field %v.%v is repeated", d.name, f.name)
+		}
+		set[f] = true
+
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+		if tok == ":" {
+			if tok, err = p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if f.message != nil {
+			var close string
+			switch tok {
+			case "{":
+				close = "}"
+			case "<":
+				close = ">"
+			default:
+				return nil, fmt.Errorf("Expected \"{\" or \"<\" for field %v.%v, got %q", d.name, f.name, tok)
+			}
+			v, err := p.parseText(f.message, close)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, proto.EncodeVarint(f.number<<3|wireBytes)...)
+			b = append(b, proto.EncodeVarint(uint64(len(v)))...)
+			b = append(b, v...)
+			continue
+		}
+		if b, err = appendValue(b, f, tok); err != nil {
+			return nil, fmt.Errorf("Field %v.%v: %v", d.name, f.name, err)
+		}
+	}
+	for _, f := range d.fields {
+		if f.required && !set[f] {
+			return nil, fmt.Errorf("Required field %v.%v is not set", d.name, f.name)
+		}
+	}
+	return b, nil
+}
+
+// appendValue encodes a scalar or an enum field given in the text format.
+func appendValue(b []byte, f *fieldDesc, tok string) ([]byte, error) {
+	var x uint64
+	var err error
+	switch f.scalar {
+	case "":
+		v, ok := f.enum.values[tok]
+		if !ok {
+			n, err := strconv.ParseInt(tok, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Unknown enum value %v", tok)
+			}
+			v = int32(n)
+		}
+		x = uint64(int64(v))
+	case "int32", "int64", "sfixed64":
+		bits := 64
+		if f.scalar == "int32" {
+			bits = 32
+		}
+		var v int64
+		v, err = strconv.ParseInt(tok, 0, bits)
+		x = uint64(v)
+	case "sfixed32":
+		var v int64
+		v, err = strconv.ParseInt(tok, 0, 32)
+		x = uint64(uint32(v))
+	case "sint32", "sint64":
+		bits := 64
+		if f.scalar == "sint32" {
+			bits = 32
+		}
+		var v int64
+		v, err = strconv.ParseInt(tok, 0, bits)
+		x = uint64(v<<1 ^ v>>63)
+		if bits == 32 {
+			x = uint64(uint32(x))
+		}
+	case "uint32", "fixed32":
+		x, err = strconv.ParseUint(tok, 0, 32)
+	case "uint64", "fixed64":
+		x, err = strconv.ParseUint(tok, 0, 64)
+	case "bool":
+		var v bool
+		switch tok {
+		case "true", "t", "1":
+			v = true
+		case "false", "f", "0":
+		default:
+			err = fmt.Errorf("Invalid bool %v", tok)
+		}
+		if v {
+			x = 1
+		}
+	case "float":
+		var v float64
+		v, err = strconv.ParseFloat(tok, 32)
+		x = uint64(math.Float32bits(float32(v)))
+	case "double":
+		var v float64
+		v, err = strconv.ParseFloat(tok, 64)
+		x = math.Float64bits(v)
+	case "string", "bytes":
+		var v []byte
+		if v, err = unquote(tok); err != nil {
+			return nil, err
+		}
+		b = append(b, proto.EncodeVarint(f.number<<3|wireBytes)...)
+		b = append(b, proto.EncodeVarint(uint64(len(v)))...)
+		return append(b, v...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wire := f.wireType()
+	b = append(b, proto.EncodeVarint(f.number<<3|wire)...)
+	switch wire {
+	case wireFixed32:
+		return append(b, byte(x), byte(x>>8), byte(x>>16), byte(x>>24)), nil
+	case wireFixed64:
+		for i := 0; i < 8; i++ {
+			b = append(b, byte(x>>(8*uint(i))))
+		}
+		return b, nil
+	}
+	return append(b, proto.EncodeVarint(x)...), nil
+}
+
+// unquote unquotes a string of the text format, with the C escapes.
+func unquote(tok string) ([]byte, error) {
+	if len(tok) < 2 || tok[0] != tok[len(tok)-1] || tok[0] != '"' && tok[0] != '\'' {
+		return nil, fmt.Errorf("Expected a string, got %v", tok)
+	}
+	s := tok[1 : len(tok)-1]
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		if i++; i >= len(s) {
+			return nil, fmt.Errorf("Invalid escape in %v", tok)
+		}
+		switch c = s[i]; c {
+		case 'a':
+			b = append(b, '\a')
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'v':
+			b = append(b, '\v')
+		case '\\', '\'', '"', '?':
+			b = append(b, c)
+		case 'x', 'X', '0', '1', '2', '3', '4', '5', '6', '7':
+			base, digits, start := 8, 3, i
+			if c == 'x' || c == 'X' {
+				base, digits, start = 16, 2, i+1
+			}
+			end := start
+			for end < len(s) && end-start < digits && isDigit(s[end], base) {
+				end++
+			}
+			v, err := strconv.ParseUint(s[start:end], base, 8)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid escape in %v", tok)
+			}
+			b = append(b, byte(v))
+			i = end - 1
+		default:
+			return nil, fmt.Errorf("Invalid escape in %v", tok)
+		}
+	}
+	return b, nil
+}
+
+func isDigit(c byte, base int) bool {
+	if base == 16 {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	return c >= '0' && c <= '7'
+}
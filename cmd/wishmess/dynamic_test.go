@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/membership"
+	"github.com/go-distributed/testify/assert"
+)
+
+const customProto = `
+package custom;
+
+message Event {
+	enum Level { DEBUG = 0; INFO = 1; WARN = 2; }
+	message Tag { required string key = 1; optional bytes value = 2; }
+
+	required string name = 1;
+	optional Level level = 2;
+	repeated Tag tags = 3;
+	optional sint32 delta = 4;
+	optional sint64 offset = 5;
+	optional float ratio = 6;
+	optional double score = 7;
+	repeated fixed32 ids = 8 [packed = true];
+	optional sfixed64 stamp = 9;
+	optional bool ok = 10;
+	optional int32 code = 11;
+}
+`
+
+func newCustomSchema(t *testing.T) *schema {
+	s := newSchema()
+	assert.NoError(t, s.parseProto(strings.NewReader(customProto)))
+	assert.NoError(t, s.resolve())
+	return s
+}
+
+// Test the schema decodes the messages like their Go types.
+func TestDecodeMessage(t *testing.T) {
+	f, err := os.Open("../../membership/membership.proto")
+	assert.NoError(t, err)
+	defer f.Close()
+	s := newSchema()
+	assert.NoError(t, s.parseProto(f))
+	assert.NoError(t, s.resolve())
+
+	msg := &membership.Sync{
+		From: proto.String("a:8000\n\x01\"\\"),
+		Updates: []*membership.Update{
+			{Addr: proto.String("b:8000"), State: proto.Uint32(1), Incarnation: proto.Uint64(3)},
+			{Addr: proto.String("c:8000"), State: proto.Uint32(2), Incarnation: proto.Uint64(1 << 40)},
+		},
+		Reply: proto.Bool(true),
+	}
+	b, err := proto.Marshal(msg)
+	assert.NoError(t, err)
+	text, err := decodeMessage(s.messages["membership.Sync"], b)
+	assert.NoError(t, err)
+	assert.Equal(t, proto.MarshalTextString(msg), text)
+
+	// The unknown fields are dumped in the wire format.
+	text, err = decodeMessage(s.messages["membership.Update"], []byte{0x0a, 0x01, 'b', 0x20, 0x07})
+	assert.NoError(t, err)
+	assert.Equal(t, "Addr: \"b\"\n/* 2 unknown bytes */\n4: 7\n", text)
+
+	_, err = decodeMessage(s.messages["membership.Update"], []byte{0x0a, 0x05})
+	assert.Error(t, err)
+}
+
+// Test the messages in the text format are encoded by the schema.
+func TestEncodeMessage(t *testing.T) {
+	s := newCustomSchema(t)
+	d := s.messages["custom.Event"]
+
+	b, err := encodeMessage(d, `
+		name: "disk\tfull\001" level: WARN
+		tags { key: "host" value: "\x00\377" }
+		tags < key: 'zone' >
+		delta: -3 offset: -1099511627776
+		ratio: 0.5 score: -inf
+		ids: 1 ids: 4294967295
+		stamp: -2 ok: true code: -1
+	`)
+	assert.NoError(t, err)
+	text, err := decodeMessage(d, b)
+	assert.NoError(t, err)
+	assert.Equal(t, `name: "disk\tfull\001"
+level: WARN
+tags: <
+  key: "host"
+  value: "\000\377"
+>
+tags: <
+  key: "zone"
+>
+delta: -3
+offset: -1099511627776
+ratio: 0.5
+score: -inf
+ids: 1
+ids: 4294967295
+stamp: -2
+ok: true
+code: -1
+`, text)
+
+	// The packed repeated fields are decoded.
+	text, err = decodeMessage(d, []byte{0x0a, 0x01, 'e', 0x42, 0x08, 1, 0, 0, 0, 2, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, "name: \"e\"\nids: 1\nids: 2\n", text)
+
+	for _, text := range []string{
+		``,
+		`name: "a" bogus: 1`,
+		`name: "a" name: "b"`,
+		`name: "a" level: FATAL`,
+		`name: "a" code: 2147483648`,
+		`name: "a" tags { value: "v" }`,
+		`name: "a" tags: "v"`,
+		`name: "a" ok: maybe`,
+		`name: "a\q"`,
+		`name: a`,
+		`name: "a" tags {`,
+	} {
+		_, err := encodeMessage(d, text)
+		assert.Error(t, err, text)
+	}
+}
@@ -0,0 +1,199 @@
+// Command wishmess sends and inspects the messages of the messenger
+// nodes, without writing a Go program.
+//
+// The node's codec identifies a message by the order its type is
+// registered, so wishmess must register the same types in the same
+// order as the node. -types lists the names in that order, and
+// -proto gives the .proto files that declare the messages:
+//
+//	wishmess send -types pubsub.Subscribe,pubsub.Unsubscribe,pubsub.Sync,pubsub.Publication \
+//		-to localhost:8000 -type pubsub.Subscribe 'From: "localhost:9000" Topics: "news"'
+//	wishmess listen -types membership.Ping,membership.Ack,membership.PingReq,membership.Sync \
+//		-proto membership/membership.proto -addr localhost:9000
+//	wishmess decode -proto pubsub/pubsub.proto incident.capture
+//	wishmess decode -proto pubsub/pubsub.proto -hex 0a0e6c6f63616c686f73743a3930303000
+//
+// Without -types, the messages declared at the top level of the
+// .proto files are registered in the order of declaration. That only
+// matches a node that registers every one of them, in that order:
+// pubsub does, but membership doesn't register Update, so its nodes
+// need -types.
+//
+// The message of send is in the protobuf text format, with the field
+// names of the .proto. It's read from the stdin if it's not given in
+// the arguments. The captures are the files written by the capture
+// package.
+//
+// The messages built in this repository (the test examples, pubsub,
+// membership and detector) are encoded by their Go types. The others
+// are encoded by the schema parsed from the .proto files, which
+// supports the messages, the nested messages, the enums and the
+// oneofs, but not the maps and the groups. A registered message
+// without a .proto is decoded by the field numbers and the wire
+// values, without the field names, and can't be sent.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/go-distributed/messenger/transporter"
+)
+
+const usage = `Usage: wishmess <command> [flags] [args]
+
+Commands:
+  send    -to host:port -type name [message]   send a message in the text format
+  listen  -addr host:port                      print the incoming messages
+  decode  [-hex frame] [capture ...]           print the captured messages
+
+All the commands take -types name,... to register the messages in the
+same order as the node, and -proto file.proto,... to give the schemas
+of the messages. Without -types, the top level messages of the .proto
+files are registered in the order of declaration, which only matches
+a node that registers all of them in that order.
+
+The messages built in this repository (protobuf.GoGoProtobufTestMessage*,
+pubsub.*, membership.* and detector.*) don't need a .proto. A message
+without a Go type or a .proto is printed by field number in the wire
+format, and can't be sent.
+Run 'wishmess <command> -h' for the flags of the command.
+`
+
+func main() {
+	// The glog flags are not used, but glog complains if
+	// the command line is not parsed.
+	flag.CommandLine.Parse(nil)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "send":
+		err = runSend(args)
+	case "listen":
+		err = runListen(args)
+	case "decode":
+		err = runDecode(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n\n%v", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wishmess %v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet creates the flags of the command, with the flags
+// of the registration.
+func newFlagSet(name string) (*flag.FlagSet, *string, *string) {
+	fs := flag.NewFlagSet("wishmess "+name, flag.ExitOnError)
+	types := fs.String("types", "", "Comma-separated message names, in the order the node registers them")
+	protos := fs.String("proto", "", "Comma-separated .proto files with the schemas of the messages, registered in the order of declaration if -types is not given")
+	return fs, types, protos
+}
+
+func runSend(args []string) error {
+	fs, types, protos := newFlagSet("send")
+	to := fs.String("to", "", "The host:port of the node")
+	typeName := fs.String("type", "", "The name of the message type")
+	from := fs.String("from", "", "The host:port the node should reply to, if any")
+	fs.Parse(args)
+	if *to == "" || *typeName == "" {
+		return fmt.Errorf("-to and -type are required")
+	}
+
+	names, s, err := registration(*types, *protos)
+	if err != nil {
+		return err
+	}
+	r, err := newRegistry(names, s)
+	if err != nil {
+		return err
+	}
+	text, err := readText(fs.Args())
+	if err != nil {
+		return err
+	}
+	return send(r, transporter.NewHTTPTransporter(*from), *to, *typeName, text)
+}
+
+func runListen(args []string) error {
+	fs, types, protos := newFlagSet("listen")
+	addr := fs.String("addr", "", "The host:port to listen on")
+	fs.Parse(args)
+	if *addr == "" {
+		return fmt.Errorf("-addr is required")
+	}
+
+	names, s, err := registration(*types, *protos)
+	if err != nil {
+		return err
+	}
+	r, err := newRegistry(names, s)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	tr := transporter.NewHTTPTransporter(*addr)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tr.Start()
+	}()
+	defer tr.Stop()
+	fmt.Fprintf(os.Stderr, "Listening on %v, press Ctrl-C to stop\n", *addr)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listen(ctx, r, tr, os.Stdout)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case err := <-done:
+		return err
+	}
+}
+
+func runDecode(args []string) error {
+	fs, types, protos := newFlagSet("decode")
+	frame := fs.String("hex", "", "Decode a single frame given in hex")
+	fs.Parse(args)
+
+	names, s, err := registration(*types, *protos)
+	if err != nil {
+		return err
+	}
+	r, err := newRegistry(names, s)
+	if err != nil {
+		return err
+	}
+	if *frame != "" {
+		return decodeHex(r, *frame, os.Stdout)
+	}
+	if fs.NArg() == 0 {
+		return decode(r, os.Stdin, os.Stdout)
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = decode(r, f, os.Stdout)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// schema holds the messages and the enums declared in .proto files,
+// so the messages without a Go type can be encoded and decoded.
+type schema struct {
+	messages map[string]*messageDesc // By full name.
+	enums    map[string]*enumDesc    // By full name.
+	order    []string                // The top level messages, in the order of declaration.
+}
+
+type messageDesc struct {
+	name   string // Full name.
+	fields []*fieldDesc
+}
+
+type fieldDesc struct {
+	name     string
+	number   uint64
+	repeated bool
+	required bool
+	typeName string // As declared.
+	scope    string // Where it's declared, to resolve the type.
+
+	// Resolved, exactly one of them is set.
+	scalar  string
+	message *messageDesc
+	enum    *enumDesc
+}
+
+type enumDesc struct {
+	names  map[int32]string
+	values map[string]int32
+}
+
+// The scalar types, by their wire type.
+var scalarWireTypes = map[string]uint64{
+	"int32": wireVarint, "int64": wireVarint, "uint32": wireVarint, "uint64": wireVarint,
+	"sint32": wireVarint, "sint64": wireVarint, "bool": wireVarint,
+	"fixed64": wireFixed64, "sfixed64": wireFixed64, "double": wireFixed64,
+	"fixed32": wireFixed32, "sfixed32": wireFixed32, "float": wireFixed32,
+	"string": wireBytes, "bytes": wireBytes,
+}
+
+func newSchema() *schema {
+	return &schema{
+		messages: make(map[string]*messageDesc),
+		enums:    make(map[string]*enumDesc),
+	}
+}
+
+// wireType returns the wire type of the field.
+func (f *fieldDesc) wireType() uint64 {
+	switch {
+	case f.message != nil:
+		return wireBytes
+	case f.enum != nil:
+		return wireVarint
+	}
+	return scalarWireTypes[f.scalar]
+}
+
+// field returns the field with the number, or nil.
+func (d *messageDesc) field(number uint64) *fieldDesc {
+	for _, f := range d.fields {
+		if f.number == number {
+			return f
+		}
+	}
+	return nil
+}
+
+// fieldByName returns the field with the name, or nil.
+func (d *messageDesc) fieldByName(name string) *fieldDesc {
+	for _, f := range d.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// resolve resolves the types of the fields, once all the files
+// are parsed. A type is looked up from the innermost scope, like
+// protoc does.
+func (s *schema) resolve() error {
+	for _, d := range s.messages {
+		for _, f := range d.fields {
+			if _, ok := scalarWireTypes[f.typeName]; ok {
+				f.scalar = f.typeName
+				continue
+			}
+			var candidates []string
+			if strings.HasPrefix(f.typeName, ".") {
+				candidates = []string{f.typeName[1:]}
+			} else {
+				for scope := f.scope; ; scope = parentScope(scope) {
+					candidates = append(candidates, join(scope, f.typeName))
+					if scope == "" {
+						break
+					}
+				}
+			}
+			for _, name := range candidates {
+				if f.message = s.messages[name]; f.message != nil {
+					break
+				}
+				if f.enum = s.enums[name]; f.enum != nil {
+					break
+				}
+			}
+			if f.message == nil && f.enum == nil {
+				return fmt.Errorf("Unknown type %v of field %v.%v", f.typeName, d.name, f.name)
+			}
+		}
+	}
+	return nil
+}
+
+func parentScope(scope string) string {
+	if i := strings.LastIndex(scope, "."); i >= 0 {
+		return scope[:i]
+	}
+	return ""
+}
+
+func join(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// parseProto adds the messages and the enums declared in the .proto
+// to the schema. It understands the subset of the language that
+// describes the messages: the services, the options and the
+// extensions are skipped, the maps and the groups are not supported.
+func (s *schema) parseProto(r io.Reader) error {
+	toks, err := tokenize(r)
+	if err != nil {
+		return err
+	}
+	p := &protoParser{schema: s, toks: toks}
+	return p.parseFile()
+}
+
+type protoParser struct {
+	schema *schema
+	toks   []string
+	pos    int
+	pkg    string
+}
+
+func (p *protoParser) next() (string, error) {
+	if p.pos >= len(p.toks) {
+		return "", fmt.Errorf("Unexpected end of file")
+	}
+	tok := p.toks[p.pos]
+	p.pos++
+	return tok, nil
+}
+
+func (p *protoParser) expect(want string) error {
+	tok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("Expected %q, got %q", want, tok)
+	}
+	return nil
+}
+
+// skip skips the tokens up to the end of the statement, or up to
+// the end of the block if the statement has one.
+func (p *protoParser) skip() error {
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case ";":
+			return nil
+		case "{":
+			return p.skipBlock()
+		}
+	}
+}
+
+// skipBlock skips the tokens up to the closing brace.
+func (p *protoParser) skipBlock() error {
+	for depth := 1; depth > 0; {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		}
+	}
+	return nil
+}
+
+func (p *protoParser) parseFile() error {
+	for p.pos < len(p.toks) {
+		tok, _ := p.next()
+		switch tok {
+		case ";":
+		case "package":
+			pkg, err := p.next()
+			if err != nil {
+				return err
+			}
+			p.pkg = pkg
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "syntax", "import", "option", "service", "extend":
+			if err := p.skip(); err != nil {
+				return err
+			}
+		case "message":
+			name, err := p.parseMessage(p.pkg)
+			if err != nil {
+				return err
+			}
+			p.schema.order = append(p.schema.order, name)
+		case "enum":
+			if err := p.parseEnum(p.pkg); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unexpected %q", tok)
+		}
+	}
+	return nil
+}
+
+// parseMessage parses a message after the keyword, and returns its full name.
+func (p *protoParser) parseMessage(scope string) (string, error) {
+	name, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	d := &messageDesc{name: join(scope, name)}
+	if _, ok := p.schema.messages[d.name]; ok {
+		return "", fmt.Errorf("Message %v is already declared", d.name)
+	}
+	p.schema.messages[d.name] = d
+	if err := p.expect("{"); err != nil {
+		return "", err
+	}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return "", err
+		}
+		switch tok {
+		case "}":
+			return d.name, nil
+		case ";":
+		case "message":
+			if _, err := p.parseMessage(d.name); err != nil {
+				return "", err
+			}
+		case "enum":
+			if err := p.parseEnum(d.name); err != nil {
+				return "", err
+			}
+		case "option", "reserved", "extensions", "extend":
+			if err := p.skip(); err != nil {
+				return "", err
+			}
+		case "oneof":
+			if err := p.parseOneof(d); err != nil {
+				return "", err
+			}
+		case "map", "group":
+			return "", fmt.Errorf("Unsupported %v in message %v", tok, d.name)
+		default:
+			if err := p.parseField(d, tok); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseOneof(d *messageDesc) error {
+	if _, err := p.next(); err != nil {
+		return err
+	}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "}":
+			return nil
+		case "option":
+			if err := p.skip(); err != nil {
+				return err
+			}
+		default:
+			if err := p.parseField(d, tok); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseField parses a field, the tok is its first token.
+func (p *protoParser) parseField(d *messageDesc, tok string) error {
+	f := &fieldDesc{scope: d.name}
+	switch tok {
+	case "repeated", "required", "optional":
+		f.repeated = tok == "repeated"
+		f.required = tok == "required"
+		var err error
+		if tok, err = p.next(); err != nil {
+			return err
+		}
+	}
+	if tok == "map" || tok == "group" {
+		return fmt.Errorf("Unsupported %v in message %v", tok, d.name)
+	}
+	f.typeName = tok
+	var err error
+	if f.name, err = p.next(); err != nil {
+		return err
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := p.next()
+	if err != nil {
+		return err
+	}
+	if f.number, err = strconv.ParseUint(number, 0, 29); err != nil || f.number == 0 {
+		return fmt.Errorf("Invalid number %q of field %v.%v", number, d.name, f.name)
+	}
+	tok, err = p.next()
+	if err != nil {
+		return err
+	}
+	if tok == "[" {
+		// Skip the options of the field.
+		for tok != "]" {
+			if tok, err = p.next(); err != nil {
+				return err
+			}
+		}
+		if tok, err = p.next(); err != nil {
+			return err
+		}
+	}
+	if tok != ";" {
+		return fmt.Errorf("Expected \";\" after field %v.%v, got %q", d.name, f.name, tok)
+	}
+	d.fields = append(d.fields, f)
+	return nil
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	name, err := p.next()
+	if err != nil {
+		return err
+	}
+	e := &enumDesc{names: make(map[int32]string), values: make(map[string]int32)}
+	p.schema.enums[join(scope, name)] = e
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case "}":
+			return nil
+		case ";":
+			continue
+		case "option", "reserved":
+			if err := p.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		number, err := p.next()
+		if err != nil {
+			return err
+		}
+		v, err := strconv.ParseInt(number, 0, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q of %v", number, tok)
+		}
+		if err := p.skip(); err != nil {
+			return err
+		}
+		if _, ok := e.names[int32(v)]; !ok {
+			e.names[int32(v)] = tok
+		}
+		e.values[tok] = int32(v)
+	}
+}
+
+// tokenize splits the .proto into the identifiers, the numbers,
+// the strings and the punctuation, without the comments.
+func tokenize(r io.Reader) ([]string, error) {
+	b, err := io.ReadAll(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	src := string(b)
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated comment")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("Unterminated string")
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		case isIdentChar(c) || c == '-' || c == '+':
+			j := i + 1
+			for j < len(src) && (isIdentChar(src[j]) || isExponentSign(src[i:j], src[j])) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// isExponentSign tells whether the c is the sign of the exponent
+// of the number, like in 1e-3.
+func isExponentSign(num string, c byte) bool {
+	if c != '-' && c != '+' {
+		return false
+	}
+	last := num[len(num)-1]
+	num = strings.TrimLeft(num, "-+")
+	return (last == 'e' || last == 'E') && num != "" && num[0] >= '0' && num[0] <= '9' && !strings.HasPrefix(num, "0x")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/detector"
+	"github.com/go-distributed/messenger/membership"
+	"github.com/go-distributed/messenger/pubsub"
+)
+
+// knownTypes are the messages built in this repository, by their
+// full protobuf name. They are encoded and decoded by their Go types,
+// the other messages by the schemas parsed from the .proto files.
+var knownTypes = map[string]proto.Message{
+	"protobuf.GoGoProtobufTestMessage1": &example.GoGoProtobufTestMessage1{},
+	"protobuf.GoGoProtobufTestMessage2": &example.GoGoProtobufTestMessage2{},
+	"protobuf.GoGoProtobufTestMessage3": &example.GoGoProtobufTestMessage3{},
+	"protobuf.GoGoProtobufTestMessage4": &example.GoGoProtobufTestMessage4{},
+	"protobuf.GoGoProtobufTestMessage5": &example.GoGoProtobufTestMessage5{},
+
+	"pubsub.Subscribe":   &pubsub.Subscribe{},
+	"pubsub.Unsubscribe": &pubsub.Unsubscribe{},
+	"pubsub.Sync":        &pubsub.Sync{},
+	"pubsub.Publication": &pubsub.Publication{},
+
+	"membership.Update":  &membership.Update{},
+	"membership.Ping":    &membership.Ping{},
+	"membership.Ack":     &membership.Ack{},
+	"membership.PingReq": &membership.PingReq{},
+	"membership.Sync":    &membership.Sync{},
+
+	"detector.Heartbeat": &detector.Heartbeat{},
+}
+
+// maxTypes is the number of the message types a type byte can tell.
+const maxTypes = 256
+
+// registry maps the message types to the type bytes, in the same
+// order as the node registers them. The frames are encoded like
+// the GoGoProtobufCodec does, the protobuf encoding followed by the
+// type byte. The messages that are neither in knownTypes nor in the
+// schema still take their place in the order, so the type bytes of
+// the others match.
+type registry struct {
+	names  []string // Indexed by the type byte.
+	types  map[reflect.Type]byte
+	schema *schema
+}
+
+// newRegistry registers the messages in the order of the names.
+// The schema may be nil.
+func newRegistry(names []string, s *schema) (*registry, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No message is registered, use -types or -proto")
+	}
+	if len(names) > maxTypes {
+		return nil, fmt.Errorf("Too many message types: %d, at most %d", len(names), maxTypes)
+	}
+	if s == nil {
+		s = newSchema()
+	}
+	r := &registry{
+		names:  names,
+		types:  make(map[reflect.Type]byte),
+		schema: s,
+	}
+	seen := make(map[string]bool)
+	for i, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("Message type %v is already registered", name)
+		}
+		seen[name] = true
+		if msg, ok := knownTypes[name]; ok {
+			r.types[reflect.TypeOf(msg)] = byte(i)
+		}
+	}
+	return r, nil
+}
+
+// marshal encodes the message into a frame.
+func (r *registry) marshal(msg proto.Message) ([]byte, error) {
+	mtype, ok := r.types[reflect.TypeOf(msg)]
+	if !ok {
+		return nil, fmt.Errorf("Message type %v is not registered", reflect.TypeOf(msg))
+	}
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, mtype), nil
+}
+
+// unmarshal decodes the frame, it returns the name of the message
+// type, and a nil message if the type is not in knownTypes.
+func (r *registry) unmarshal(b []byte) (string, proto.Message, error) {
+	name, err := r.typeName(b)
+	if err != nil {
+		return "", nil, err
+	}
+	msg, ok := knownTypes[name]
+	if !ok {
+		return name, nil, nil
+	}
+	msg = reflect.New(reflect.TypeOf(msg).Elem()).Interface().(proto.Message)
+	if err := proto.Unmarshal(b[:len(b)-1], msg); err != nil {
+		return name, nil, err
+	}
+	return name, msg, nil
+}
+
+// typeName returns the name of the message type of the frame.
+func (r *registry) typeName(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", fmt.Errorf("Empty frame")
+	}
+	mtype := int(b[len(b)-1])
+	if mtype >= len(r.names) {
+		return "", fmt.Errorf("Unknown message type: %v", mtype)
+	}
+	return r.names[mtype], nil
+}
+
+// decode decodes the frame, and returns the name of the message type
+// and the message in the text format. A message that has neither a
+// Go type nor a schema is dumped in the wire format, with the raw
+// set.
+func (r *registry) decode(b []byte) (name, text string, raw bool, err error) {
+	name, msg, err := r.unmarshal(b)
+	if err != nil {
+		return name, "", false, err
+	}
+	if msg != nil {
+		return name, proto.MarshalTextString(msg), false, nil
+	}
+	if d, ok := r.schema.messages[name]; ok {
+		text, err = decodeMessage(d, b[:len(b)-1])
+		return name, text, false, err
+	}
+	text, err = dumpWire(b[:len(b)-1])
+	return name, text, true, err
+}
+
+// encode parses the message of the type in the text format, and
+// encodes it into a frame.
+func (r *registry) encode(name, text string) ([]byte, error) {
+	if msg, ok := knownTypes[name]; ok {
+		msg = reflect.New(reflect.TypeOf(msg).Elem()).Interface().(proto.Message)
+		if err := proto.UnmarshalText(text, msg); err != nil {
+			return nil, fmt.Errorf("Failed to parse %v: %v", name, err)
+		}
+		return r.marshal(msg)
+	}
+	d, ok := r.schema.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown message type: %v, give its .proto with -proto", name)
+	}
+	for mtype, registered := range r.names {
+		if registered != name {
+			continue
+		}
+		b, err := encodeMessage(d, text)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %v: %v", name, err)
+		}
+		return append(b, byte(mtype)), nil
+	}
+	return nil, fmt.Errorf("Message type %v is not registered", name)
+}
+
+// registration returns the names of the messages to register, and
+// the schema of the messages declared in the .proto files. The
+// types list the names in the order the node registers them. If
+// it's empty, the messages declared at the top level of the .proto
+// files are registered in the order of declaration, which only
+// matches a node that registers all of them in that order.
+func registration(types, protos string) ([]string, *schema, error) {
+	s := newSchema()
+	for _, path := range strings.Split(protos, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = s.parseProto(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse %v: %v", path, err)
+		}
+	}
+	if err := s.resolve(); err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(types, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = s.order
+	}
+	return names, s, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/membership"
+	"github.com/go-distributed/messenger/pubsub"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the messages are parsed from the .proto.
+func TestParseProto(t *testing.T) {
+	s := newSchema()
+	assert.NoError(t, s.parseProto(strings.NewReader(`
+syntax = "proto2";
+package example;
+import "other.proto";
+option go_package = "example";
+
+/* message Commented {} */
+message Outer {
+	// message Commented {}
+	message Inner { required int32 a = 1 [default = 3]; }
+	enum Kind { A = 0; B = 1 [deprecated = true]; }
+	optional Inner inner = 1;
+	repeated Kind kinds = 2 [packed = true];
+	oneof choice {
+		string name = 3;
+		.example.Other other = 4;
+	}
+	reserved 5, 6;
+	extensions 100 to 199;
+}
+message Other{ repeated string b = 1; }
+service Service { rpc Call (Outer) returns (Other) {} }
+`)))
+	assert.NoError(t, s.resolve())
+	assert.Equal(t, []string{"example.Outer", "example.Other"}, s.order)
+
+	outer := s.messages["example.Outer"]
+	assert.Equal(t, 4, len(outer.fields))
+	assert.Equal(t, s.messages["example.Outer.Inner"], outer.fieldByName("inner").message)
+	assert.Equal(t, "B", outer.fieldByName("kinds").enum.names[1])
+	assert.True(t, outer.fieldByName("kinds").repeated)
+	assert.Equal(t, s.messages["example.Other"], outer.field(4).message)
+	assert.True(t, s.messages["example.Outer.Inner"].fields[0].required)
+
+	for _, src := range []string{
+		"message Broken {",
+		"message Map { map<string, int32> m = 1; }",
+		"message Group { optional group G = 1 { optional int32 a = 2; } }",
+		"message Zero { optional int32 a = 0; }",
+		"message Twice {} message Twice {}",
+		"/* message Unterminated {}",
+	} {
+		assert.Error(t, newSchema().parseProto(strings.NewReader(src)), src)
+	}
+	s = newSchema()
+	assert.NoError(t, s.parseProto(strings.NewReader("message Unknown { optional Missing m = 1; }")))
+	assert.Error(t, s.resolve())
+}
+
+func writeProto(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	path = filepath.Join(t.TempDir(), filepath.Base(path))
+	assert.NoError(t, os.WriteFile(path, b, 0644))
+	return path
+}
+
+// Test the messages are registered in the order of the node.
+func TestRegistration(t *testing.T) {
+	path := writeProto(t, "../../pubsub/pubsub.proto")
+
+	// Without -types, the order of declaration.
+	names, _, err := registration("", path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pubsub.Subscribe", "pubsub.Unsubscribe", "pubsub.Sync", "pubsub.Publication"}, names)
+
+	// With -types, only the types, in their order.
+	names, s, err := registration("detector.Heartbeat, pubsub.Sync", path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"detector.Heartbeat", "pubsub.Sync"}, names)
+
+	r, err := newRegistry(names, s)
+	assert.NoError(t, err)
+	// The type byte is the index of the registration.
+	data, err := r.marshal(&pubsub.Sync{From: proto.String("a:8000")})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), data[len(data)-1])
+	name, msg, err := r.unmarshal(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "pubsub.Sync", name)
+	assert.Equal(t, &pubsub.Sync{From: proto.String("a:8000")}, msg)
+
+	// The membership nodes don't register Update, so its
+	// order of declaration doesn't match them.
+	path = writeProto(t, "../../membership/membership.proto")
+	names, s, err = registration("membership.Ping,membership.Ack,membership.PingReq,membership.Sync", path)
+	assert.NoError(t, err)
+	r, err = newRegistry(names, s)
+	assert.NoError(t, err)
+	data, err = r.marshal(&membership.Sync{From: proto.String("a:8000")})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(3), data[len(data)-1])
+
+	// The unknown types take their place, but can't be encoded.
+	r, err = newRegistry([]string{"example.Custom", "pubsub.Sync"}, nil)
+	assert.NoError(t, err)
+	data, err = r.marshal(&pubsub.Sync{From: proto.String("a:8000")})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(1), data[len(data)-1])
+	name, msg, err = r.unmarshal([]byte{0})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.Custom", name)
+	assert.Nil(t, msg)
+	_, err = r.marshal(&pubsub.Subscribe{})
+	assert.Error(t, err)
+	_, err = r.encode("example.Custom", "")
+	assert.Error(t, err)
+
+	_, err = newRegistry(nil, nil)
+	assert.Error(t, err)
+	_, err = newRegistry([]string{"pubsub.Sync", "pubsub.Sync"}, nil)
+	assert.Error(t, err)
+	_, err = newRegistry(make([]string, maxTypes+1), nil)
+	assert.Error(t, err)
+	_, _, err = registration("", "missing.proto")
+	assert.Error(t, err)
+}
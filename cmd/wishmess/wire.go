@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// The protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// dumpWire prints an encoded message whose type is unknown, by the
+// field numbers and the wire values. The length-delimited values
+// are printed as strings if they are printable, as nested messages
+// if they parse as such, and in hex otherwise.
+func dumpWire(b []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := dumpFields(&buf, b, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func dumpFields(buf *bytes.Buffer, b []byte, indent string) error {
+	for len(b) > 0 {
+		field, wire, x, v, n, err := readField(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		switch wire {
+		case wireVarint:
+			fmt.Fprintf(buf, "%s%d: %d\n", indent, field, x)
+		case wireFixed64:
+			fmt.Fprintf(buf, "%s%d: 0x%016x\n", indent, field, x)
+		case wireFixed32:
+			fmt.Fprintf(buf, "%s%d: 0x%08x\n", indent, field, x)
+		case wireBytes:
+			dumpBytes(buf, field, v, indent)
+		}
+	}
+	return nil
+}
+
+// readField reads a field, and returns its number, its wire type,
+// its value, and the number of bytes read. The value is in x for
+// the varints and the fixed values, and in v for the bytes.
+func readField(b []byte) (field, wire, x uint64, v []byte, n int, err error) {
+	key, n := proto.DecodeVarint(b)
+	if n == 0 {
+		return 0, 0, 0, nil, 0, fmt.Errorf("Truncated field key")
+	}
+	field, wire = key>>3, key&7
+	if field == 0 {
+		return 0, 0, 0, nil, 0, fmt.Errorf("Invalid field number 0")
+	}
+	b = b[n:]
+	switch wire {
+	case wireVarint:
+		var l int
+		if x, l = proto.DecodeVarint(b); l == 0 {
+			return 0, 0, 0, nil, 0, fmt.Errorf("Truncated varint of field %d", field)
+		}
+		n += l
+	case wireFixed64, wireFixed32:
+		size := 8
+		if wire == wireFixed32 {
+			size = 4
+		}
+		if len(b) < size {
+			return 0, 0, 0, nil, 0, fmt.Errorf("Truncated fixed value of field %d", field)
+		}
+		for i := size - 1; i >= 0; i-- {
+			x = x<<8 | uint64(b[i])
+		}
+		n += size
+	case wireBytes:
+		l, m := proto.DecodeVarint(b)
+		if m == 0 || uint64(len(b)-m) < l {
+			return 0, 0, 0, nil, 0, fmt.Errorf("Truncated bytes of field %d", field)
+		}
+		v = b[m : m+int(l)]
+		n += m + int(l)
+	default:
+		return 0, 0, 0, nil, 0, fmt.Errorf("Unsupported wire type %d of field %d", wire, field)
+	}
+	return field, wire, x, v, n, nil
+}
+
+// dumpBytes prints a length-delimited value.
+func dumpBytes(buf *bytes.Buffer, field uint64, v []byte, indent string) {
+	if printable(v) {
+		fmt.Fprintf(buf, "%s%d: %q\n", indent, field, v)
+		return
+	}
+	var nested bytes.Buffer
+	if err := dumpFields(&nested, v, indent+"  "); err == nil {
+		fmt.Fprintf(buf, "%s%d {\n%s%s}\n", indent, field, nested.String(), indent)
+		return
+	}
+	fmt.Fprintf(buf, "%s%d: 0x%x\n", indent, field, v)
+}
+
+// printable tells whether the value looks like a string.
+func printable(v []byte) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	return strings.IndexFunc(string(v), func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	}) < 0
+}
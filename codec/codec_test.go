@@ -171,3 +171,23 @@ func BenchmarkGoGoProtoBufCodecUnmarshal(b *testing.B) {
 		}
 	}
 }
+
+// Test registering messages while marshalling/unmarshalling.
+func TestGoGoProtobufCodecConcurrency(t *testing.T) {
+	c := NewGoGoProtobufCodec()
+	assert.NoError(t, c.Initial())
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	msg := generateGoGoProtobufMessages()[0]
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			testMarshalUnmarshal(t, c, msg)
+		}
+		close(done)
+	}()
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, c.RegisterMessage(&example.GoGoProtobufTestMessage3{}))
+	<-done
+	assert.NoError(t, c.Destroy())
+}
@@ -3,6 +3,7 @@ package codec
 import (
 	"fmt"
 	"reflect"
+	"sync"
 
 	"code.google.com/p/gogoprotobuf/proto"
 	log "github.com/golang/glog"
@@ -13,7 +14,9 @@ type messageType uint8
 
 // GoGoProtobufCodec implements the codec interface for Codec.
 // We use reflect to make it a 'self-explained' codec.
+// It's safe to register messages while marshalling/unmarshalling.
 type GoGoProtobufCodec struct {
+	mu                    sync.RWMutex
 	registeredMessages    map[reflect.Type]messageType
 	reversedMap           map[messageType]reflect.Type
 	registeredMessagePtrs map[reflect.Type]messageType
@@ -52,6 +55,10 @@ func (c *GoGoProtobufCodec) RegisterMessage(msg interface{}) error {
 		concreteType = msgTypeValue.Type()
 		ptrType = reflect.PtrTo(concreteType)
 	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if _, ok := c.registeredMessages[concreteType]; ok {
 		return fmt.Errorf("Message type %v is already registered", concreteType)
 	}
@@ -78,7 +85,9 @@ func (c *GoGoProtobufCodec) Marshal(msg interface{}) ([]byte, error) {
 	}()
 
 	// Check if the message is registered.
+	c.mu.RLock()
 	mtype, ok := c.registeredMessagePtrs[reflect.TypeOf(msg)]
+	c.mu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Unknown message type: %v", reflect.ValueOf(msg).Elem().Type())
 	}
@@ -101,7 +110,9 @@ func (c *GoGoProtobufCodec) Unmarshal(data []byte) (interface{}, error) {
 	}()
 
 	mtype := messageType(data[len(data)-1])
+	c.mu.RLock()
 	rtype, ok := c.reversedMap[mtype]
+	c.mu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Unknown message type: %v", mtype)
 	}
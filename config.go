@@ -0,0 +1,242 @@
+package messenger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/metrics"
+	"github.com/go-distributed/messenger/tracing"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+const defaultQueueSize = 1024
+const defaultPreparePeriod = time.Second * 1
+
+// DispatchMode decides how the incoming messages are dispatched.
+type DispatchMode int
+
+const (
+	// DispatchSerial passes the messages to the handlers one by one,
+	// in the order they are received.
+	DispatchSerial DispatchMode = iota
+	// DispatchConcurrent passes the messages to the handlers from
+	// several workers, so a slow handler doesn't delay the others.
+	// The messages may be handled out of order.
+	DispatchConcurrent
+)
+
+func (d DispatchMode) String() string {
+	switch d {
+	case DispatchSerial:
+		return "serial"
+	case DispatchConcurrent:
+		return "concurrent"
+	}
+	return fmt.Sprintf("DispatchMode(%d)", int(d))
+}
+
+// Config configures a messenger.
+type Config struct {
+	Codec       codec.Codec
+	Transporter transporter.Transporter
+
+	// If EnableRecv is true, the user should consume the messages
+	// via Recv(), otherwise the reading stops when the receive
+	// queue is full, depending on RecvPolicy.
+	// At least one of EnableRecv and EnableHandler must be true.
+	EnableRecv    bool
+	EnableHandler bool
+
+	// Sizes of the inbound, receive and per-peer outbound queues.
+	InboundQueueSize  int
+	RecvQueueSize     int
+	OutboundQueueSize int
+	DeadLetterSize    int
+
+	InboundPolicy  OverflowPolicy
+	RecvPolicy     OverflowPolicy
+	OutboundPolicy OverflowPolicy
+
+	// How long Start() waits for the transporter to fail
+	// before it considers the transporter started.
+	PreparePeriod time.Duration
+
+	DispatchMode DispatchMode
+	// Number of the workers in the DispatchConcurrent mode.
+	DispatchWorkers int
+
+	Breaker         BreakerConfig
+	PanicQuarantine int
+
+	Logger Logger
+	// The metrics are recorded to a new metrics.Registry if nil,
+	// use metrics.Discard to disable them.
+	Metrics metrics.Metrics
+	// The spans are exported to it if it's set, otherwise
+	// the tracing is disabled.
+	SpanExporter tracing.Exporter
+	// It sees the raw bytes of the messages on the wire if it's set.
+	WireTap WireTap
+
+	// Hooks.
+	ErrorHandler         func(error)
+	BreakerHandler       func(BreakerEvent)
+	InboundInterceptors  []InboundInterceptor
+	OutboundInterceptors []OutboundInterceptor
+}
+
+// DefaultConfig returns the default configuration, with the handler
+// enabled. The codec and the transporter must be set.
+func DefaultConfig() *Config {
+	return &Config{
+		EnableHandler:     true,
+		InboundQueueSize:  defaultQueueSize,
+		RecvQueueSize:     defaultQueueSize,
+		OutboundQueueSize: defaultQueueSize,
+		DeadLetterSize:    defaultDeadLetterSize,
+		PreparePeriod:     defaultPreparePeriod,
+		DispatchWorkers:   1,
+		Breaker:           BreakerConfig{defaultBreakerThreshold, defaultBreakerTimeout},
+		Logger:            glogLogger{},
+	}
+}
+
+// validate checks the configuration, and returns a descriptive
+// error for the first problem found.
+func (c *Config) validate() error {
+	switch {
+	case c.Codec == nil:
+		return fmt.Errorf("Invalid config: Codec is nil")
+	case c.Transporter == nil:
+		return fmt.Errorf("Invalid config: Transporter is nil")
+	case !c.EnableRecv && !c.EnableHandler:
+		return fmt.Errorf("Invalid config: Neither EnableRecv or EnableHandler is set")
+	case c.InboundQueueSize <= 0:
+		return fmt.Errorf("Invalid config: InboundQueueSize must be positive, got %d", c.InboundQueueSize)
+	case c.RecvQueueSize <= 0:
+		return fmt.Errorf("Invalid config: RecvQueueSize must be positive, got %d", c.RecvQueueSize)
+	case c.OutboundQueueSize <= 0:
+		return fmt.Errorf("Invalid config: OutboundQueueSize must be positive, got %d", c.OutboundQueueSize)
+	case c.DeadLetterSize <= 0:
+		return fmt.Errorf("Invalid config: DeadLetterSize must be positive, got %d", c.DeadLetterSize)
+	case c.PreparePeriod < 0:
+		return fmt.Errorf("Invalid config: PreparePeriod cannot be negative, got %v", c.PreparePeriod)
+	case c.DispatchMode != DispatchSerial && c.DispatchMode != DispatchConcurrent:
+		return fmt.Errorf("Invalid config: Unknown dispatch mode %v", c.DispatchMode)
+	case c.DispatchMode == DispatchConcurrent && c.DispatchWorkers <= 0:
+		return fmt.Errorf("Invalid config: DispatchWorkers must be positive, got %d", c.DispatchWorkers)
+	case c.Breaker.Threshold < 0:
+		return fmt.Errorf("Invalid config: Breaker.Threshold cannot be negative, got %d", c.Breaker.Threshold)
+	case c.PanicQuarantine < 0:
+		return fmt.Errorf("Invalid config: PanicQuarantine cannot be negative, got %d", c.PanicQuarantine)
+	}
+	for _, p := range []OverflowPolicy{c.InboundPolicy, c.RecvPolicy, c.OutboundPolicy} {
+		if p < OverflowBlock || p > OverflowError {
+			return fmt.Errorf("Invalid config: Unknown overflow policy %v", p)
+		}
+	}
+	return nil
+}
+
+// Option changes the configuration.
+type Option func(*Config)
+
+// WithRecv enables or disables Recv().
+func WithRecv(enable bool) Option {
+	return func(c *Config) { c.EnableRecv = enable }
+}
+
+// WithHandler enables or disables the handlers.
+func WithHandler(enable bool) Option {
+	return func(c *Config) { c.EnableHandler = enable }
+}
+
+// WithQueueSizes sets the sizes of the inbound, receive and
+// per-peer outbound queues.
+func WithQueueSizes(inbound, recv, outbound int) Option {
+	return func(c *Config) {
+		c.InboundQueueSize = inbound
+		c.RecvQueueSize = recv
+		c.OutboundQueueSize = outbound
+	}
+}
+
+// WithOverflowPolicies sets the overflow policies of the inbound,
+// receive and per-peer outbound queues.
+func WithOverflowPolicies(inbound, recv, outbound OverflowPolicy) Option {
+	return func(c *Config) {
+		c.InboundPolicy = inbound
+		c.RecvPolicy = recv
+		c.OutboundPolicy = outbound
+	}
+}
+
+// WithPreparePeriod sets how long Start() waits for the transporter.
+func WithPreparePeriod(d time.Duration) Option {
+	return func(c *Config) { c.PreparePeriod = d }
+}
+
+// WithDispatchMode sets the dispatch mode, and the number of workers
+// in the DispatchConcurrent mode.
+func WithDispatchMode(mode DispatchMode, workers int) Option {
+	return func(c *Config) {
+		c.DispatchMode = mode
+		c.DispatchWorkers = workers
+	}
+}
+
+// WithBreaker configures the per-peer circuit breakers.
+func WithBreaker(config BreakerConfig) Option {
+	return func(c *Config) { c.Breaker = config }
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithMetrics sets the metrics the messenger records to.
+func WithMetrics(mt metrics.Metrics) Option {
+	return func(c *Config) { c.Metrics = mt }
+}
+
+// WithTracing enables the tracing, the spans are exported to the exporter.
+func WithTracing(exporter tracing.Exporter) Option {
+	return func(c *Config) { c.SpanExporter = exporter }
+}
+
+// WithWireTap sets the wire tap, see SetWireTap.
+func WithWireTap(tap WireTap) Option {
+	return func(c *Config) { c.WireTap = tap }
+}
+
+// WithErrorHandler sets the error handler, see SetErrorHandler.
+func WithErrorHandler(errHandler func(error)) Option {
+	return func(c *Config) { c.ErrorHandler = errHandler }
+}
+
+// WithBreakerHandler sets the breaker handler, see SetBreakerHandler.
+func WithBreakerHandler(h func(BreakerEvent)) Option {
+	return func(c *Config) { c.BreakerHandler = h }
+}
+
+// WithInterceptors adds the inbound and outbound interceptors.
+func WithInterceptors(inbound []InboundInterceptor, outbound []OutboundInterceptor) Option {
+	return func(c *Config) {
+		c.InboundInterceptors = append(c.InboundInterceptors, inbound...)
+		c.OutboundInterceptors = append(c.OutboundInterceptors, outbound...)
+	}
+}
+
+// NewWithOptions creates a new messenger from the default
+// configuration changed by the options.
+func NewWithOptions(codec codec.Codec, tr transporter.Transporter, opts ...Option) (*Messenger, error) {
+	config := DefaultConfig()
+	config.Codec = codec
+	config.Transporter = tr
+	for _, opt := range opts {
+		opt(config)
+	}
+	return NewWithConfig(config)
+}
@@ -0,0 +1,106 @@
+package messenger
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// A logger that records the warnings and the errors.
+type recordLogger struct {
+	sync.Mutex
+	warnings []string
+	errors   []string
+}
+
+func (l *recordLogger) Infof(format string, args ...interface{}) {}
+
+func (l *recordLogger) Warningf(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Errorf(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+// Test the configuration is validated.
+func TestConfigValidate(t *testing.T) {
+	c := codec.NewGoGoProtobufCodec()
+	tr := newFakeTransporter()
+
+	_, err := NewWithConfig(nil)
+	assert.Error(t, err)
+	_, err = NewWithConfig(DefaultConfig())
+	assert.Error(t, err)
+
+	for _, opts := range [][]Option{
+		{WithHandler(false)},
+		{WithQueueSizes(0, 1, 1)},
+		{WithQueueSizes(1, -1, 1)},
+		{WithQueueSizes(1, 1, 0)},
+		{WithPreparePeriod(-time.Second)},
+		{WithDispatchMode(DispatchConcurrent, 0)},
+		{WithDispatchMode(DispatchMode(3), 1)},
+		{WithOverflowPolicies(OverflowBlock, OverflowPolicy(9), OverflowBlock)},
+		{WithBreaker(BreakerConfig{Threshold: -1})},
+	} {
+		m, err := NewWithOptions(c, tr, opts...)
+		assert.Nil(t, m)
+		assert.Error(t, err)
+	}
+	_, err = NewWithOptions(nil, tr)
+	assert.Error(t, err)
+	_, err = NewWithOptions(c, nil)
+	assert.Error(t, err)
+
+	// The old constructor returns nil.
+	assert.Nil(t, New(c, tr, false, false))
+}
+
+// Test the messenger is built from the options.
+func TestNewWithOptions(t *testing.T) {
+	logger := &recordLogger{}
+	var errs []error
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), newFakeTransporter(),
+		WithRecv(true),
+		WithHandler(false),
+		WithQueueSizes(1, 2, 3),
+		WithOverflowPolicies(OverflowDropNewest, OverflowError, OverflowDropOldest),
+		WithPreparePeriod(time.Millisecond*10),
+		WithDispatchMode(DispatchConcurrent, 4),
+		WithLogger(logger),
+		WithErrorHandler(func(err error) { errs = append(errs, err) }),
+	)
+	assert.NoError(t, err)
+	assert.NotNil(t, m)
+	assert.True(t, m.enableRecv)
+	assert.False(t, m.enableHandler)
+	assert.Equal(t, time.Millisecond*10, m.preparePeriod)
+	assert.Equal(t, 4, m.workers)
+
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.Send("a:8000", &example.GoGoProtobufTestMessage1{}))
+	assert.Equal(t, []QueueInfo{
+		{"inbound", "", 0, 1, OverflowDropNewest, 0},
+		{"recv", "", 0, 2, OverflowError, 0},
+		{"outbound", "a:8000", 1, 3, OverflowDropOldest, 0},
+	}, m.Queues())
+
+	// The hooks and the logger are used.
+	m.pushRecv("a:8000", &example.GoGoProtobufTestMessage1{})
+	m.pushRecv("a:8000", &example.GoGoProtobufTestMessage1{})
+	assert.Equal(t, ErrQueueFull, m.pushRecv("a:8000", &example.GoGoProtobufTestMessage1{}))
+	assert.Equal(t, 1, len(errs))
+	m.pushInbound(&messageReceived{from: "a:8000"})
+	m.pushInbound(&messageReceived{from: "a:8000"})
+	assert.Equal(t, 1, len(logger.warnings))
+}
@@ -0,0 +1,130 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+type testKey struct{}
+
+// Test SendContext() gives up when the ctx is done before the
+// message is queued.
+func TestSendContext(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.SetOutgoingQueue(1, OverflowBlock))
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), testKey{}, "v"))
+	assert.NoError(t, m.SendContext(ctx, "a:8000", msg))
+
+	// Blocked on the full queue.
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel2()
+	assert.Equal(t, context.DeadlineExceeded, m.SendContext(ctx2, "a:8000", msg))
+
+	// The queued message is sent even if the ctx is cancelled,
+	// and it keeps the ctx's values.
+	cancel()
+	q, _ := m.peerQueue("a:8000")
+	mts := <-q.ch
+	assert.NoError(t, mts.ctx.Err())
+	assert.Equal(t, "v", mts.ctx.Value(testKey{}))
+	assert.NoError(t, m.send(mts))
+	assert.Equal(t, 0, m.DeadLetters().Len())
+}
+
+// deadlineTransporter records the deadlines of the sends.
+type deadlineTransporter struct {
+	*fakeTransporter
+	deadlines chan time.Time
+}
+
+func (d *deadlineTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	deadline, _ := ctx.Deadline()
+	d.deadlines <- deadline
+	return d.fakeTransporter.SendContext(ctx, hostport, b)
+}
+
+// Test the deadline of SendContext() still applies once the
+// message is queued, even if the ctx is cancelled.
+func TestSendContextDeadline(t *testing.T) {
+	tr := &deadlineTransporter{newFakeTransporter(), make(chan time.Time, 1)}
+	m := New(codec.NewGoGoProtobufCodec(), tr, true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	msg := &example.GoGoProtobufTestMessage1{}
+	q, _ := m.peerQueue("a:8000")
+
+	// The deadline is passed to the transporter.
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	assert.NoError(t, m.SendContext(ctx, "a:8000", msg))
+	cancel()
+	assert.NoError(t, m.send(<-q.ch))
+	assert.Equal(t, deadline, <-tr.deadlines)
+	<-tr.out
+
+	// No deadline.
+	assert.NoError(t, m.SendContext(context.Background(), "a:8000", msg))
+	assert.NoError(t, m.send(<-q.ch))
+	assert.True(t, (<-tr.deadlines).IsZero())
+	<-tr.out
+
+	// The message is dropped if the deadline has passed in the queue.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.NoError(t, m.SendContext(ctx, "a:8000", msg))
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, context.DeadlineExceeded, m.send(<-q.ch))
+	assert.Equal(t, 0, len(tr.deadlines))
+	it := m.DeadLetters()
+	assert.Equal(t, 1, it.Len())
+	it.Next()
+	assert.Equal(t, context.DeadlineExceeded, it.DeadLetter().Reason)
+}
+
+// Test RecvContext() and StartContext().
+func TestRecvStartContext(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err := m.RecvContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The fake transporter blocks, so the messenger waits
+	// for the prepare period, which is longer than the ctx.
+	assert.Equal(t, context.DeadlineExceeded, m.StartContext(ctx))
+}
+
+// Test the handlers' ctx is cancelled when the messenger is stopped.
+func TestHandlerContext(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.Error(t, m.RegisterContextHandler(&example.GoGoProtobufTestMessage1{}, nil))
+
+	ctxs := make(chan context.Context, 1)
+	froms := make(chan string, 1)
+	assert.NoError(t, m.RegisterContextHandler(&example.GoGoProtobufTestMessage1{},
+		func(ctx context.Context, from string, msg interface{}) {
+			ctxs <- ctx
+			froms <- from
+		}))
+
+	assert.NoError(t, m.inboundChain(m.current().ctx, "a:8000", &example.GoGoProtobufTestMessage1{}))
+	ctx := <-ctxs
+	assert.Equal(t, "a:8000", <-froms)
+	assert.NoError(t, ctx.Err())
+
+	assert.NoError(t, m.Stop())
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
@@ -0,0 +1,211 @@
+package messenger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultDeadLetterSize = 1024
+
+// Direction tells whether a message was coming in or going out.
+type Direction int
+
+const (
+	// Inbound messages come from the wire.
+	Inbound Direction = iota
+	// Outbound messages go to the wire.
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// MarshalText encodes the direction as "inbound" or "outbound".
+func (d Direction) MarshalText() ([]byte, error) {
+	switch d {
+	case Inbound, Outbound:
+		return []byte(d.String()), nil
+	}
+	return nil, fmt.Errorf("Unknown direction: %d", int(d))
+}
+
+// UnmarshalText decodes "inbound" or "outbound".
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "inbound":
+		*d = Inbound
+	case "outbound":
+		*d = Outbound
+	default:
+		return fmt.Errorf("Unknown direction: %q", text)
+	}
+	return nil
+}
+
+// DeadLetter records a message that could not be delivered
+// or processed, together with the reason of the failure.
+type DeadLetter struct {
+	ID        uint64
+	Direction Direction
+	Hostport  string      // The destination, or the sender if known.
+	Data      []byte      // Raw bytes, nil if the message could not be marshalled.
+	Msg       interface{} // The message, nil if it could not be unmarshalled.
+	Reason    error
+	Time      time.Time
+}
+
+// deadLetterQueue is a bounded queue of dead letters.
+// When it's full, the oldest dead letter is discarded.
+type deadLetterQueue struct {
+	mu      sync.Mutex
+	letters []*DeadLetter
+	size    int
+	nextID  uint64
+}
+
+func newDeadLetterQueue(size int) *deadLetterQueue {
+	return &deadLetterQueue{size: size}
+}
+
+func (q *deadLetterQueue) add(dl *DeadLetter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	dl.ID = q.nextID
+	dl.Time = time.Now()
+	if len(q.letters) >= q.size {
+		q.letters = q.letters[1:]
+	}
+	q.letters = append(q.letters, dl)
+}
+
+func (q *deadLetterQueue) remove(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.letters {
+		if q.letters[i].ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *deadLetterQueue) snapshot() []*DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	letters := make([]*DeadLetter, len(q.letters))
+	copy(letters, q.letters)
+	return letters
+}
+
+func (q *deadLetterQueue) purge() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.letters = nil
+}
+
+// DeadLetterIterator iterates over a snapshot of the dead letters,
+// from the oldest to the newest.
+type DeadLetterIterator struct {
+	letters []*DeadLetter
+	index   int
+}
+
+// Next advances the iterator, it returns false when there is
+// no more dead letters.
+func (it *DeadLetterIterator) Next() bool {
+	if it.index >= len(it.letters) {
+		return false
+	}
+	it.index++
+	return true
+}
+
+// DeadLetter returns the current dead letter.
+func (it *DeadLetterIterator) DeadLetter() *DeadLetter {
+	if it.index == 0 {
+		return nil
+	}
+	return it.letters[it.index-1]
+}
+
+// Len returns the number of dead letters in the snapshot.
+func (it *DeadLetterIterator) Len() int {
+	return len(it.letters)
+}
+
+// DeadLetters returns an iterator over the current dead letters.
+func (m *Messenger) DeadLetters() *DeadLetterIterator {
+	return &DeadLetterIterator{letters: m.deadLetters.snapshot()}
+}
+
+// PurgeDeadLetters discards all the dead letters.
+func (m *Messenger) PurgeDeadLetters() {
+	m.deadLetters.purge()
+}
+
+// Reinject feeds a dead letter back into the messenger, usually
+// after the problem that caused the failure has been fixed.
+// An inbound dead letter is decoded again and passed to the handlers
+// through the inbound queue, which needs the messenger to be running,
+// an outbound dead letter is sent again to its destination.
+// The dead letter is removed from the queue on success.
+func (m *Messenger) Reinject(dl *DeadLetter) error {
+	switch dl.Direction {
+	case Inbound:
+		if m.State() != StateRunning {
+			return ErrStopped
+		}
+		if len(dl.Data) == 0 {
+			return fmt.Errorf("Dead letter %d has no data", dl.ID)
+		}
+		msg, err := m.codec.Unmarshal(dl.Data)
+		if err != nil {
+			return err
+		}
+		if !m.deadLetters.remove(dl.ID) {
+			return fmt.Errorf("Unknown dead letter: %d", dl.ID)
+		}
+		mr := &messageReceived{from: dl.Hostport, data: dl.Data, msg: msg, queued: time.Now()}
+		if !m.pushInbound(mr) {
+			m.deadLetters.add(dl)
+			return ErrStopped
+		}
+	case Outbound:
+		if !m.deadLetters.remove(dl.ID) {
+			return fmt.Errorf("Unknown dead letter: %d", dl.ID)
+		}
+		if err := m.Send(dl.Hostport, dl.Msg); err != nil {
+			m.deadLetters.add(dl)
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown direction: %v", dl.Direction)
+	}
+	return nil
+}
+
+// deadLetter records a failed message.
+func (m *Messenger) deadLetter(d Direction, hostport string, b []byte, msg interface{}, reason error) {
+	m.countDropped(d, hostport, msg)
+	m.debug.fail(hostport, true, reason)
+	m.deadLetters.add(&DeadLetter{
+		Direction: d,
+		Hostport:  hostport,
+		Data:      b,
+		Msg:       msg,
+		Reason:    reason,
+	})
+}
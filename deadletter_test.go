@@ -0,0 +1,105 @@
+package messenger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test that failed messages end up in the dead letter queue
+// and can be reinjected.
+func TestDeadLetters(t *testing.T) {
+	tr := newFakeTransporter()
+	m := New(codec.NewGoGoProtobufCodec(), tr, true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.Start())
+
+	// Unknown message type, the codec should fail to unmarshal it.
+	tr.in <- []byte{0x08, 0x01, 0xff}
+
+	// Failed to send.
+	tr.setSendError(fmt.Errorf("peer is down"))
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, m.Send("localhost:8010", msg))
+
+	waitFor(t, time.Second*5, func() bool {
+		return m.DeadLetters().Len() == 2
+	})
+
+	var inbound, outbound *DeadLetter
+	it := m.DeadLetters()
+	for it.Next() {
+		dl := it.DeadLetter()
+		assert.Error(t, dl.Reason)
+		switch dl.Direction {
+		case Inbound:
+			inbound = dl
+		case Outbound:
+			outbound = dl
+		}
+	}
+	assert.NotNil(t, inbound)
+	assert.NotNil(t, outbound)
+	assert.Equal(t, []byte{0x08, 0x01, 0xff}, inbound.Data)
+	assert.Equal(t, "localhost:8010", outbound.Hostport)
+	assert.Equal(t, msg, outbound.Msg)
+
+	// Still can't be decoded.
+	assert.Error(t, m.Reinject(inbound))
+
+	// The peer is back.
+	tr.setSendError(nil)
+	assert.NoError(t, m.Reinject(outbound))
+	select {
+	case b := <-tr.out:
+		assert.Equal(t, outbound.Data, b)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Reinjected message is not sent")
+	}
+	assert.Equal(t, 1, m.DeadLetters().Len())
+
+	m.PurgeDeadLetters()
+	assert.Equal(t, 0, m.DeadLetters().Len())
+
+	assert.NoError(t, m.Destroy())
+}
+
+// Test the inbound dead letters are reinjected only if they have
+// data, and only while the messenger is running.
+func TestReinjectInbound(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	msg := &example.GoGoProtobufTestMessage1{F0: proto.Int32(1)}
+	b, err := m.Codec().Marshal(msg)
+	assert.NoError(t, err)
+	m.deadLetter(Inbound, "a:8000", nil, nil, fmt.Errorf("Recv failed"))
+	m.deadLetter(Inbound, "a:8000", b, msg, fmt.Errorf("No handler"))
+	dls := m.deadLetters.snapshot()
+	assert.Equal(t, 2, len(dls))
+
+	// Not running yet.
+	assert.Equal(t, ErrStopped, m.Reinject(dls[1]))
+
+	assert.NoError(t, m.Start())
+	defer m.Destroy()
+	assert.Error(t, m.Reinject(dls[0]))
+	assert.NoError(t, m.Reinject(dls[1]))
+	received, err := m.RecvTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, received)
+	assert.Equal(t, 1, m.DeadLetters().Len())
+}
@@ -0,0 +1,394 @@
+package messenger
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+const (
+	// DefaultDebugPrefix is where ServeDebug serves the debug
+	// pages by default.
+	DefaultDebugPrefix = "/debug/messenger/"
+
+	defaultRecentErrors = 64
+	defaultTailSize     = 256
+	// The peers are claimed by the senders, so the least recently
+	// active ones are evicted to bound the memory.
+	defaultDebugPeers = 1024
+)
+
+// MessageInfo describes a message type and its handlers.
+type MessageInfo struct {
+	Type       string
+	Registered bool     // Whether it's registered in the codec.
+	Handlers   []string // The names of the handlers, by priority.
+}
+
+// PeerStats is the traffic with a peer.
+type PeerStats struct {
+	Peer          string
+	Sent          uint64
+	Received      uint64
+	Failed        uint64 // Number of the dead letters.
+	BytesSent     uint64
+	BytesReceived uint64
+	LastSent      time.Time
+	LastReceived  time.Time
+	LastError     string
+	Breaker       string // The state of the circuit breaker.
+	Queued        int    // Number of the messages in the outbound queue.
+}
+
+// RecentError is an error that happened recently.
+type RecentError struct {
+	Time  time.Time
+	Error string
+}
+
+// TailEntry is a message that went through the messenger,
+// which is passed to the tails.
+type TailEntry struct {
+	Time      time.Time
+	Direction Direction
+	Peer      string // The destination, or the sender if known.
+	Msg       interface{}
+}
+
+func (e *TailEntry) String() string {
+	text := fmt.Sprintf("%v", e.Msg)
+	if pb, ok := e.Msg.(proto.Message); ok {
+		text = proto.CompactTextString(pb)
+	}
+	prep := "to"
+	if e.Direction == Inbound {
+		prep = "from"
+	}
+	return fmt.Sprintf("%v %v %v %q %v {%v}", e.Time.Format(time.RFC3339Nano),
+		e.Direction, prep, e.Peer, typeName(e.Msg), strings.TrimSpace(text))
+}
+
+// debugState keeps the per-peer stats, the recent errors and the
+// tails, which are only for the introspection.
+type debugState struct {
+	mu       sync.Mutex
+	peers    map[string]*PeerStats
+	maxPeers int
+	errors   []RecentError
+	size     int
+	tails    map[chan *TailEntry]bool
+}
+
+func newDebugState(size, maxPeers int) *debugState {
+	return &debugState{
+		peers:    make(map[string]*PeerStats),
+		maxPeers: maxPeers,
+		size:     size,
+		tails:    make(map[chan *TailEntry]bool),
+	}
+}
+
+func (d *debugState) peer(hostport string) *PeerStats {
+	ps, ok := d.peers[hostport]
+	if !ok {
+		if len(d.peers) >= d.maxPeers {
+			d.evict()
+		}
+		ps = &PeerStats{Peer: hostport}
+		d.peers[hostport] = ps
+	}
+	return ps
+}
+
+// evict removes the stats of the least recently active peer.
+func (d *debugState) evict() {
+	var oldest string
+	var oldestTime time.Time
+	first := true
+	for hostport, ps := range d.peers {
+		last := ps.LastSent
+		if ps.LastReceived.After(last) {
+			last = ps.LastReceived
+		}
+		if first || last.Before(oldestTime) {
+			oldest, oldestTime, first = hostport, last, false
+		}
+	}
+	delete(d.peers, oldest)
+}
+
+// record counts a message that went through the messenger,
+// and passes it to the tails.
+func (d *debugState) record(dir Direction, hostport string, msg interface{}, n int) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ps := d.peer(hostport)
+	if dir == Inbound {
+		ps.Received++
+		ps.BytesReceived += uint64(n)
+		ps.LastReceived = now
+	} else {
+		ps.Sent++
+		ps.BytesSent += uint64(n)
+		ps.LastSent = now
+	}
+	if len(d.tails) == 0 {
+		return
+	}
+	e := &TailEntry{now, dir, hostport, msg}
+	for ch := range d.tails {
+		// Never block the messenger for a slow reader.
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// fail records an error, and counts the dead letter for the peer.
+func (d *debugState) fail(hostport string, deadLetter bool, err error) {
+	if err == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if deadLetter {
+		ps := d.peer(hostport)
+		ps.Failed++
+		ps.LastError = err.Error()
+	}
+	if len(d.errors) >= d.size {
+		d.errors = d.errors[1:]
+	}
+	d.errors = append(d.errors, RecentError{time.Now(), err.Error()})
+}
+
+func (d *debugState) tail() chan *TailEntry {
+	ch := make(chan *TailEntry, defaultTailSize)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tails[ch] = true
+	return ch
+}
+
+func (d *debugState) untail(ch chan *TailEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tails, ch)
+}
+
+// Messages returns the known message types, which are either
+// registered or handled, and the names of their handlers. The
+// interface handlers and the default handler are listed under
+// their interface type and "default".
+func (m *Messenger) Messages() []MessageInfo {
+	m.mu.RLock()
+	infos := make(map[string]*MessageInfo)
+	info := func(t string) *MessageInfo {
+		if infos[t] == nil {
+			infos[t] = &MessageInfo{Type: t}
+		}
+		return infos[t]
+	}
+	for msgType := range m.registeredMessages {
+		info(msgType.String()).Registered = true
+	}
+	add := func(t string, hs []*handler) {
+		i := info(t)
+		for _, h := range hs {
+			i.Handlers = append(i.Handlers, h.name)
+		}
+	}
+	for msgType, hs := range m.handlers {
+		add(msgType.String(), hs)
+	}
+	for _, h := range m.interfaceHandlers {
+		add(h.iface.String(), []*handler{h})
+	}
+	if m.defaultHandler != nil {
+		add(defaultHandlerName, []*handler{m.defaultHandler})
+	}
+	m.mu.RUnlock()
+
+	var names []string
+	for t := range infos {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	messages := make([]MessageInfo, len(names))
+	for i, t := range names {
+		messages[i] = *infos[t]
+	}
+	return messages
+}
+
+// PeerStats returns the traffic with each peer the messenger has
+// talked to, sorted by the peer. The messages whose sender is
+// unknown are counted under the empty peer. Only the 1024 most
+// recently active peers are kept.
+func (m *Messenger) PeerStats() []PeerStats {
+	queued := make(map[string]int)
+	for _, q := range m.Queues() {
+		if q.Name == "outbound" {
+			queued[q.Peer] = q.Len
+		}
+	}
+
+	m.debug.mu.Lock()
+	stats := make([]PeerStats, 0, len(m.debug.peers))
+	for _, ps := range m.debug.peers {
+		stats = append(stats, *ps)
+	}
+	m.debug.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Peer < stats[j].Peer })
+	for i := range stats {
+		stats[i].Breaker = m.BreakerState(stats[i].Peer).String()
+		stats[i].Queued = queued[stats[i].Peer]
+	}
+	return stats
+}
+
+// RecentErrors returns the recent errors, from the oldest to the
+// newest. They are the reasons of the dead letters, and the errors
+// passed to the error handler.
+func (m *Messenger) RecentErrors() []RecentError {
+	m.debug.mu.Lock()
+	defer m.debug.mu.Unlock()
+
+	errors := make([]RecentError, len(m.debug.errors))
+	copy(errors, m.debug.errors)
+	return errors
+}
+
+// Tail returns a channel that receives the messages going through
+// the messenger, until the cancel function is called. The messages
+// are discarded if the channel is not drained in time.
+func (m *Messenger) Tail() (<-chan *TailEntry, func()) {
+	ch := m.debug.tail()
+	return ch, func() { m.debug.untail(ch) }
+}
+
+// DebugHandler returns an http.Handler that serves the debug pages
+// under the prefix:
+//
+//	messages  the message types and their handlers
+//	queues    the state of the queues
+//	peers     the traffic with each peer
+//	errors    the recent errors
+//	tail      a live stream of the messages, in the protobuf text format
+//
+// All of them but the tail are in JSON.
+func (m *Messenger) DebugHandler(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	mux := http.NewServeMux()
+	pages := map[string]func() interface{}{
+		"messages": func() interface{} { return m.Messages() },
+		"queues":   func() interface{} { return m.queueViews() },
+		"peers":    func() interface{} { return m.PeerStats() },
+		"errors":   func() interface{} { return m.RecentErrors() },
+	}
+	for name, page := range pages {
+		mux.HandleFunc(prefix+name, jsonHandler(page))
+	}
+	mux.HandleFunc(prefix+"tail", m.serveTail)
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != prefix {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, name := range []string{"messages", "queues", "peers", "errors", "tail"} {
+			fmt.Fprintln(w, prefix+name)
+		}
+	})
+	return mux
+}
+
+// ServeDebug serves the debug pages under the prefix, or
+// DefaultDebugPrefix if it's empty, along with the messages.
+// The transporter must serve HTTP, like the HTTPTransporter.
+func (m *Messenger) ServeDebug(prefix string) error {
+	mux, ok := m.tr.(transporter.HTTPMuxer)
+	if !ok {
+		return fmt.Errorf("Transporter %T cannot serve HTTP", m.tr)
+	}
+	if prefix == "" {
+		prefix = DefaultDebugPrefix
+	}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	mux.Handle(prefix, m.DebugHandler(prefix))
+	return nil
+}
+
+// queueView is QueueInfo with the policy rendered as text.
+type queueView struct {
+	Name    string
+	Peer    string `json:",omitempty"`
+	Len     int
+	Cap     int
+	Policy  string
+	Dropped uint64
+}
+
+func (m *Messenger) queueViews() []queueView {
+	var views []queueView
+	for _, q := range m.Queues() {
+		views = append(views, queueView{q.Name, q.Peer, q.Len, q.Cap, q.Policy.String(), q.Dropped})
+	}
+	return views
+}
+
+func jsonHandler(page func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(page(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+	}
+}
+
+// serveTail streams the messages going through the messenger until
+// the client goes away. The "type" query parameter keeps only the
+// messages whose type contains it.
+func (m *Messenger) serveTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter := r.URL.Query().Get("type")
+	ch, cancel := m.Tail()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-ch:
+			if filter != "" && !strings.Contains(typeName(e.Msg), filter) {
+				continue
+			}
+			if _, err := fmt.Fprintln(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
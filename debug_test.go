@@ -0,0 +1,143 @@
+package messenger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the message types, the peer stats, the recent errors and the tail.
+func TestDebug(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.Error(t, m.ServeDebug(""))
+
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {}))
+	assert.NoError(t, m.RegisterHandler((*proto.Message)(nil), func(msg interface{}) {}))
+	assert.NoError(t, m.SetDefaultHandler(func(msg interface{}) {}))
+	assert.Equal(t, []MessageInfo{
+		{"*protobuf.GoGoProtobufTestMessage1", true, []string{"*protobuf.GoGoProtobufTestMessage1"}},
+		{"*protobuf.GoGoProtobufTestMessage2", true, nil},
+		{"default", false, []string{"default"}},
+		{"proto.Message", false, []string{"proto.Message"}},
+	}, m.Messages())
+
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	ch, cancel := m.Tail()
+	defer cancel()
+
+	msg := &example.GoGoProtobufTestMessage1{F0: proto.Int32(42)}
+	assert.NoError(t, m.Send("a:8000", msg))
+	tr.in <- <-tr.out
+	tr.setDown("b:8000", true)
+	assert.NoError(t, m.Send("b:8000", msg))
+
+	for _, dir := range []Direction{Outbound, Inbound} {
+		select {
+		case e := <-ch:
+			assert.Equal(t, dir, e.Direction)
+			assert.Equal(t, msg, e.Msg)
+			assert.Contains(t, e.String(), "F0:42")
+		case <-time.After(time.Second):
+			t.Fatalf("No %v message in the tail", dir)
+		}
+	}
+
+	waitFor(t, time.Second, func() bool { return len(m.RecentErrors()) == 1 })
+	assert.Equal(t, "b:8000 is down", m.RecentErrors()[0].Error)
+	stats := m.PeerStats()
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, "", stats[0].Peer)
+	assert.Equal(t, uint64(1), stats[0].Received)
+	assert.Equal(t, "a:8000", stats[1].Peer)
+	assert.Equal(t, uint64(1), stats[1].Sent)
+	assert.Equal(t, stats[0].BytesReceived, stats[1].BytesSent)
+	assert.Equal(t, "closed", stats[1].Breaker)
+	assert.Equal(t, "b:8000", stats[2].Peer)
+	assert.Equal(t, uint64(1), stats[2].Failed)
+	assert.Equal(t, "b:8000 is down", stats[2].LastError)
+
+	m.reportError(fmt.Errorf("Something went wrong"))
+	errs := m.RecentErrors()
+	assert.Equal(t, 2, len(errs))
+	assert.Equal(t, "Something went wrong", errs[1].Error)
+}
+
+// Test the stats of the least recently active peer are evicted.
+func TestDebugPeersEvicted(t *testing.T) {
+	d := newDebugState(defaultRecentErrors, 2)
+	d.record(Inbound, "a:8000", nil, 1)
+	d.record(Outbound, "b:8000", nil, 1)
+	d.record(Inbound, "a:8000", nil, 1)
+	d.record(Inbound, "c:8000", nil, 1)
+	assert.Equal(t, 2, len(d.peers))
+	assert.Equal(t, uint64(2), d.peers["a:8000"].Received)
+	assert.Nil(t, d.peers["b:8000"])
+}
+
+// Test the debug pages.
+func TestDebugHandler(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {}))
+
+	server := httptest.NewServer(m.DebugHandler(DefaultDebugPrefix))
+	defer server.Close()
+	get := func(page string, v interface{}) {
+		resp, err := http.Get(server.URL + DefaultDebugPrefix + page)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	var messages []MessageInfo
+	get("messages", &messages)
+	assert.Equal(t, m.Messages(), messages)
+
+	var queues []map[string]interface{}
+	get("queues", &queues)
+	assert.Equal(t, 2, len(queues))
+	assert.Equal(t, "inbound", queues[0]["Name"])
+	assert.Equal(t, "block", queues[0]["Policy"])
+
+	resp, err := http.Get(server.URL + DefaultDebugPrefix + "unknown")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	resp, err = http.Get(server.URL + DefaultDebugPrefix + "tail?type=Message1")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	waitFor(t, time.Second, func() bool {
+		m.debug.mu.Lock()
+		defer m.debug.mu.Unlock()
+		return len(m.debug.tails) == 1
+	})
+	assert.NoError(t, m.Send("a:8000", &example.GoGoProtobufTestMessage1{F0: proto.Int32(7)}))
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(line, `outbound to "a:8000" *protobuf.GoGoProtobufTestMessage1 {F0:7}`), line)
+}
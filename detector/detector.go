@@ -0,0 +1,240 @@
+// Package detector implements a phi-accrual failure detector atop
+// the messenger. The nodes send heartbeats to each other periodically,
+// and the detector reports how suspicious each peer is, based on the
+// history of the heartbeat inter-arrival times.
+package detector
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	log "github.com/golang/glog"
+)
+
+// The peers that watch this node without being watched are sent
+// heartbeats until they stop sending theirs for that many intervals.
+const watcherExpiry = 10
+
+// Config configures the failure detector.
+type Config struct {
+	// Heartbeats are sent every HeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// A peer is considered unavailable when its phi reaches Threshold.
+	Threshold float64
+	// Number of inter-arrival times kept for each peer.
+	WindowSize int
+	// Minimum standard deviation of the inter-arrival times.
+	MinStdDev time.Duration
+	// Heartbeat delays tolerated without raising the suspicion much.
+	AcceptablePause time.Duration
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		HeartbeatInterval: time.Second,
+		Threshold:         8,
+		WindowSize:        1000,
+		MinStdDev:         time.Millisecond * 100,
+		AcceptablePause:   0,
+	}
+}
+
+// Detector sends heartbeats to the watched peers, and tracks the
+// heartbeats it receives.
+type Detector struct {
+	m      *messenger.Messenger
+	self   string
+	config Config
+
+	mu       sync.Mutex
+	targets  map[string]bool
+	peers    map[string]*PhiAccrual
+	watchers map[string]time.Time // The unwatched peers that send heartbeats, by the last one.
+	seq      uint64
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates a failure detector atop the messenger, self is the
+// address of the messenger that the peers can send to.
+// It registers its own message in the messenger, so the messenger
+// must have the handler enabled. If config is nil, the default
+// configuration is used.
+func New(m *messenger.Messenger, self string, config *Config) (*Detector, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	d := &Detector{
+		m:        m,
+		self:     self,
+		config:   *config,
+		targets:  make(map[string]bool),
+		peers:    make(map[string]*PhiAccrual),
+		watchers: make(map[string]time.Time),
+	}
+	if err := m.RegisterMessage(&Heartbeat{}); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterHandler(&Heartbeat{}, d.handleHeartbeat); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Start sending heartbeats.
+func (d *Detector) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stop != nil {
+		return fmt.Errorf("Detector is already started")
+	}
+	d.stop = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go d.heartbeatLoop(d.stop, d.stopped)
+	return nil
+}
+
+// Stop sending heartbeats.
+func (d *Detector) Stop() error {
+	d.mu.Lock()
+	stop, stopped := d.stop, d.stopped
+	d.stop, d.stopped = nil, nil
+	d.mu.Unlock()
+
+	if stop == nil {
+		return fmt.Errorf("Detector is not started")
+	}
+	close(stop)
+	<-stopped
+	return nil
+}
+
+// Watch a peer, heartbeats are sent to it and its heartbeats
+// are tracked. The suspicion grows from now on, so a peer that
+// never sends a heartbeat becomes unavailable.
+// The heartbeats from the unwatched peers are not tracked, but
+// heartbeats are sent back to them, so a peer can be watched by
+// a node that it doesn't watch itself.
+func (d *Detector) Watch(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.targets[addr] {
+		d.targets[addr] = true
+		d.history(addr).Start(time.Now())
+	}
+}
+
+// Unwatch a peer, and forget its history.
+func (d *Detector) Unwatch(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.targets, addr)
+	delete(d.peers, addr)
+}
+
+// Phi returns the suspicion level of the peer. It's 0 if the
+// peer is not watched.
+func (d *Detector) Phi(addr string) float64 {
+	d.mu.Lock()
+	p, ok := d.peers[addr]
+	d.mu.Unlock()
+
+	if !ok {
+		return 0
+	}
+	return p.Phi(time.Now())
+}
+
+// IsAvailable tells whether the suspicion level of the peer
+// is below the threshold.
+func (d *Detector) IsAvailable(addr string) bool {
+	return d.Phi(addr) < d.config.Threshold
+}
+
+// Suspicion returns the suspicion levels of all the watched peers.
+func (d *Detector) Suspicion() map[string]float64 {
+	d.mu.Lock()
+	var addrs []string
+	for addr := range d.peers {
+		addrs = append(addrs, addr)
+	}
+	d.mu.Unlock()
+	sort.Strings(addrs)
+
+	levels := make(map[string]float64)
+	for _, addr := range addrs {
+		levels[addr] = d.Phi(addr)
+	}
+	return levels
+}
+
+func (d *Detector) history(addr string) *PhiAccrual {
+	p, ok := d.peers[addr]
+	if !ok {
+		p = NewPhiAccrual(d.config.WindowSize, d.config.MinStdDev,
+			d.config.AcceptablePause, d.config.HeartbeatInterval)
+		d.peers[addr] = p
+	}
+	return p
+}
+
+func (d *Detector) heartbeatLoop(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(d.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			d.seq++
+			hb := &Heartbeat{From: proto.String(d.self), Seq: proto.Uint64(d.seq)}
+			var targets []string
+			for addr := range d.targets {
+				targets = append(targets, addr)
+			}
+			expiry := time.Now().Add(-d.config.HeartbeatInterval * watcherExpiry)
+			for addr, last := range d.watchers {
+				if last.Before(expiry) {
+					delete(d.watchers, addr)
+				} else if !d.targets[addr] {
+					targets = append(targets, addr)
+				}
+			}
+			d.mu.Unlock()
+
+			for _, addr := range targets {
+				if err := d.m.Send(addr, hb); err != nil {
+					log.Warningf("Detector: Failed to send heartbeat to %v: %v\n", addr, err)
+				}
+			}
+		}
+	}
+}
+
+func (d *Detector) handleHeartbeat(msg interface{}) {
+	hb := msg.(*Heartbeat)
+	d.mu.Lock()
+	p, ok := d.peers[hb.GetFrom()]
+	if !ok {
+		// It watches us, send it heartbeats.
+		d.watchers[hb.GetFrom()] = time.Now()
+	}
+	d.mu.Unlock()
+	if !ok {
+		log.V(2).Infof("Detector: Heartbeat from unwatched %v is not tracked\n", hb.GetFrom())
+		return
+	}
+	p.Heartbeat(time.Now())
+}
@@ -0,0 +1,157 @@
+package detector
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the phi computation with regular heartbeats.
+func TestPhiAccrual(t *testing.T) {
+	interval := time.Millisecond * 100
+	p := NewPhiAccrual(100, time.Millisecond*10, 0, interval)
+
+	now := time.Now()
+	assert.Equal(t, 0.0, p.Phi(now))
+	for i := 0; i < 20; i++ {
+		p.Heartbeat(now)
+		now = now.Add(interval)
+	}
+	last := now.Add(-interval)
+
+	// The phi grows as the next heartbeat is late.
+	phi1 := p.Phi(last.Add(interval))
+	phi2 := p.Phi(last.Add(interval * 2))
+	phi3 := p.Phi(last.Add(interval * 5))
+	assert.True(t, phi1 < 1, "phi1 = %v", phi1)
+	assert.True(t, phi2 > phi1, "phi2 = %v", phi2)
+	assert.True(t, phi3 > 8, "phi3 = %v", phi3)
+
+	// Tolerate the pause.
+	q := NewPhiAccrual(100, time.Millisecond*10, interval*5, interval)
+	now = last
+	for i := 0; i < 20; i++ {
+		q.Heartbeat(now)
+		now = now.Add(interval)
+	}
+	phi4 := q.Phi(now.Add(-interval).Add(interval * 5))
+	assert.True(t, phi4 < 1, "phi4 = %v", phi4)
+
+	// Without any heartbeat, the phi grows from the start.
+	r := NewPhiAccrual(100, time.Millisecond*10, 0, interval)
+	r.Start(now)
+	assert.True(t, r.Phi(now.Add(interval*5)) > 8)
+	// The interval until the first heartbeat is not recorded.
+	r.Heartbeat(now.Add(interval * 5))
+	assert.Equal(t, 2, len(r.intervals))
+	assert.True(t, r.Phi(now.Add(interval*6)) < 1)
+
+	// The phi stays finite after a long silence.
+	d := DefaultConfig()
+	s := NewPhiAccrual(d.WindowSize, d.MinStdDev, d.AcceptablePause, d.HeartbeatInterval)
+	s.Heartbeat(now)
+	s.Heartbeat(now.Add(d.HeartbeatInterval))
+	phi5 := s.Phi(now.Add(time.Minute))
+	phi6 := s.Phi(now.Add(time.Hour))
+	assert.False(t, math.IsInf(phi5, 0) || math.IsNaN(phi5), "phi5 = %v", phi5)
+	assert.True(t, phi6 > phi5, "phi6 = %v", phi6)
+}
+
+func newDetector(t *testing.T, network *transporter.LocalNetwork, addr string) (*messenger.Messenger, *Detector) {
+	m := messenger.New(codec.NewGoGoProtobufCodec(),
+		transporter.NewLocalTransporter(network, addr), false, true)
+	assert.NotNil(t, m)
+	d, err := New(m, addr, &Config{
+		HeartbeatInterval: time.Millisecond * 20,
+		Threshold:         8,
+		WindowSize:        100,
+		MinStdDev:         time.Millisecond * 10,
+	})
+	assert.NoError(t, err)
+	return m, d
+}
+
+// Test the detector with the heartbeats over the messenger.
+func TestDetector(t *testing.T) {
+	network := transporter.NewLocalNetwork()
+	ma, a := newDetector(t, network, "a:8000")
+	mb, b := newDetector(t, network, "b:8000")
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, mb.Start())
+		close(done)
+	}()
+	assert.NoError(t, ma.Start())
+	<-done
+
+	a.Watch("b:8000")
+	b.Watch("a:8000")
+	// c never sends any heartbeat.
+	a.Watch("c:8000")
+	assert.NoError(t, a.Start())
+	assert.NoError(t, b.Start())
+	assert.Error(t, a.Start())
+
+	time.Sleep(time.Millisecond * 500)
+	assert.True(t, a.IsAvailable("b:8000"))
+	assert.True(t, b.IsAvailable("a:8000"))
+	assert.False(t, a.IsAvailable("c:8000"))
+	assert.Equal(t, 2, len(a.Suspicion()))
+
+	// The heartbeats from the unwatched peers are not tracked.
+	a.Unwatch("c:8000")
+	b.handleHeartbeat(&Heartbeat{From: proto.String("d:8000")})
+	assert.Equal(t, 1, len(b.Suspicion()))
+
+	// b stops sending heartbeats.
+	assert.NoError(t, b.Stop())
+	time.Sleep(time.Millisecond * 500)
+	assert.False(t, a.IsAvailable("b:8000"))
+	assert.True(t, a.Phi("b:8000") >= 8)
+
+	a.Unwatch("b:8000")
+	assert.Equal(t, 0.0, a.Phi("b:8000"))
+	assert.NoError(t, a.Stop())
+	assert.NoError(t, ma.Destroy())
+	assert.NoError(t, mb.Destroy())
+}
+
+// Test a peer watched by a node it doesn't watch still sends it
+// heartbeats.
+func TestDetectorOneSided(t *testing.T) {
+	network := transporter.NewLocalNetwork()
+	ma, a := newDetector(t, network, "a:8000")
+	mb, b := newDetector(t, network, "b:8000")
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, mb.Start())
+		close(done)
+	}()
+	assert.NoError(t, ma.Start())
+	<-done
+
+	a.Watch("b:8000")
+	assert.NoError(t, a.Start())
+	assert.NoError(t, b.Start())
+	time.Sleep(time.Millisecond * 500)
+	assert.True(t, a.IsAvailable("b:8000"))
+	assert.Equal(t, 0, len(b.Suspicion()))
+
+	// b stops sending heartbeats to a once a stops watching it.
+	a.Unwatch("b:8000")
+	assert.NoError(t, a.Stop())
+	time.Sleep(time.Millisecond * 20 * (watcherExpiry + 5))
+	b.mu.Lock()
+	assert.Equal(t, 0, len(b.watchers))
+	b.mu.Unlock()
+
+	assert.NoError(t, b.Stop())
+	assert.NoError(t, ma.Destroy())
+	assert.NoError(t, mb.Destroy())
+}
@@ -0,0 +1,42 @@
+// Code generated by protoc-gen-gogo.
+// source: heartbeat.proto
+// DO NOT EDIT!
+
+package detector
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+// Heartbeat is sent periodically to the monitoring peers.
+type Heartbeat struct {
+	From             *string `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Seq              *uint64 `protobuf:"varint,2,req" json:"Seq,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Heartbeat) Reset()         { *m = Heartbeat{} }
+func (m *Heartbeat) String() string { return proto.CompactTextString(m) }
+func (*Heartbeat) ProtoMessage()    {}
+
+func (m *Heartbeat) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Heartbeat) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func init() {
+}
@@ -0,0 +1,124 @@
+package detector
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// PhiAccrual implements the phi-accrual failure detector for one
+// peer. Instead of a boolean, it tells how suspicious the peer is,
+// based on the distribution of the heartbeat inter-arrival times:
+// phi = -log10(P(the next heartbeat arrives later than now)).
+// A phi of 1 means about 10% chance of a false suspicion,
+// 2 means 1%, 3 means 0.1%, and so on.
+type PhiAccrual struct {
+	mu           sync.Mutex
+	intervals    []float64 // Sliding window, in milliseconds.
+	windowSize   int
+	minStdDev    float64
+	pause        float64 // Acceptable heartbeat pause.
+	firstEstim   float64
+	lastArrival  time.Time
+	hasHeartbeat bool
+	started      bool // Started without a heartbeat yet.
+}
+
+// NewPhiAccrual creates a phi-accrual failure detector.
+// The windowSize is the number of inter-arrival times to keep,
+// minStdDev avoids a too sharp distribution when the heartbeats
+// are very regular, pause is added to the mean to tolerate the
+// occasional delays, and firstInterval is the estimated interval
+// used until there are enough heartbeats.
+func NewPhiAccrual(windowSize int, minStdDev, pause, firstInterval time.Duration) *PhiAccrual {
+	return &PhiAccrual{
+		windowSize: windowSize,
+		minStdDev:  toMillis(minStdDev),
+		pause:      toMillis(pause),
+		firstEstim: toMillis(firstInterval),
+	}
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Start makes the phi grow from the time as if a heartbeat arrived,
+// so a peer that never sends any heartbeat is eventually suspected.
+// The interval until the first heartbeat is not recorded.
+// It has no effect if a heartbeat has arrived already.
+func (p *PhiAccrual) Start(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.hasHeartbeat {
+		p.bootstrap()
+		p.lastArrival = now
+		p.started = true
+	}
+}
+
+// bootstrap starts with the estimated interval, mean +/- stddev,
+// where the stddev is a quarter of the mean.
+func (p *PhiAccrual) bootstrap() {
+	stdDev := p.firstEstim / 4
+	p.intervals = append(p.intervals, p.firstEstim-stdDev, p.firstEstim+stdDev)
+	p.hasHeartbeat = true
+}
+
+// Heartbeat records a heartbeat arrived at the time.
+func (p *PhiAccrual) Heartbeat(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.hasHeartbeat {
+		p.bootstrap()
+	} else if p.started {
+		p.started = false
+	} else {
+		p.intervals = append(p.intervals, toMillis(now.Sub(p.lastArrival)))
+		if len(p.intervals) > p.windowSize {
+			p.intervals = p.intervals[len(p.intervals)-p.windowSize:]
+		}
+	}
+	p.lastArrival = now
+}
+
+// Phi returns the suspicion level at the time.
+// It's 0 if no heartbeat has arrived yet, and it's not started.
+func (p *PhiAccrual) Phi(now time.Time) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.hasHeartbeat {
+		return 0
+	}
+
+	var sum, sqSum float64
+	for _, v := range p.intervals {
+		sum += v
+		sqSum += v * v
+	}
+	n := float64(len(p.intervals))
+	mean := sum / n
+	stdDev := math.Sqrt(math.Max(sqSum/n-mean*mean, 0))
+	stdDev = math.Max(stdDev, p.minStdDev)
+	mean += p.pause
+
+	return phi(toMillis(now.Sub(p.lastArrival)), mean, stdDev)
+}
+
+// phi uses the logistic approximation of the cumulative normal
+// distribution, which is precise enough. A late heartbeat is
+// computed in the log domain, so the phi keeps growing instead of
+// reaching +Inf when the probability underflows.
+func phi(timeDiff, mean, stdDev float64) float64 {
+	y := (timeDiff - mean) / stdDev
+	a := y * (1.5976 + 0.070566*y*y)
+	if timeDiff > mean {
+		// -log10(e/(1+e)) where e = exp(-a).
+		return a/math.Ln10 + math.Log10(1+math.Exp(-a))
+	}
+	e := math.Exp(-a)
+	return -math.Log10(1 - 1/(1+e))
+}
@@ -0,0 +1,346 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/metrics"
+)
+
+const defaultHandlerName = "default"
+
+// handlerFunc is the internal form of the handlers, which also
+// receives the context and the address of the sender.
+type handlerFunc func(ctx context.Context, from string, msg interface{})
+
+// handler is a registered message handler.
+type handler struct {
+	sync.Mutex
+	name        string
+	iface       reflect.Type // The interface type, for interface handlers.
+	fn          handlerFunc
+	priority    int
+	filter      func(msg interface{}) bool
+	removed     func() // Called when the handler is removed or replaced.
+	panics      int    // Number of consecutive panics.
+	quarantined bool
+}
+
+// byPriority sorts the handlers from the highest priority to the lowest.
+type byPriority []*handler
+
+func (p byPriority) Len() int           { return len(p) }
+func (p byPriority) Less(i, j int) bool { return p[i].priority > p[j].priority }
+func (p byPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func newHandler(name string, fn handlerFunc) *handler {
+	return &handler{name: name, fn: fn}
+}
+
+// wrapHandler turns a MessageHandler into a handlerFunc.
+func wrapHandler(msgHandler MessageHandler) handlerFunc {
+	return func(ctx context.Context, from string, msg interface{}) {
+		msgHandler(msg)
+	}
+}
+
+// remove runs the hook of the handler when it's removed.
+func (h *handler) remove() {
+	if h.removed != nil {
+		h.removed()
+	}
+}
+
+func (h *handler) isQuarantined() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.quarantined
+}
+
+// panicked records a panic, and quarantines the handler if it
+// has panicked limit times in a row. A limit of 0 means never.
+func (h *handler) panicked(limit int) bool {
+	h.Lock()
+	defer h.Unlock()
+	h.panics++
+	if limit > 0 && h.panics >= limit {
+		h.quarantined = true
+	}
+	return h.quarantined
+}
+
+func (h *handler) succeeded() {
+	h.Lock()
+	defer h.Unlock()
+	h.panics = 0
+}
+
+func (h *handler) release() {
+	h.Lock()
+	defer h.Unlock()
+	h.panics = 0
+	h.quarantined = false
+}
+
+// PanicError is reported when a handler or its filter panics.
+type PanicError struct {
+	Handler string      // Name of the handler.
+	Msg     interface{} // The message being handled.
+	Value   interface{} // The value passed to panic().
+	Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler %v panicked on %T: %v", e.Handler, e.Msg, e.Value)
+}
+
+// SetErrorHandler sets a callback that is called with the errors
+// that happen asynchronously, such as a *PanicError from a handler.
+func (m *Messenger) SetErrorHandler(errHandler func(error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errorHandler = errHandler
+}
+
+// SetPanicQuarantine makes the messenger quarantine a handler after
+// it panics limit times in a row. A quarantined handler is not called
+// any more until it's released. A limit of 0 disables the quarantine.
+func (m *Messenger) SetPanicQuarantine(limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.panicQuarantine = limit
+}
+
+// QuarantinedHandlers returns the names of the quarantined handlers.
+// The name of a handler is its message type, or "default" for the
+// default handler.
+func (m *Messenger) QuarantinedHandlers() []string {
+	var names []string
+	for _, h := range m.allHandlers() {
+		if h.isQuarantined() {
+			names = append(names, h.name)
+		}
+	}
+	return names
+}
+
+// ReleaseHandler releases the quarantined handlers by their name.
+func (m *Messenger) ReleaseHandler(name string) error {
+	found := false
+	for _, h := range m.allHandlers() {
+		if h.name == name {
+			h.release()
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Unknown handler: %v", name)
+	}
+	return nil
+}
+
+func (m *Messenger) allHandlers() []*handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var hs []*handler
+	for _, list := range m.handlers {
+		hs = append(hs, list...)
+	}
+	hs = append(hs, m.interfaceHandlers...)
+	if m.defaultHandler != nil {
+		hs = append(hs, m.defaultHandler)
+	}
+	return hs
+}
+
+// dispatch passes the message to the handler registered for its
+// type and to the handlers registered for the interfaces it implements.
+// If there is none of them, the message goes to the default handler.
+// It returns false if the message is not handled at all.
+func (m *Messenger) dispatch(ctx context.Context, msgType reflect.Type, from string, msg interface{}) bool {
+	// Don't hold the lock while calling the handlers,
+	// since they may register handlers as well.
+	var hs []*handler
+	m.mu.RLock()
+	hs = append(hs, m.handlers[msgType]...)
+	for _, h := range m.interfaceHandlers {
+		if msgType.Implements(h.iface) {
+			hs = append(hs, h)
+		}
+	}
+	defaultHandler := m.defaultHandler
+	m.mu.RUnlock()
+	sort.Stable(byPriority(hs))
+
+	handled := false
+	for _, h := range hs {
+		handled = m.invoke(ctx, h, from, msg) || handled
+	}
+	if !handled && defaultHandler != nil {
+		handled = m.invoke(ctx, defaultHandler, from, msg)
+	}
+	return handled
+}
+
+// addHandler adds a handler for the message type, or for the interface
+// if the type is a pointer to an interface. The handler names are unique
+// per type, an existing handler is replaced only if replace is true.
+func (m *Messenger) addHandler(msgType reflect.Type, h *handler, replace bool) error {
+	if !m.enableHandler {
+		return fmt.Errorf("Cannot register handler since it's disabled")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []*handler
+	if isInterfacePtr(msgType) {
+		h.iface = msgType.Elem()
+		list = m.interfaceHandlers
+	} else {
+		list = m.handlers[msgType]
+	}
+
+	for i := range list {
+		if list[i].iface == h.iface && list[i].name == h.name {
+			if !replace {
+				return fmt.Errorf("Handler %v for %v is already registered", h.name, msgType)
+			}
+			list[i].remove()
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+
+	// Keep the list sorted by priority, the handlers with the
+	// same priority are called in the order of registration.
+	i := sort.Search(len(list), func(i int) bool {
+		return list[i].priority < h.priority
+	})
+	list = append(list[:i:i], append([]*handler{h}, list[i:]...)...)
+
+	if isInterfacePtr(msgType) {
+		m.interfaceHandlers = list
+	} else {
+		m.handlers[msgType] = list
+	}
+	return nil
+}
+
+// removeHandler removes the first handler of the message type
+// that matches.
+func (m *Messenger) removeHandler(msgType reflect.Type, match func(*handler) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if isInterfacePtr(msgType) {
+		for i, h := range m.interfaceHandlers {
+			if h.iface == msgType.Elem() && match(h) {
+				h.remove()
+				m.interfaceHandlers = append(m.interfaceHandlers[:i:i], m.interfaceHandlers[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("No handler for interface type: %v", msgType.Elem())
+	}
+	list := m.handlers[msgType]
+	for i, h := range list {
+		if match(h) {
+			h.remove()
+			list = append(list[:i:i], list[i+1:]...)
+			if len(list) == 0 {
+				delete(m.handlers, msgType)
+			} else {
+				m.handlers[msgType] = list
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("No handler for message type: %v", msgType)
+}
+
+// handlerName returns the name of the handler registered by
+// RegisterHandler, which is the message type or the interface type.
+func handlerName(msgType reflect.Type) string {
+	if isInterfacePtr(msgType) {
+		return msgType.Elem().String()
+	}
+	return msgType.String()
+}
+
+// isInterfacePtr tells whether the type is a pointer to an interface,
+// which is used to register handlers for interface types.
+func isInterfacePtr(t reflect.Type) bool {
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Interface
+}
+
+// match tells whether the message passes the filter of the handler.
+// A panic in the filter is recovered and reported to the error
+// handler, the message doesn't match then.
+func (m *Messenger) match(h *handler, msg interface{}) (matched bool) {
+	if h.filter == nil {
+		return true
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			err := &PanicError{h.name, msg, r, buf}
+			m.logger.Errorf("Filter of handler %v panicked on %T: %v\n%s", h.name, msg, r, buf)
+			m.reportError(err)
+			matched = false
+		}
+	}()
+	return h.filter(msg)
+}
+
+// invoke calls the handler with the message if it passes the filter.
+// A panic in the handler is recovered and reported to the error handler.
+// It returns false if the handler is quarantined or filters the message.
+func (m *Messenger) invoke(ctx context.Context, h *handler, from string, msg interface{}) (handled bool) {
+	if h.isQuarantined() || !m.match(h, msg) {
+		return false
+	}
+	labels := metrics.Labels{"type": typeName(msg), "handler": h.name}
+	defer m.since(metricHandler, labels, time.Now())
+	ctx, span := m.tracer.StartFromContext(ctx, spanHandler)
+	span.SetAttribute("handler", h.name)
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			err := &PanicError{h.name, msg, r, buf}
+			span.End(err)
+			m.logger.Errorf("%v\n%s", err, buf)
+			m.mu.RLock()
+			limit := m.panicQuarantine
+			m.mu.RUnlock()
+			if h.panicked(limit) {
+				m.logger.Warningf("Handler %v is quarantined\n", h.name)
+			}
+			m.reportError(err)
+		}
+	}()
+	handled = true
+	h.fn(ctx, from, msg)
+	h.succeeded()
+	span.End(nil)
+	return
+}
+
+// reportError passes the error to the error handler.
+func (m *Messenger) reportError(err error) {
+	m.debug.fail("", false, err)
+	m.mu.RLock()
+	errHandler := m.errorHandler
+	m.mu.RUnlock()
+	if errHandler != nil {
+		errHandler(err)
+	}
+}
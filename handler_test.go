@@ -0,0 +1,98 @@
+package messenger
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test that panicking handlers are isolated and quarantined.
+func TestHandlerPanic(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+
+	var errs []error
+	var calls, fallback int
+	m.SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	m.SetPanicQuarantine(2)
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		calls++
+		panic("boom")
+	}))
+	assert.NoError(t, m.SetDefaultHandler(func(msg interface{}) {
+		fallback++
+	}))
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	msgType := reflect.TypeOf(msg)
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 2, len(errs))
+	perr, ok := errs[0].(*PanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", perr.Value)
+	assert.Equal(t, msg, perr.Msg)
+	assert.NotEmpty(t, perr.Stack)
+
+	// The handler is quarantined, so the message goes to the default handler.
+	assert.Equal(t, []string{msgType.String()}, m.QuarantinedHandlers())
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, fallback)
+
+	assert.Error(t, m.ReleaseHandler("unknown"))
+	assert.NoError(t, m.ReleaseHandler(msgType.String()))
+	assert.Empty(t, m.QuarantinedHandlers())
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, 3, calls)
+}
+
+// Test changing the handlers while messages are dispatched.
+func TestConcurrentRegistration(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	var mu sync.Mutex
+	var first, second int
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		mu.Lock()
+		first++
+		mu.Unlock()
+	}))
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	msgType := reflect.TypeOf(msg)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			m.dispatch(context.Background(), msgType, "", msg)
+		}
+		close(done)
+	}()
+
+	assert.NoError(t, m.ReplaceHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		mu.Lock()
+		second++
+		mu.Unlock()
+	}))
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage2{}))
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage2{}, handler2))
+	<-done
+
+	mu.Lock()
+	assert.Equal(t, 1000, first+second)
+	mu.Unlock()
+
+	assert.NoError(t, m.UnregisterHandler(&example.GoGoProtobufTestMessage1{}))
+	assert.Error(t, m.UnregisterHandler(&example.GoGoProtobufTestMessage1{}))
+	assert.False(t, m.dispatch(context.Background(), msgType, "", msg))
+}
@@ -0,0 +1,166 @@
+package messenger
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-distributed/messenger/metrics"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// DefaultMetricsPath is where ServeMetrics serves the metrics by default.
+const DefaultMetricsPath = "/metrics"
+
+// The names of the metrics recorded by the messenger.
+const (
+	metricSent          = "messenger_messages_sent_total"     // By type and peer.
+	metricReceived      = "messenger_messages_received_total" // By type and peer.
+	metricDropped       = "messenger_messages_dropped_total"  // By direction, type and peer.
+	metricBytesSent     = "messenger_bytes_sent_total"        // By peer.
+	metricBytesReceived = "messenger_bytes_received_total"    // By peer.
+	metricQueueDepth    = "messenger_queue_depth"             // By queue and peer.
+	metricCodec         = "messenger_codec_seconds"           // By op.
+	metricTransport     = "messenger_transport_seconds"       // By op.
+	metricHandler       = "messenger_handler_seconds"         // By type and handler.
+)
+
+// The metrics are broken down by at most maxPeerLabels peers, since
+// the inbound peers are claimed by the senders, anyone could make the
+// series grow without bound. The other peers are counted as otherPeer.
+const (
+	maxPeerLabels = 1024
+	otherPeer     = "other"
+)
+
+// peerLabels bounds the values of the peer label.
+type peerLabels struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	max  int
+}
+
+func newPeerLabels(max int) *peerLabels {
+	return &peerLabels{seen: make(map[string]bool), max: max}
+}
+
+// label returns the peer label of the hostport.
+func (p *peerLabels) label(hostport string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.seen[hostport] {
+		if len(p.seen) >= p.max {
+			return otherPeer
+		}
+		p.seen[hostport] = true
+	}
+	return hostport
+}
+
+// Metrics returns the metrics the messenger records to.
+func (m *Messenger) Metrics() metrics.Metrics {
+	return m.metrics
+}
+
+// MetricsSnapshot returns the current metrics, or nil if the
+// metrics can't be inspected. The messenger records:
+//
+//	messenger_messages_sent_total{type,peer}
+//	messenger_messages_received_total{type,peer}
+//	messenger_messages_dropped_total{direction,type,peer}
+//	messenger_bytes_sent_total{peer}
+//	messenger_bytes_received_total{peer}
+//	messenger_queue_depth{queue,peer}
+//	messenger_codec_seconds{op}, op is marshal or unmarshal
+//	messenger_transport_seconds{op}, op is send
+//	messenger_handler_seconds{type,handler}
+//
+// After 1024 different peers, the other peers are counted as "other".
+// The queue depths are updated when the snapshot is taken.
+func (m *Messenger) MetricsSnapshot() *metrics.Snapshot {
+	s, ok := m.metrics.(metrics.Snapshotter)
+	if !ok {
+		return nil
+	}
+	m.updateQueueMetrics()
+	return s.Snapshot()
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics
+// in the Prometheus text exposition format.
+func (m *Messenger) MetricsHandler() http.Handler {
+	return metrics.PrometheusHandler(m.MetricsSnapshot)
+}
+
+// ServeMetrics serves the metrics in the Prometheus text format at
+// the path, or DefaultMetricsPath if it's empty, along with the
+// messages. The transporter must serve HTTP, like the HTTPTransporter.
+func (m *Messenger) ServeMetrics(path string) error {
+	mux, ok := m.tr.(transporter.HTTPMuxer)
+	if !ok {
+		return fmt.Errorf("Transporter %T cannot serve HTTP", m.tr)
+	}
+	if path == "" {
+		path = DefaultMetricsPath
+	}
+	mux.Handle(path, m.MetricsHandler())
+	return nil
+}
+
+func (m *Messenger) updateQueueMetrics() {
+	for _, q := range m.Queues() {
+		peer := q.Peer
+		if peer != "" {
+			peer = m.peerLabels.label(peer)
+		}
+		m.metrics.Set(metricQueueDepth, metrics.Labels{"queue": q.Name, "peer": peer}, float64(q.Len))
+	}
+}
+
+// typeName returns the name of the message type for the labels.
+func typeName(msg interface{}) string {
+	if msg == nil {
+		return "unknown"
+	}
+	return reflect.TypeOf(msg).String()
+}
+
+func (m *Messenger) since(name string, labels metrics.Labels, start time.Time) {
+	m.metrics.Observe(name, labels, time.Since(start).Seconds())
+}
+
+// marshal encodes the message, and records the latency.
+func (m *Messenger) marshal(msg interface{}) ([]byte, error) {
+	defer m.since(metricCodec, metrics.Labels{"op": "marshal"}, time.Now())
+	return m.codec.Marshal(msg)
+}
+
+// unmarshal decodes the message, and records the latency.
+func (m *Messenger) unmarshal(b []byte) (interface{}, error) {
+	// The codec expects at least the type byte.
+	if len(b) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	defer m.since(metricCodec, metrics.Labels{"op": "unmarshal"}, time.Now())
+	return m.codec.Unmarshal(b)
+}
+
+func (m *Messenger) countSent(hostport string, msg interface{}, n int) {
+	peer := m.peerLabels.label(hostport)
+	m.metrics.Add(metricSent, metrics.Labels{"type": typeName(msg), "peer": peer}, 1)
+	m.metrics.Add(metricBytesSent, metrics.Labels{"peer": peer}, float64(n))
+}
+
+func (m *Messenger) countReceived(from string, msg interface{}, n int) {
+	peer := m.peerLabels.label(from)
+	m.metrics.Add(metricReceived, metrics.Labels{"type": typeName(msg), "peer": peer}, 1)
+	m.metrics.Add(metricBytesReceived, metrics.Labels{"peer": peer}, float64(n))
+}
+
+func (m *Messenger) countDropped(d Direction, hostport string, msg interface{}) {
+	m.metrics.Add(metricDropped, metrics.Labels{
+		"direction": d.String(), "type": typeName(msg), "peer": m.peerLabels.label(hostport),
+	}, 1)
+}
@@ -0,0 +1,122 @@
+package messenger
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/metrics"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the messenger records the metrics.
+func TestMetrics(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	handled := make(chan struct{}, 1)
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		handled <- struct{}{}
+	}))
+	assert.NoError(t, m.Start())
+	defer m.Destroy()
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	msgType := "*protobuf.GoGoProtobufTestMessage1"
+	b, err := m.Codec().Marshal(msg)
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.Send("a:8000", msg))
+	<-tr.out
+	tr.in <- b
+	<-handled
+	tr.setDown("b:8000", true)
+	assert.NoError(t, m.Send("b:8000", msg))
+
+	var s *metrics.Snapshot
+	waitFor(t, time.Second, func() bool {
+		s = m.MetricsSnapshot()
+		return s.Counter(metricDropped, metrics.Labels{
+			"direction": "outbound", "type": msgType, "peer": "b:8000",
+		}) == 1
+	})
+	assert.Equal(t, float64(1), s.Counter(metricSent, metrics.Labels{"type": msgType, "peer": "a:8000"}))
+	assert.Equal(t, float64(len(b)), s.Counter(metricBytesSent, metrics.Labels{"peer": "a:8000"}))
+	assert.Equal(t, float64(1), s.Counter(metricReceived, metrics.Labels{"type": msgType, "peer": ""}))
+	assert.Equal(t, float64(len(b)), s.Counter(metricBytesReceived, metrics.Labels{"peer": ""}))
+	assert.Equal(t, uint64(2), s.Histogram(metricCodec, metrics.Labels{"op": "marshal"}).Count)
+	assert.Equal(t, uint64(1), s.Histogram(metricCodec, metrics.Labels{"op": "unmarshal"}).Count)
+	assert.Equal(t, uint64(2), s.Histogram(metricTransport, metrics.Labels{"op": "send"}).Count)
+	assert.Equal(t, uint64(1), s.Histogram(metricHandler, metrics.Labels{"type": msgType, "handler": msgType}).Count)
+	assert.Equal(t, float64(0), s.Gauge(metricQueueDepth, metrics.Labels{"queue": "outbound", "peer": "a:8000"}))
+	assert.Equal(t, 4, len(s.Gauges))
+}
+
+// Test the peer labels are bounded.
+func TestPeerLabels(t *testing.T) {
+	p := newPeerLabels(2)
+	assert.Equal(t, "a:8000", p.label("a:8000"))
+	assert.Equal(t, "b:8000", p.label("b:8000"))
+	assert.Equal(t, otherPeer, p.label("c:8000"))
+	assert.Equal(t, "a:8000", p.label("a:8000"))
+}
+
+// Test the metrics can be disabled.
+func TestMetricsDiscard(t *testing.T) {
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), newFakeTransporter(),
+		WithMetrics(metrics.Discard))
+	assert.NoError(t, err)
+	assert.Equal(t, metrics.Discard, m.Metrics())
+	assert.Nil(t, m.MetricsSnapshot())
+}
+
+// Test the metrics are served in the Prometheus text format
+// along with the messages.
+func TestServeMetrics(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+	assert.Error(t, m.ServeMetrics(""))
+
+	hostport := freePort(t)
+	tr := transporter.NewHTTPTransporter(hostport)
+	m = New(codec.NewGoGoProtobufCodec(), tr, false, true)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.ServeMetrics(""))
+	assert.NoError(t, m.Start())
+	defer m.Destroy()
+
+	assert.NoError(t, m.Send(hostport, &example.GoGoProtobufTestMessage1{}))
+	sent := fmt.Sprintf(`%s{peer=%q,type="*protobuf.GoGoProtobufTestMessage1"} 1`, metricSent, hostport)
+	var body string
+	waitFor(t, time.Second*5, func() bool {
+		resp, err := http.Get("http://" + hostport + DefaultMetricsPath)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body = string(b)
+		return resp.StatusCode == http.StatusOK && strings.Contains(body, sent)
+	})
+	assert.Contains(t, body, "# TYPE "+metricSent+" counter\n")
+	assert.Contains(t, body, "# TYPE "+metricCodec+" histogram\n")
+	assert.Contains(t, body, metricCodec+`_bucket{le="+Inf",op="marshal"} 1`)
+}
+
+// freePort returns a local address that is free to listen on.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
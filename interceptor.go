@@ -0,0 +1,87 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// InboundFunc delivers an incoming message to the handlers
+// and the receive queue. The from is the address of the sender,
+// it's empty if the transporter doesn't know it. The ctx is
+// cancelled when the messenger is stopped.
+type InboundFunc func(ctx context.Context, from string, msg interface{}) error
+
+// InboundInterceptor wraps an InboundFunc. An interceptor can inspect
+// the message, mutate or replace it before passing it to next, delay
+// it, or drop it by returning without calling next.
+type InboundInterceptor func(next InboundFunc) InboundFunc
+
+// OutboundFunc queues an outgoing message for sending. The ctx
+// bounds how long the message can wait before it's sent.
+type OutboundFunc func(ctx context.Context, hostport string, msg interface{}) error
+
+// OutboundInterceptor wraps an OutboundFunc, see InboundInterceptor.
+type OutboundInterceptor func(next OutboundFunc) OutboundFunc
+
+// UseInbound appends interceptors to the inbound chain.
+// The interceptors added first are the outermost ones.
+func (m *Messenger) UseInbound(interceptors ...InboundInterceptor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inboundInterceptors = append(m.inboundInterceptors, interceptors...)
+	chain := InboundFunc(m.deliver)
+	for i := len(m.inboundInterceptors) - 1; i >= 0; i-- {
+		chain = m.inboundInterceptors[i](chain)
+	}
+	m.inboundChain = chain
+}
+
+// UseOutbound appends interceptors to the outbound chain.
+// The interceptors added first are the outermost ones.
+func (m *Messenger) UseOutbound(interceptors ...OutboundInterceptor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outboundInterceptors = append(m.outboundInterceptors, interceptors...)
+	chain := OutboundFunc(m.enqueue)
+	for i := len(m.outboundInterceptors) - 1; i >= 0; i-- {
+		chain = m.outboundInterceptors[i](chain)
+	}
+	m.outboundChain = chain
+}
+
+// RecoverInterceptor returns an interceptor that recovers from panics
+// in the rest of the chain, and turns them into errors. The panics
+// are logged to the messenger's logger.
+func (m *Messenger) RecoverInterceptor() InboundInterceptor {
+	return func(next InboundFunc) InboundFunc {
+		return func(ctx context.Context, from string, msg interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					buf := make([]byte, 4096)
+					buf = buf[:runtime.Stack(buf, false)]
+					m.logger.Errorf("Panic while handling %T: %v\n%s", msg, r, buf)
+					err = fmt.Errorf("Panic while handling %T: %v", msg, r)
+				}
+			}()
+			return next(ctx, from, msg)
+		}
+	}
+}
+
+// TimingInterceptor returns an interceptor that measures how long
+// the rest of the chain takes for each message, and reports it.
+func TimingInterceptor(report func(msg interface{}, d time.Duration)) InboundInterceptor {
+	return func(next InboundFunc) InboundFunc {
+		return func(ctx context.Context, from string, msg interface{}) error {
+			start := time.Now()
+			defer func() {
+				report(msg, time.Since(start))
+			}()
+			return next(ctx, from, msg)
+		}
+	}
+}
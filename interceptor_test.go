@@ -0,0 +1,92 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the inbound interceptor chain.
+func TestInboundInterceptors(t *testing.T) {
+	logger := &recordLogger{}
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), newFakeTransporter(), WithLogger(logger))
+	assert.NoError(t, err)
+
+	var order []string
+	var handled []interface{}
+	var timed int
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		handled = append(handled, msg)
+	}))
+
+	m.UseInbound(
+		m.RecoverInterceptor(),
+		TimingInterceptor(func(msg interface{}, d time.Duration) {
+			timed++
+		}),
+		func(next InboundFunc) InboundFunc {
+			return func(ctx context.Context, from string, msg interface{}) error {
+				order = append(order, "first")
+				return next(ctx, from, msg)
+			}
+		},
+		func(next InboundFunc) InboundFunc {
+			return func(ctx context.Context, from string, msg interface{}) error {
+				order = append(order, "second")
+				// Drop message 3, mutate message 1, and panic on message 2.
+				switch v := msg.(type) {
+				case *example.GoGoProtobufTestMessage2:
+					panic("boom")
+				case *example.GoGoProtobufTestMessage3:
+					return nil
+				case *example.GoGoProtobufTestMessage1:
+					v.F1 = proto.String("intercepted")
+				}
+				return next(ctx, from, msg)
+			}
+		})
+
+	assert.NoError(t, m.inboundChain(context.Background(), "", &example.GoGoProtobufTestMessage1{F1: proto.String("hello")}))
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, 1, len(handled))
+	assert.Equal(t, "intercepted", handled[0].(*example.GoGoProtobufTestMessage1).GetF1())
+
+	assert.NoError(t, m.inboundChain(context.Background(), "", &example.GoGoProtobufTestMessage3{}))
+	assert.Equal(t, 1, len(handled))
+
+	// The panic is recovered, and logged to the messenger's logger.
+	assert.Error(t, m.inboundChain(context.Background(), "", &example.GoGoProtobufTestMessage2{}))
+	assert.Equal(t, 3, timed)
+	assert.Equal(t, 1, len(logger.errors))
+}
+
+// Test the outbound interceptor chain.
+func TestOutboundInterceptors(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	m.UseOutbound(func(next OutboundFunc) OutboundFunc {
+		return func(ctx context.Context, hostport string, msg interface{}) error {
+			if hostport == "forbidden:8000" {
+				return fmt.Errorf("Not allowed to send to %v", hostport)
+			}
+			return next(ctx, "redirected:8000", msg)
+		}
+	})
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.Error(t, m.Send("forbidden:8000", msg))
+	assert.NoError(t, m.Send("localhost:8000", msg))
+	q, _ := m.peerQueue("redirected:8000")
+	assert.Equal(t, 1, len(q.ch))
+	mts := <-q.ch
+	assert.Equal(t, "redirected:8000", mts.hostport)
+	assert.Equal(t, msg, mts.msg)
+}
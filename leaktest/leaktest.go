@@ -0,0 +1,98 @@
+// Package leaktest helps the tests to verify that no goroutine
+// is leaked, e.g. after a messenger is destroyed.
+//
+//	func TestSomething(t *testing.T) {
+//		defer leaktest.Check(t)()
+//		...
+//	}
+package leaktest
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long Check waits for the goroutines to exit.
+const DefaultTimeout = time.Second * 5
+
+// TB is the part of testing.TB used by the package.
+type TB interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Check snapshots the running goroutines, and returns a function
+// that fails the test if any goroutine started afterwards is still
+// running, after waiting DefaultTimeout for them to exit.
+func Check(t TB) func() {
+	return CheckTimeout(t, DefaultTimeout)
+}
+
+// CheckTimeout is like Check, with a custom timeout.
+func CheckTimeout(t TB, timeout time.Duration) func() {
+	before := make(map[string]bool)
+	for id := range goroutines() {
+		before[id] = true
+	}
+	return func() {
+		var leaked []string
+		deadline := time.Now().Add(timeout)
+		for {
+			leaked = leaked[:0]
+			for id, stack := range goroutines() {
+				if !before[id] && !ignored(stack) {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		sort.Strings(leaked)
+		for _, stack := range leaked {
+			t.Errorf("Leaked goroutine: %v", stack)
+		}
+	}
+}
+
+// goroutines returns the stacks of the running goroutines by their ids.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		// The header looks like "goroutine 18 [running]:".
+		fields := strings.Fields(stack)
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		stacks[fields[1]] = stack
+	}
+	return stacks
+}
+
+// ignored tells whether the goroutine is run by the testing
+// package or the runtime, rather than the code under test.
+func ignored(stack string) bool {
+	for _, s := range []string{
+		"testing.tRunner(",
+		"testing.(*T).Run(",
+		"runtime.ensureSigM(",
+		"os/signal.signal_recv(",
+	} {
+		if strings.Contains(stack, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package leaktest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+// Test the leaked goroutines are reported.
+func TestCheck(t *testing.T) {
+	r := &recorder{}
+	check := CheckTimeout(r, time.Millisecond*50)
+	stop := make(chan struct{})
+	go func(stop chan struct{}) {
+		<-stop
+	}(stop)
+	check()
+	assert.Equal(t, 1, len(r.errors))
+	close(stop)
+
+	// The goroutines that exit in time are not reported.
+	r = &recorder{}
+	check = CheckTimeout(r, time.Second)
+	stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		<-stop
+	}(stop)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		close(stop)
+	}()
+	check()
+	assert.Empty(t, r.errors)
+}
@@ -0,0 +1,199 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle state of the messenger.
+type State int
+
+const (
+	// StateNew is the state of a messenger that is never started.
+	StateNew State = iota
+	// StateStarting means Start() is in progress.
+	StateStarting
+	// StateRunning means the messenger is sending and receiving.
+	StateRunning
+	// StateStopping means Stop() is in progress.
+	StateStopping
+	// StateStopped means the messenger is stopped, it can be
+	// started again.
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateStopping:
+		return "stopping"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// session holds what lives for one run of the messenger,
+// a new session is created when the messenger is restarted.
+type session struct {
+	stop chan struct{}
+	// Cancelled when the messenger is stopped.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Protects the recvQueue from being closed while sending to it.
+	recvMu     sync.RWMutex
+	recvQueue  chan interface{} // Buffer for recv messages.
+	recvClosed bool
+}
+
+func newSession(recvQueueSize int) *session {
+	s := &session{
+		stop:      make(chan struct{}),
+		recvQueue: make(chan interface{}, recvQueueSize),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// close ends the session, and wakes up the blocked receivers.
+func (s *session) close() {
+	s.cancel()
+	close(s.stop)
+
+	s.recvMu.Lock()
+	s.recvClosed = true
+	close(s.recvQueue)
+	s.recvMu.Unlock()
+}
+
+// renew creates the next session, the messages that are not
+// received yet are carried over.
+func (s *session) renew(recvQueueSize int) *session {
+	next := newSession(recvQueueSize)
+	for msg := range s.recvQueue {
+		select {
+		case next.recvQueue <- msg:
+		default:
+		}
+	}
+	return next
+}
+
+// State returns the lifecycle state of the messenger.
+func (m *Messenger) State() State {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.state
+}
+
+// current returns the current session.
+func (m *Messenger) current() *session {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.sess
+}
+
+func (m *Messenger) setState(state State) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state = state
+}
+
+// Start the messenger.
+func (m *Messenger) Start() error {
+	return m.StartContext(context.Background())
+}
+
+// StartContext starts the messenger, the ctx bounds how long it
+// waits for the transporter to start. A stopped messenger can be
+// started again, the messages that are not received yet are kept,
+// but the messages that were not sent before Stop() are not sent,
+// they are in the dead letters, see Reinject().
+func (m *Messenger) StartContext(ctx context.Context) error {
+	m.stateMu.Lock()
+	switch m.state {
+	case StateNew:
+	case StateStopped:
+		m.sess = m.sess.renew(m.recvQueueSize)
+	default:
+		m.stateMu.Unlock()
+		return fmt.Errorf("Cannot start messenger in state %v", m.state)
+	}
+	m.state = StateStarting
+	sess := m.sess
+	m.stateMu.Unlock()
+
+	if err := m.start(ctx, sess); err != nil {
+		sess.close()
+		m.setState(StateStopped)
+		return err
+	}
+	m.setState(StateRunning)
+	return nil
+}
+
+func (m *Messenger) start(ctx context.Context, sess *session) error {
+	if err := m.codec.Initial(); err != nil {
+		return err
+	}
+
+	// Buffered, so the goroutine doesn't leak if the
+	// transporter fails after the prepare period.
+	errChan := make(chan error, 1)
+	go func() {
+		if err := m.tr.Start(); err != nil {
+			errChan <- err
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		m.tr.Stop()
+		return ctx.Err()
+	case <-time.After(m.preparePeriod):
+	}
+
+	go m.incomingLoop(sess)
+	m.startSenders(sess)
+	for i := 0; i < m.workers; i++ {
+		go m.readingLoop(sess)
+	}
+	return nil
+}
+
+// Stop the messenger. The blocked receivers are woken up with
+// ErrStopped, the messages that are not sent yet are moved to the
+// dead letters with ErrStopped, so they are not sent when the
+// messenger is started again unless they are reinjected, and the
+// messages sent afterwards are rejected until then.
+func (m *Messenger) Stop() error {
+	m.stateMu.Lock()
+	prev := m.state
+	if prev != StateNew && prev != StateRunning {
+		m.stateMu.Unlock()
+		return fmt.Errorf("Cannot stop messenger in state %v", prev)
+	}
+	m.state = StateStopping
+	sess := m.sess
+	m.stateMu.Unlock()
+
+	sess.close()
+	m.stopSenders()
+	m.drainQueues()
+	var err error
+	if prev == StateRunning {
+		err = m.tr.Stop()
+	}
+	m.setState(StateStopped)
+	return err
+}
@@ -0,0 +1,148 @@
+package messenger
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/leaktest"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the lifecycle state machine, and restarting the messenger.
+func TestLifecycle(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.Equal(t, StateNew, m.State())
+
+	msg := &example.GoGoProtobufTestMessage1{F1: proto.String("hello")}
+	b, err := m.Codec().Marshal(msg)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, m.Start())
+		assert.Equal(t, StateRunning, m.State())
+		assert.Error(t, m.Start())
+
+		assert.NoError(t, m.Send("a:8000", msg))
+		select {
+		case out := <-tr.out:
+			assert.Equal(t, b, out)
+		case <-time.After(time.Second):
+			t.Fatal("Nothing sent")
+		}
+		tr.in <- b
+		recvMsg, err := m.RecvTimeout(time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, recvMsg)
+
+		// Leave a message in the receive queue.
+		tr.in <- b
+		waitFor(t, time.Second, func() bool { return len(m.RecvChan()) == 1 })
+
+		assert.NoError(t, m.Stop())
+		assert.Equal(t, StateStopped, m.State())
+		assert.Error(t, m.Stop())
+		assert.Equal(t, ErrStopped, m.Send("a:8000", msg))
+
+		// The queued message can still be received.
+		recvMsg, err = m.TryRecv()
+		assert.NoError(t, err)
+		assert.Equal(t, msg, recvMsg)
+		_, err = m.Recv()
+		assert.Equal(t, ErrStopped, err)
+	}
+
+	assert.NoError(t, m.Destroy())
+	assert.Equal(t, StateStopped, m.State())
+}
+
+// Test a new messenger can be stopped without being started,
+// the messages not received are kept when it's restarted, and
+// the messages not sent are moved to the dead letters.
+func TestStopNew(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.NoError(t, m.pushRecv("", msg))
+	assert.NoError(t, m.Send("a:8000", msg))
+
+	assert.NoError(t, m.Stop())
+	assert.Equal(t, StateStopped, m.State())
+	it := m.DeadLetters()
+	assert.Equal(t, 1, it.Len())
+	it.Next()
+	dl := it.DeadLetter()
+	assert.Equal(t, Outbound, dl.Direction)
+	assert.Equal(t, ErrStopped, dl.Reason)
+
+	assert.NoError(t, m.Start())
+	recvMsg, err := m.TryRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, msg, recvMsg)
+	select {
+	case <-tr.out:
+		t.Fatal("The dead letter is sent after the restart")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// It's sent once it's reinjected.
+	assert.NoError(t, m.Reinject(dl))
+	select {
+	case <-tr.out:
+	case <-time.After(time.Second):
+		t.Fatal("Reinjected message is not sent")
+	}
+	assert.NoError(t, m.Destroy())
+}
+
+// Test no goroutine is leaked after the messengers are destroyed.
+func TestDestroyNoLeaks(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	network := transporter.NewLocalNetwork()
+	for _, trs := range [][]transporter.Transporter{
+		{transporter.NewHTTPTransporter("localhost:8040"), transporter.NewHTTPTransporter("localhost:8041")},
+		{transporter.NewLocalTransporter(network, "localhost:8040"), transporter.NewLocalTransporter(network, "localhost:8041")},
+		{newFakeTransporter(), newFakeTransporter()},
+	} {
+		var ms []*Messenger
+		for _, tr := range trs {
+			m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+				WithRecv(true), WithPreparePeriod(time.Millisecond*100),
+				WithDispatchMode(DispatchConcurrent, 4))
+			assert.NoError(t, err)
+			assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+			assert.NoError(t, m.Start())
+			ms = append(ms, m)
+		}
+		msg := &example.GoGoProtobufTestMessage1{F1: proto.String("hello")}
+		assert.NoError(t, ms[0].Send("localhost:8041", msg))
+		assert.NoError(t, ms[0].Send("localhost:8042", msg))
+		if _, ok := trs[0].(*fakeTransporter); !ok {
+			recvMsg, err := ms[1].RecvTimeout(time.Second * 5)
+			assert.NoError(t, err)
+			assert.Equal(t, msg, recvMsg)
+		}
+
+		// A receiver blocked in Recv() is woken up.
+		errs := make(chan error)
+		go func() {
+			_, err := ms[0].Recv()
+			errs <- err
+		}()
+		for _, m := range ms {
+			assert.NoError(t, m.Destroy())
+		}
+		assert.Equal(t, ErrStopped, <-errs)
+	}
+}
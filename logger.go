@@ -0,0 +1,29 @@
+package messenger
+
+import (
+	log "github.com/golang/glog"
+)
+
+// Logger logs the messenger's internal events.
+type Logger interface {
+	// Infof logs the verbose messages.
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// glogLogger is the default logger, the verbose messages
+// are logged at -v=1.
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	log.V(1).Infof(format, args...)
+}
+
+func (glogLogger) Warningf(format string, args ...interface{}) {
+	log.Warningf(format, args...)
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+}
@@ -0,0 +1,686 @@
+// Package membership implements a SWIM-style membership protocol
+// atop the messenger. The members probe each other directly and
+// indirectly, and gossip the join/leave/suspect/dead states by
+// piggybacking on the probe messages.
+package membership
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	log "github.com/golang/glog"
+)
+
+// State is the state of a member.
+type State int
+
+const (
+	// Alive members answer the probes.
+	Alive State = iota
+	// Suspect members failed to answer a probe, they are declared
+	// dead unless they refute the suspicion in time.
+	Suspect
+	// Dead members are confirmed to be failed.
+	Dead
+	// Left members have left the group voluntarily.
+	Left
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Member is a snapshot of a member.
+type Member struct {
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// EventType is the type of a membership change.
+type EventType int
+
+const (
+	// MemberJoined is emitted when a member is first known alive,
+	// or comes back after being dead or left.
+	MemberJoined EventType = iota
+	// MemberSuspected is emitted when a member becomes suspect.
+	MemberSuspected
+	// MemberRecovered is emitted when a suspect member refutes.
+	MemberRecovered
+	// MemberDied is emitted when a member is confirmed dead.
+	MemberDied
+	// MemberLeft is emitted when a member leaves.
+	MemberLeft
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MemberJoined:
+		return "joined"
+	case MemberSuspected:
+		return "suspected"
+	case MemberRecovered:
+		return "recovered"
+	case MemberDied:
+		return "died"
+	case MemberLeft:
+		return "left"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change of the membership.
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+// Config configures the membership protocol.
+type Config struct {
+	// A member is probed every ProbeInterval.
+	ProbeInterval time.Duration
+	// How long to wait for the ack of a direct probe before
+	// asking the other members to probe indirectly.
+	ProbeTimeout time.Duration
+	// Number of members to ask for an indirect probe.
+	IndirectProbes int
+	// How long a member stays suspect before it's declared dead.
+	SuspicionTimeout time.Duration
+	// An update is gossiped RetransmitMult * log(N) times.
+	RetransmitMult int
+	// Maximum number of updates piggybacked on a message.
+	MaxPiggyback int
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		ProbeInterval:    time.Second,
+		ProbeTimeout:     time.Millisecond * 300,
+		IndirectProbes:   3,
+		SuspicionTimeout: time.Second * 5,
+		RetransmitMult:   4,
+		MaxPiggyback:     8,
+	}
+}
+
+type member struct {
+	Member
+	suspectTime time.Time
+}
+
+// An update waiting to be gossiped.
+type update struct {
+	u         *Update
+	transmits int
+}
+
+// An indirect probe relayed for another member.
+type relay struct {
+	addr  string
+	seq   uint64
+	start time.Time
+}
+
+// Membership maintains the member list of a group.
+type Membership struct {
+	m      *messenger.Messenger
+	self   string
+	config Config
+
+	mu           sync.Mutex
+	incarnation  uint64
+	members      map[string]*member // Not including self.
+	probeOrder   []string
+	probeIndex   int
+	seq          uint64
+	acks         map[uint64]chan struct{}
+	relays       map[uint64]*relay
+	updates      map[string]*update
+	eventHandler func(Event)
+	rand         *rand.Rand
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates the membership atop the messenger, self is the
+// address of the messenger that the members can send to.
+// It registers its own messages in the messenger, so the messenger
+// must have the handler enabled. If config is nil, the default
+// configuration is used.
+func New(m *messenger.Messenger, self string, config *Config) (*Membership, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	ml := &Membership{
+		m:       m,
+		self:    self,
+		config:  *config,
+		members: make(map[string]*member),
+		acks:    make(map[uint64]chan struct{}),
+		relays:  make(map[uint64]*relay),
+		updates: make(map[string]*update),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	msgs := []interface{}{&Ping{}, &Ack{}, &PingReq{}, &Sync{}}
+	handlers := []messenger.MessageHandler{
+		ml.handlePing, ml.handleAck, ml.handlePingReq, ml.handleSync,
+	}
+	for i := range msgs {
+		if err := m.RegisterMessage(msgs[i]); err != nil {
+			return nil, err
+		}
+		if err := m.RegisterHandler(msgs[i], handlers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ml, nil
+}
+
+// SetEventHandler sets a callback that is called on every
+// membership change.
+func (ml *Membership) SetEventHandler(h func(Event)) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.eventHandler = h
+}
+
+// Start probing the members.
+func (ml *Membership) Start() error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if ml.stop != nil {
+		return fmt.Errorf("Membership is already started")
+	}
+	ml.stop = make(chan struct{})
+	ml.stopped = make(chan struct{})
+	go ml.probeLoop(ml.stop, ml.stopped)
+	return nil
+}
+
+// Stop probing the members. It doesn't tell the others,
+// so they will find this member dead, see Leave.
+func (ml *Membership) Stop() error {
+	ml.mu.Lock()
+	stop, stopped := ml.stop, ml.stopped
+	ml.stop, ml.stopped = nil, nil
+	ml.mu.Unlock()
+
+	if stop == nil {
+		return fmt.Errorf("Membership is not started")
+	}
+	close(stop)
+	<-stopped
+	return nil
+}
+
+// Join the group by contacting the seeds.
+func (ml *Membership) Join(seeds ...string) error {
+	join := &Sync{
+		From:    proto.String(ml.self),
+		Updates: ml.fullState(),
+		Reply:   proto.Bool(true),
+	}
+	var lastErr error
+	sent := 0
+	for _, seed := range seeds {
+		if seed == ml.self {
+			continue
+		}
+		if err := ml.m.Send(seed, join); err != nil {
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
+
+// Leave the group. The others are told, and the probing stops.
+func (ml *Membership) Leave() error {
+	ml.mu.Lock()
+	left := newUpdate(ml.self, Left, ml.incarnation)
+	ml.mu.Unlock()
+
+	for _, peer := range ml.Peers() {
+		err := ml.m.Send(peer, &Sync{
+			From:    proto.String(ml.self),
+			Updates: []*Update{left},
+		})
+		if err != nil {
+			log.Warningf("Membership: Failed to send leave to %v: %v\n", peer, err)
+		}
+	}
+	return ml.Stop()
+}
+
+// Members returns a snapshot of the member list, including
+// this member itself, sorted by address.
+func (ml *Membership) Members() []Member {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	members := []Member{{ml.self, Alive, ml.incarnation}}
+	for _, mb := range ml.members {
+		members = append(members, mb.Member)
+	}
+	sort.Sort(byAddr(members))
+	return members
+}
+
+// Peers returns the addresses of the other members that are
+// alive or suspect.
+func (ml *Membership) Peers() []string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.peers()
+}
+
+// Group returns the live peers as a messenger group source,
+// so messages can be multicast to them.
+func (ml *Membership) Group() messenger.MembershipSource {
+	return messenger.MembershipFunc(ml.Peers)
+}
+
+type byAddr []Member
+
+func (p byAddr) Len() int           { return len(p) }
+func (p byAddr) Less(i, j int) bool { return p[i].Addr < p[j].Addr }
+func (p byAddr) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func newUpdate(addr string, state State, incarnation uint64) *Update {
+	return &Update{
+		Addr:        proto.String(addr),
+		State:       proto.Uint32(uint32(state)),
+		Incarnation: proto.Uint64(incarnation),
+	}
+}
+
+func (ml *Membership) peers() []string {
+	var peers []string
+	for addr, mb := range ml.members {
+		if mb.State == Alive || mb.State == Suspect {
+			peers = append(peers, addr)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (ml *Membership) fullState() []*Update {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	updates := []*Update{newUpdate(ml.self, Alive, ml.incarnation)}
+	for _, mb := range ml.members {
+		updates = append(updates, newUpdate(mb.Addr, mb.State, mb.Incarnation))
+	}
+	return updates
+}
+
+func (ml *Membership) probeLoop(stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(ml.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ml.checkSuspects()
+			ml.probe(stop)
+		}
+	}
+}
+
+// checkSuspects declares the suspects that time out dead.
+func (ml *Membership) checkSuspects() {
+	var events []Event
+	ml.mu.Lock()
+	now := time.Now()
+	for _, mb := range ml.members {
+		if mb.State == Suspect && now.Sub(mb.suspectTime) >= ml.config.SuspicionTimeout {
+			if e := ml.apply(newUpdate(mb.Addr, Dead, mb.Incarnation)); e != nil {
+				events = append(events, *e)
+			}
+		}
+	}
+	for seq, r := range ml.relays {
+		if now.Sub(r.start) >= ml.config.ProbeInterval*2 {
+			delete(ml.relays, seq)
+		}
+	}
+	ml.mu.Unlock()
+	ml.emit(events)
+}
+
+// probe the next member, directly and then indirectly.
+func (ml *Membership) probe(stop chan struct{}) {
+	ml.mu.Lock()
+	target, ok := ml.nextTarget()
+	if !ok {
+		ml.mu.Unlock()
+		return
+	}
+	seq, ack := ml.expectAck()
+	ping := &Ping{
+		Seq:     proto.Uint64(seq),
+		From:    proto.String(ml.self),
+		Updates: ml.piggyback(),
+	}
+	ml.mu.Unlock()
+	defer ml.forgetAck(seq)
+
+	ml.send(target, ping)
+	select {
+	case <-ack:
+		return
+	case <-stop:
+		return
+	case <-time.After(ml.config.ProbeTimeout):
+	}
+
+	// Ask some other members to probe the target.
+	ml.mu.Lock()
+	var helpers []string
+	for _, addr := range ml.peers() {
+		if addr != target {
+			helpers = append(helpers, addr)
+		}
+	}
+	for i := range helpers {
+		j := ml.rand.Intn(i + 1)
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	}
+	if len(helpers) > ml.config.IndirectProbes {
+		helpers = helpers[:ml.config.IndirectProbes]
+	}
+	req := &PingReq{
+		Seq:     proto.Uint64(seq),
+		From:    proto.String(ml.self),
+		Target:  proto.String(target),
+		Updates: ml.piggyback(),
+	}
+	ml.mu.Unlock()
+	for _, helper := range helpers {
+		ml.send(helper, req)
+	}
+
+	wait := ml.config.ProbeInterval - ml.config.ProbeTimeout
+	if wait <= 0 {
+		wait = ml.config.ProbeTimeout
+	}
+	select {
+	case <-ack:
+		return
+	case <-stop:
+		return
+	case <-time.After(wait):
+	}
+
+	// No ack at all, suspect the target.
+	var events []Event
+	ml.mu.Lock()
+	if mb, ok := ml.members[target]; ok && mb.State == Alive {
+		if e := ml.apply(newUpdate(target, Suspect, mb.Incarnation)); e != nil {
+			events = append(events, *e)
+		}
+	}
+	ml.mu.Unlock()
+	ml.emit(events)
+}
+
+// nextTarget picks the next member to probe in a round-robin
+// fashion, the order is shuffled on every round.
+func (ml *Membership) nextTarget() (string, bool) {
+	for i := 0; i < 2; i++ {
+		for ml.probeIndex < len(ml.probeOrder) {
+			addr := ml.probeOrder[ml.probeIndex]
+			ml.probeIndex++
+			if mb, ok := ml.members[addr]; ok && (mb.State == Alive || mb.State == Suspect) {
+				return addr, true
+			}
+		}
+		ml.probeOrder = ml.peers()
+		ml.probeIndex = 0
+		for i := range ml.probeOrder {
+			j := ml.rand.Intn(i + 1)
+			ml.probeOrder[i], ml.probeOrder[j] = ml.probeOrder[j], ml.probeOrder[i]
+		}
+	}
+	return "", false
+}
+
+func (ml *Membership) expectAck() (uint64, chan struct{}) {
+	ml.seq++
+	ack := make(chan struct{})
+	ml.acks[ml.seq] = ack
+	return ml.seq, ack
+}
+
+func (ml *Membership) forgetAck(seq uint64) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	delete(ml.acks, seq)
+}
+
+// piggyback picks the updates to gossip, the least transmitted first.
+func (ml *Membership) piggyback() []*Update {
+	limit := ml.config.RetransmitMult *
+		int(math.Ceil(math.Log10(float64(len(ml.members)+2))))
+	var pending []*update
+	for addr, u := range ml.updates {
+		if u.transmits >= limit {
+			delete(ml.updates, addr)
+			continue
+		}
+		pending = append(pending, u)
+	}
+	sort.Sort(byTransmits(pending))
+	if len(pending) > ml.config.MaxPiggyback {
+		pending = pending[:ml.config.MaxPiggyback]
+	}
+
+	updates := make([]*Update, len(pending))
+	for i, u := range pending {
+		u.transmits++
+		updates[i] = u.u
+	}
+	return updates
+}
+
+type byTransmits []*update
+
+func (p byTransmits) Len() int           { return len(p) }
+func (p byTransmits) Less(i, j int) bool { return p[i].transmits < p[j].transmits }
+func (p byTransmits) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// gossip queues an update to be piggybacked, it replaces
+// the pending update of the same member.
+func (ml *Membership) gossip(u *Update) {
+	ml.updates[u.GetAddr()] = &update{u: u}
+}
+
+// apply an update to the member list, following the SWIM rules
+// on the incarnation numbers. It returns the event if the update
+// changes the member list.
+func (ml *Membership) apply(u *Update) *Event {
+	addr, state, inc := u.GetAddr(), State(u.GetState()), u.GetIncarnation()
+	if addr == ml.self {
+		// Refute the suspicion by increasing the incarnation.
+		if (state == Suspect || state == Dead) && inc >= ml.incarnation {
+			ml.incarnation = inc + 1
+			ml.gossip(newUpdate(ml.self, Alive, ml.incarnation))
+		}
+		return nil
+	}
+
+	mb, ok := ml.members[addr]
+	if !ok {
+		mb = &member{Member: Member{addr, state, inc}}
+		if state == Suspect {
+			mb.suspectTime = time.Now()
+		}
+		ml.members[addr] = mb
+		ml.gossip(u)
+		if state == Alive || state == Suspect {
+			return &Event{MemberJoined, mb.Member}
+		}
+		return nil
+	}
+
+	var override bool
+	switch state {
+	case Alive:
+		override = inc > mb.Incarnation
+	case Suspect:
+		override = (mb.State == Alive && inc >= mb.Incarnation) ||
+			(mb.State == Suspect && inc > mb.Incarnation) ||
+			((mb.State == Dead || mb.State == Left) && inc > mb.Incarnation)
+	case Dead, Left:
+		override = (mb.State != Dead && mb.State != Left && inc >= mb.Incarnation) ||
+			inc > mb.Incarnation
+	}
+	if !override {
+		return nil
+	}
+
+	prev := mb.State
+	mb.State, mb.Incarnation = state, inc
+	if state == Suspect {
+		mb.suspectTime = time.Now()
+	}
+	ml.gossip(u)
+
+	switch {
+	case state == Alive && prev == Suspect:
+		return &Event{MemberRecovered, mb.Member}
+	case (state == Alive || state == Suspect) && (prev == Dead || prev == Left):
+		return &Event{MemberJoined, mb.Member}
+	case state == Suspect && prev == Alive:
+		return &Event{MemberSuspected, mb.Member}
+	case state == Dead && prev != Dead:
+		return &Event{MemberDied, mb.Member}
+	case state == Left && prev != Left:
+		return &Event{MemberLeft, mb.Member}
+	}
+	return nil
+}
+
+// applyAll applies the updates and emits the events.
+func (ml *Membership) applyAll(updates []*Update) {
+	var events []Event
+	ml.mu.Lock()
+	for _, u := range updates {
+		if e := ml.apply(u); e != nil {
+			events = append(events, *e)
+		}
+	}
+	ml.mu.Unlock()
+	ml.emit(events)
+}
+
+func (ml *Membership) emit(events []Event) {
+	ml.mu.Lock()
+	h := ml.eventHandler
+	ml.mu.Unlock()
+
+	for _, e := range events {
+		log.V(1).Infof("Membership: %v %v\n", e.Member.Addr, e.Type)
+		if h != nil {
+			h(e)
+		}
+	}
+}
+
+func (ml *Membership) send(hostport string, msg interface{}) {
+	if err := ml.m.Send(hostport, msg); err != nil {
+		log.Warningf("Membership: Failed to send to %v: %v\n", hostport, err)
+	}
+}
+
+func (ml *Membership) handlePing(msg interface{}) {
+	ping := msg.(*Ping)
+	ml.applyAll(ping.GetUpdates())
+
+	ml.mu.Lock()
+	ack := &Ack{
+		Seq:     ping.Seq,
+		From:    proto.String(ml.self),
+		Updates: ml.piggyback(),
+	}
+	ml.mu.Unlock()
+	ml.send(ping.GetFrom(), ack)
+}
+
+func (ml *Membership) handleAck(msg interface{}) {
+	ack := msg.(*Ack)
+	ml.applyAll(ack.GetUpdates())
+
+	ml.mu.Lock()
+	if ch, ok := ml.acks[ack.GetSeq()]; ok {
+		delete(ml.acks, ack.GetSeq())
+		close(ch)
+	}
+	r, ok := ml.relays[ack.GetSeq()]
+	delete(ml.relays, ack.GetSeq())
+	ml.mu.Unlock()
+
+	// Relay the ack of an indirect probe.
+	if ok {
+		ml.send(r.addr, &Ack{Seq: proto.Uint64(r.seq), From: ack.From})
+	}
+}
+
+func (ml *Membership) handlePingReq(msg interface{}) {
+	req := msg.(*PingReq)
+	ml.applyAll(req.GetUpdates())
+
+	ml.mu.Lock()
+	ml.seq++
+	seq := ml.seq
+	ml.relays[seq] = &relay{req.GetFrom(), req.GetSeq(), time.Now()}
+	ping := &Ping{
+		Seq:     proto.Uint64(seq),
+		From:    proto.String(ml.self),
+		Updates: ml.piggyback(),
+	}
+	ml.mu.Unlock()
+	ml.send(req.GetTarget(), ping)
+}
+
+func (ml *Membership) handleSync(msg interface{}) {
+	st := msg.(*Sync)
+	ml.applyAll(st.GetUpdates())
+
+	if st.GetReply() {
+		ml.send(st.GetFrom(), &Sync{
+			From:    proto.String(ml.self),
+			Updates: ml.fullState(),
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// Code generated by protoc-gen-gogo.
+// source: membership.proto
+// DO NOT EDIT!
+
+package membership
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+// Update carries the state of a member, it's gossiped
+// by piggybacking on the other messages.
+type Update struct {
+	Addr             *string `protobuf:"bytes,1,req" json:"Addr,omitempty"`
+	State            *uint32 `protobuf:"varint,2,req" json:"State,omitempty"`
+	Incarnation      *uint64 `protobuf:"varint,3,req" json:"Incarnation,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Update) Reset()         { *m = Update{} }
+func (m *Update) String() string { return proto.CompactTextString(m) }
+func (*Update) ProtoMessage()    {}
+
+func (m *Update) GetAddr() string {
+	if m != nil && m.Addr != nil {
+		return *m.Addr
+	}
+	return ""
+}
+
+func (m *Update) GetState() uint32 {
+	if m != nil && m.State != nil {
+		return *m.State
+	}
+	return 0
+}
+
+func (m *Update) GetIncarnation() uint64 {
+	if m != nil && m.Incarnation != nil {
+		return *m.Incarnation
+	}
+	return 0
+}
+
+// Ping probes a member, which answers with an Ack.
+type Ping struct {
+	Seq              *uint64   `protobuf:"varint,1,req" json:"Seq,omitempty"`
+	From             *string   `protobuf:"bytes,2,req" json:"From,omitempty"`
+	Updates          []*Update `protobuf:"bytes,3,rep" json:"Updates,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Ping) Reset()         { *m = Ping{} }
+func (m *Ping) String() string { return proto.CompactTextString(m) }
+func (*Ping) ProtoMessage()    {}
+
+func (m *Ping) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *Ping) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Ping) GetUpdates() []*Update {
+	if m != nil {
+		return m.Updates
+	}
+	return nil
+}
+
+// Ack answers a Ping. When relayed for a PingReq,
+// From is the member that is probed.
+type Ack struct {
+	Seq              *uint64   `protobuf:"varint,1,req" json:"Seq,omitempty"`
+	From             *string   `protobuf:"bytes,2,req" json:"From,omitempty"`
+	Updates          []*Update `protobuf:"bytes,3,rep" json:"Updates,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Ack) Reset()         { *m = Ack{} }
+func (m *Ack) String() string { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()    {}
+
+func (m *Ack) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *Ack) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Ack) GetUpdates() []*Update {
+	if m != nil {
+		return m.Updates
+	}
+	return nil
+}
+
+// PingReq asks a member to probe the target indirectly.
+type PingReq struct {
+	Seq              *uint64   `protobuf:"varint,1,req" json:"Seq,omitempty"`
+	From             *string   `protobuf:"bytes,2,req" json:"From,omitempty"`
+	Target           *string   `protobuf:"bytes,3,req" json:"Target,omitempty"`
+	Updates          []*Update `protobuf:"bytes,4,rep" json:"Updates,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *PingReq) Reset()         { *m = PingReq{} }
+func (m *PingReq) String() string { return proto.CompactTextString(m) }
+func (*PingReq) ProtoMessage()    {}
+
+func (m *PingReq) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *PingReq) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *PingReq) GetTarget() string {
+	if m != nil && m.Target != nil {
+		return *m.Target
+	}
+	return ""
+}
+
+func (m *PingReq) GetUpdates() []*Update {
+	if m != nil {
+		return m.Updates
+	}
+	return nil
+}
+
+// Sync carries the full member list, it's used to join and leave.
+// If Reply is set, the receiver answers with its own member list.
+type Sync struct {
+	From             *string   `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Updates          []*Update `protobuf:"bytes,2,rep" json:"Updates,omitempty"`
+	Reply            *bool     `protobuf:"varint,3,opt" json:"Reply,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *Sync) Reset()         { *m = Sync{} }
+func (m *Sync) String() string { return proto.CompactTextString(m) }
+func (*Sync) ProtoMessage()    {}
+
+func (m *Sync) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Sync) GetUpdates() []*Update {
+	if m != nil {
+		return m.Updates
+	}
+	return nil
+}
+
+func (m *Sync) GetReply() bool {
+	if m != nil && m.Reply != nil {
+		return *m.Reply
+	}
+	return false
+}
+
+func init() {
+}
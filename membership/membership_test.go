@@ -0,0 +1,146 @@
+package membership
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+type node struct {
+	m  *messenger.Messenger
+	ml *Membership
+
+	mu     sync.Mutex
+	events []Event
+}
+
+func newNode(t *testing.T, network *transporter.LocalNetwork, addr string) *node {
+	m := messenger.New(codec.NewGoGoProtobufCodec(),
+		transporter.NewLocalTransporter(network, addr), false, true)
+	assert.NotNil(t, m)
+	ml, err := New(m, addr, &Config{
+		ProbeInterval:    time.Millisecond * 50,
+		ProbeTimeout:     time.Millisecond * 20,
+		IndirectProbes:   2,
+		SuspicionTimeout: time.Millisecond * 200,
+		RetransmitMult:   4,
+		MaxPiggyback:     8,
+	})
+	assert.NoError(t, err)
+
+	n := &node{m: m, ml: ml}
+	ml.SetEventHandler(func(e Event) {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.events = append(n.events, e)
+	})
+	return n
+}
+
+func (n *node) state(addr string) (State, bool) {
+	for _, mb := range n.ml.Members() {
+		if mb.Addr == addr {
+			return mb.State, true
+		}
+	}
+	return Dead, false
+}
+
+func (n *node) hasEvent(typ EventType, addr string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range n.events {
+		if e.Type == typ && e.Member.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait until the condition becomes true, or fail after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met after %v", timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Test join, failure detection and leave.
+func TestMembership(t *testing.T) {
+	network := transporter.NewLocalNetwork()
+	var nodes []*node
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		n := newNode(t, network, fmt.Sprintf("node%d:8000", i))
+		nodes = append(nodes, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, n.m.Start())
+		}()
+	}
+	wg.Wait()
+
+	// Everyone joins through node0.
+	for _, n := range nodes {
+		assert.NoError(t, n.ml.Start())
+		assert.NoError(t, n.ml.Join("node0:8000"))
+	}
+	waitFor(t, time.Second*5, func() bool {
+		for _, n := range nodes {
+			if len(n.ml.Peers()) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	assert.Equal(t, 4, len(nodes[0].ml.Members()))
+	assert.True(t, nodes[1].hasEvent(MemberJoined, "node3:8000"))
+	assert.Equal(t, 3, len(nodes[2].ml.Group().Members()))
+
+	// node3 crashes, the others should find it dead.
+	assert.NoError(t, nodes[3].ml.Stop())
+	assert.NoError(t, nodes[3].m.Stop())
+	waitFor(t, time.Second*5, func() bool {
+		for _, n := range nodes[:3] {
+			if s, _ := n.state("node3:8000"); s != Dead {
+				return false
+			}
+		}
+		return true
+	})
+	assert.True(t, nodes[0].hasEvent(MemberDied, "node3:8000"))
+
+	// node2 leaves.
+	assert.NoError(t, nodes[2].ml.Leave())
+	waitFor(t, time.Second*5, func() bool {
+		for _, n := range nodes[:2] {
+			if s, _ := n.state("node2:8000"); s != Left {
+				return false
+			}
+		}
+		return true
+	})
+	assert.True(t, nodes[1].hasEvent(MemberLeft, "node2:8000"))
+	assert.Equal(t, []string{"node1:8000"}, nodes[0].ml.Peers())
+
+	// The survivors are still alive.
+	time.Sleep(time.Millisecond * 500)
+	s, _ := nodes[0].state("node1:8000")
+	assert.Equal(t, Alive, s)
+
+	assert.NoError(t, nodes[0].ml.Stop())
+	assert.NoError(t, nodes[1].ml.Stop())
+	for _, n := range nodes {
+		assert.NoError(t, n.m.Destroy())
+	}
+}
@@ -1,42 +1,120 @@
 package messenger
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/go-distributed/messenger/codec"
+	"github.com/go-distributed/messenger/metrics"
+	"github.com/go-distributed/messenger/tracing"
 	"github.com/go-distributed/messenger/transporter"
 	log "github.com/golang/glog"
 )
 
-const defaultQueueSize = 1024
-const preparePeriod = time.Second * 1
+var (
+	// ErrStopped is returned when the messenger is stopped.
+	ErrStopped = errors.New("Messenger is stopped")
+	// ErrNoMessage is returned by TryRecv if there is no message.
+	ErrNoMessage = errors.New("No message available")
+	// ErrTimeout is returned by RecvTimeout if no message arrives in time.
+	ErrTimeout = errors.New("Timed out waiting for message")
+)
 
 // MessageHandler is a callback that handles the messages.
 // One can register the message with the callback by
 // calling RegisterHandler.
 type MessageHandler func(interface{})
 
+// ContextHandler is a callback that handles the messages, it also
+// receives the address of the sender, which is empty if the transporter
+// doesn't know it, and a context that is cancelled when the messenger
+// is stopped. The address is claimed by the sender and not verified,
+// so it should not be used to authorize the message.
+type ContextHandler func(ctx context.Context, from string, msg interface{})
+
 type messageToSend struct {
+	ctx      context.Context // Has the sender's values, but is never cancelled.
+	deadline time.Time       // The deadline of the sender's ctx, if any.
 	hostport string
 	msg      interface{}
+	data     []byte     // Set if the message is already encoded.
+	result   chan error // Set if the sender waits for the result.
+	sess     *session   // The session of the sender that sends it.
+	span     *tracing.Span
+	queued   time.Time
+}
+
+type messageReceived struct {
+	from   string
+	data   []byte
+	msg    interface{}
+	span   *tracing.Span
+	queued time.Time
 }
 
 // Messenger is an abstraction that can send and receive
 // messages.
 type Messenger struct {
-	codec     codec.Codec
-	tr        transporter.Transporter
-	inQueue   chan interface{}    // For incomming messages.
-	outQueue  chan *messageToSend // For outgoing messages.
-	recvQueue chan interface{}    // Buffer for recv messages.
+	// Number of the discarded messages, accessed atomically.
+	// Keep them at the top, so they are 64-bit aligned.
+	inDropped   uint64
+	recvDropped uint64
+
+	codec   codec.Codec
+	tr      transporter.Transporter
+	inQueue chan *messageReceived // For incomming messages.
+
+	// Protects the lifecycle state and the current session.
+	stateMu       sync.Mutex
+	state         State
+	sess          *session
+	recvQueueSize int
+
+	deadLetters *deadLetterQueue // For undeliverable messages.
+	breakers    *breakers        // For unreachable peers.
+	debug       *debugState      // For the introspection.
+
+	// Protects the per-peer outgoing queues.
+	outMu          sync.Mutex
+	outQueues      map[string]*peerQueue
+	outQueueSize   int
+	overflowPolicy OverflowPolicy
+	outIdleTimeout time.Duration
+	sending        *session // The session of the started senders.
 
-	handlers           map[reflect.Type]MessageHandler
+	// Protects the registered messages, handlers, interceptors,
+	// callbacks and policies, so they can be changed at any time.
+	mu                 sync.RWMutex
+	handlers           map[reflect.Type][]*handler // Sorted by priority.
+	interfaceHandlers  []*handler
+	defaultHandler     *handler
 	registeredMessages map[reflect.Type]bool
-	stop               chan struct{}
-	enableRecv         bool
-	enableHandler      bool
+	groups             map[string]MembershipSource
+
+	inboundInterceptors  []InboundInterceptor
+	outboundInterceptors []OutboundInterceptor
+	inboundChain         InboundFunc
+	outboundChain        OutboundFunc
+
+	errorHandler    func(error)
+	panicQuarantine int
+	inPolicy        OverflowPolicy
+	recvPolicy      OverflowPolicy
+
+	preparePeriod time.Duration
+	workers       int // Number of the reading loops.
+	logger        Logger
+	metrics       metrics.Metrics
+	peerLabels    *peerLabels
+	tracer        *tracing.Tracer // Nil if the tracing is disabled.
+	wireTap       WireTap
+
+	enableRecv    bool
+	enableHandler bool
 }
 
 // New create a new messenger.
@@ -45,29 +123,91 @@ type Messenger struct {
 // the the underlying reading will stop if the queue is full.
 // At least one of the enableRecv and enableHandler should be
 // set to true.
+// It returns nil if the configuration is invalid, use
+// NewWithConfig or NewWithOptions to get the error.
 func New(codec codec.Codec, tr transporter.Transporter,
 	enableRecv, enableHandler bool) *Messenger {
-	if !enableRecv && !enableHandler {
-		log.Warningf("Neither recv or handler is enabled\n")
+	m, err := NewWithOptions(codec, tr, WithRecv(enableRecv), WithHandler(enableHandler))
+	if err != nil {
+		log.Warningf("%v\n", err)
 		return nil
 	}
-	return &Messenger{
-		codec:              codec,
-		tr:                 tr,
-		inQueue:            make(chan interface{}, defaultQueueSize),
-		outQueue:           make(chan *messageToSend, defaultQueueSize),
-		recvQueue:          make(chan interface{}, defaultQueueSize),
-		handlers:           make(map[reflect.Type]MessageHandler),
+	return m
+}
+
+// NewWithConfig creates a new messenger with the configuration.
+func NewWithConfig(config *Config) (*Messenger, error) {
+	if config == nil {
+		return nil, fmt.Errorf("Invalid config: Config is nil")
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = glogLogger{}
+	}
+	mt := config.Metrics
+	if mt == nil {
+		mt = metrics.NewRegistry()
+	}
+	var tracer *tracing.Tracer
+	if config.SpanExporter != nil {
+		tracer = tracing.NewTracer(config.SpanExporter)
+	}
+	workers := 1
+	if config.DispatchMode == DispatchConcurrent {
+		workers = config.DispatchWorkers
+	}
+	m := &Messenger{
+		codec:              config.Codec,
+		tr:                 config.Transporter,
+		inQueue:            make(chan *messageReceived, config.InboundQueueSize),
+		sess:               newSession(config.RecvQueueSize),
+		recvQueueSize:      config.RecvQueueSize,
+		deadLetters:        newDeadLetterQueue(config.DeadLetterSize),
+		breakers:           newBreakers(logger),
+		debug:              newDebugState(defaultRecentErrors, defaultDebugPeers),
+		outQueues:          make(map[string]*peerQueue),
+		outQueueSize:       config.OutboundQueueSize,
+		overflowPolicy:     config.OutboundPolicy,
+		outIdleTimeout:     defaultQueueIdleTimeout,
+		handlers:           make(map[reflect.Type][]*handler),
 		registeredMessages: make(map[reflect.Type]bool),
-		stop:               make(chan struct{}),
-		enableRecv:         enableRecv,
-		enableHandler:      enableHandler,
+		groups:             make(map[string]MembershipSource),
+		errorHandler:       config.ErrorHandler,
+		panicQuarantine:    config.PanicQuarantine,
+		inPolicy:           config.InboundPolicy,
+		recvPolicy:         config.RecvPolicy,
+		preparePeriod:      config.PreparePeriod,
+		workers:            workers,
+		logger:             logger,
+		metrics:            mt,
+		peerLabels:         newPeerLabels(maxPeerLabels),
+		tracer:             tracer,
+		wireTap:            config.WireTap,
+		enableRecv:         config.EnableRecv,
+		enableHandler:      config.EnableHandler,
 	}
+	m.SetInboundPolicy(config.InboundPolicy)
+	m.breakers.config = config.Breaker
+	m.breakers.onChange = config.BreakerHandler
+	m.UseInbound(config.InboundInterceptors...)
+	m.UseOutbound(config.OutboundInterceptors...)
+	return m, nil
+}
+
+// Codec returns the codec used by the messenger.
+func (m *Messenger) Codec() codec.Codec {
+	return m.codec
 }
 
 // RegisterMessage Regists a message in the messenger.
 // It will call the undelying codec to register the message as well.
 func (m *Messenger) RegisterMessage(msg interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	msgType := reflect.TypeOf(msg)
 	if _, ok := m.registeredMessages[msgType]; ok {
 		return fmt.Errorf("Message type %v already registered", msgType)
@@ -79,152 +219,364 @@ func (m *Messenger) RegisterMessage(msg interface{}) error {
 	return nil
 }
 
+// isRegistered tells whether the message type is registered.
+func (m *Messenger) isRegistered(msgType reflect.Type) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.registeredMessages[msgType]
+}
+
 // RegisterHandler regists a message with a handler.
 // When such a message comes in, it will be passed to
 // the handler.
+// To register a handler for an interface type, pass a nil pointer
+// to the interface, e.g. (*proto.Message)(nil). Such a handler
+// receives all the messages that implement the interface, in
+// addition to the handler registered for the message type.
+// Only one handler can be registered this way for a message type,
+// use Subscribe to add more.
 func (m *Messenger) RegisterHandler(msg interface{}, msgHandler MessageHandler) error {
-	if !m.enableHandler {
-		return fmt.Errorf("Cannot register handler since it's disabled")
-	}
+	return m.registerHandler(reflect.TypeOf(msg), wrapHandler(msgHandler), false)
+}
+
+// ReplaceHandler replaces the handler of a message, or registers
+// it if there is no handler for the message yet.
+func (m *Messenger) ReplaceHandler(msg interface{}, msgHandler MessageHandler) error {
+	return m.registerHandler(reflect.TypeOf(msg), wrapHandler(msgHandler), true)
+}
 
+// UnregisterHandler removes the handler of a message, which is
+// registered by RegisterHandler or ReplaceHandler.
+func (m *Messenger) UnregisterHandler(msg interface{}) error {
 	msgType := reflect.TypeOf(msg)
-	if _, ok := m.handlers[msgType]; ok {
-		return fmt.Errorf("Message type: %v is already registered", msgType)
-	}
-	m.handlers[msgType] = msgHandler
-	return nil
+	return m.removeHandler(msgType, func(h *handler) bool {
+		return h.name == handlerName(msgType)
+	})
 }
 
-// Start the messenger.
-func (m *Messenger) Start() error {
-	if err := m.codec.Initial(); err != nil {
-		return err
+// RegisterContextHandler is like RegisterHandler, but the handler
+// also receives the context and the address of the sender.
+func (m *Messenger) RegisterContextHandler(msg interface{}, h ContextHandler) error {
+	if h == nil {
+		return fmt.Errorf("Cannot register nil handler")
 	}
+	return m.registerHandler(reflect.TypeOf(msg), handlerFunc(h), false)
+}
 
-	errChan := make(chan error)
-	go func() {
-		if err := m.tr.Start(); err != nil {
-			errChan <- err
-		}
-	}()
+func (m *Messenger) registerHandler(msgType reflect.Type, fn handlerFunc, replace bool) error {
+	if msgType == nil {
+		return fmt.Errorf("Cannot register handler for nil")
+	}
+	return m.addHandler(msgType, newHandler(handlerName(msgType), fn), replace)
+}
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-time.After(preparePeriod):
+// SetDefaultHandler sets the handler for the registered messages
+// that have no other handler. Passing nil removes the default handler.
+func (m *Messenger) SetDefaultHandler(msgHandler MessageHandler) error {
+	if !m.enableHandler {
+		return fmt.Errorf("Cannot register handler since it's disabled")
 	}
 
-	go m.incomingLoop()
-	go m.outgoingLoop()
-	go m.readingLoop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msgHandler == nil {
+		m.defaultHandler = nil
+		return nil
+	}
+	m.defaultHandler = newHandler(defaultHandlerName, wrapHandler(msgHandler))
 	return nil
 }
 
 // From the wire to the queue.
-func (m *Messenger) incomingLoop() {
+func (m *Messenger) incomingLoop(sess *session) {
 	for {
 		select {
-		case <-m.stop:
+		case <-sess.stop:
 			return
 		default:
 		}
 
-		b, err := m.tr.Recv()
+		from, b, md, err := m.recvFrom(sess.ctx)
 		if err != nil {
-			log.Warningf("Transporter Recv() error: %v\n", err)
+			select {
+			case <-sess.stop:
+				// Interrupted by Stop().
+				return
+			default:
+			}
+			if err == transporter.ErrStopped {
+				m.logger.Warningf("Transporter is stopped, no longer receiving\n")
+				return
+			}
+			m.logger.Warningf("Transporter Recv() error: %v\n", err)
+			m.deadLetter(Inbound, from, b, nil, err)
 			continue
 		}
-		msg, err := m.codec.Unmarshal(b)
-		if err != nil {
-			log.Warningf("Codec Unmarshal() error: %v\n", err)
-			continue
+		m.tap(Inbound, from, b)
+		if err := m.receive(from, b, md); err == ErrStopped {
+			return
 		}
-		m.inQueue <- msg
 	}
 }
 
+// receive decodes a message from the wire, and puts it in the
+// inbound queue. It returns ErrStopped if the messenger is stopped.
+func (m *Messenger) receive(from string, b []byte, md transporter.Metadata) error {
+	span := m.startReceive(from, md)
+	codecSpan := m.child(span, spanUnmarshal)
+	msg, err := m.unmarshal(b)
+	codecSpan.End(err)
+	if err != nil {
+		m.logger.Warningf("Codec Unmarshal() error: %v\n", err)
+		m.deadLetter(Inbound, from, b, nil, err)
+		span.End(err)
+		return err
+	}
+	span.SetAttribute("type", typeName(msg))
+	m.countReceived(from, msg, len(b))
+	m.debug.record(Inbound, from, msg, len(b))
+	mr := &messageReceived{from: from, data: b, msg: msg, span: span, queued: time.Now()}
+	if !m.pushInbound(mr) {
+		span.End(ErrStopped)
+		return ErrStopped
+	}
+	return nil
+}
+
+// recvFrom receives from the transporter, the sender is
+// left empty if the transporter doesn't know it, and the
+// metadata is nil if the transporter doesn't carry it.
+// It's interrupted by the ctx only if the transporter is a
+// ContextTransporter, otherwise it returns after the next message.
+func (m *Messenger) recvFrom(ctx context.Context) (string, []byte, transporter.Metadata, error) {
+	if mr, ok := m.tr.(transporter.MetadataRecver); ok {
+		return mr.RecvMetadata(ctx)
+	}
+	if ct, ok := m.tr.(transporter.ContextTransporter); ok {
+		from, b, err := ct.RecvFromContext(ctx)
+		return from, b, nil, err
+	}
+	if fr, ok := m.tr.(transporter.FromRecver); ok {
+		from, b, err := fr.RecvFrom()
+		return from, b, nil, err
+	}
+	b, err := m.tr.Recv()
+	return "", b, nil, err
+}
+
 // From the queue to callbacks / recvQueue.
-func (m *Messenger) readingLoop() {
+func (m *Messenger) readingLoop(sess *session) {
 	for {
 		select {
-		case <-m.stop:
+		case <-sess.stop:
 			return
-		case msg := <-m.inQueue:
-			msgType := reflect.TypeOf(msg)
-			// Verify message type.
-			if _, ok := m.registeredMessages[msgType]; !ok {
-				log.Warningf("Unregistered message type: %v\n", msgType)
-				continue
-			}
-			// Pass the message to the handler.
-			if m.enableHandler {
-				if h, ok := m.handlers[msgType]; ok {
-					h(msg)
-				}
-			}
-			// Pass the message to the receive queue.
-			if m.enableRecv {
-				m.recvQueue <- msg
-			}
+		case mr := <-m.inQueue:
+			m.queued(mr.span, mr.queued)
+			mr.span.End(m.handle(sess.ctx, mr))
 		}
 	}
 }
 
-// From the queue to the wire.
-func (m *Messenger) outgoingLoop() {
-	for {
-		select {
-		case <-m.stop:
-			return
-		case mts := <-m.outQueue:
-			// TODO: Verify message type.
-			b, err := m.codec.Marshal(mts.msg)
-			if err != nil {
-				log.Warningf("Codec Marshal() error: %v\n", err)
-				continue
-			}
+// handle passes the message through the inbound chain, the handlers
+// see the message's span in the ctx.
+func (m *Messenger) handle(ctx context.Context, mr *messageReceived) error {
+	msg := mr.msg
+	msgType := reflect.TypeOf(msg)
+	// Verify message type.
+	if !m.isRegistered(msgType) {
+		m.logger.Warningf("Unregistered message type: %v\n", msgType)
+		err := fmt.Errorf("Unregistered message type: %v", msgType)
+		m.deadLetter(Inbound, mr.from, mr.data, msg, err)
+		return err
+	}
+	if mr.span != nil {
+		ctx = tracing.NewContext(ctx, mr.span.Context())
+	}
+	// Pass the message through the inbound chain.
+	m.mu.RLock()
+	chain := m.inboundChain
+	m.mu.RUnlock()
+	if err := chain(ctx, mr.from, msg); err != nil {
+		m.logger.Warningf("Failed to deliver message: %v\n", err)
+		m.deadLetter(Inbound, mr.from, mr.data, msg, err)
+		return err
+	}
+	return nil
+}
 
-			if err = m.tr.Send(mts.hostport, b); err != nil {
-				log.Warningf("Transporter Send() error: %v\n", err)
-				continue
-			}
-		}
+// deliver passes the message to the handlers and the receive queue,
+// it's the end of the inbound chain.
+func (m *Messenger) deliver(ctx context.Context, from string, msg interface{}) error {
+	msgType := reflect.TypeOf(msg)
+	handled := m.enableHandler && m.dispatch(ctx, msgType, from, msg)
+	if !handled && !m.enableRecv {
+		return fmt.Errorf("No handler for message type: %v", msgType)
+	}
+	// Pass the message to the receive queue.
+	if m.enableRecv {
+		return m.pushRecv(from, msg)
 	}
+	return nil
 }
 
-// Stop the messenger.
-func (m *Messenger) Stop() error {
-	close(m.stop)
-	return m.tr.Stop()
+// send encodes the message if needed, and sends it to the wire.
+func (m *Messenger) send(mts *messageToSend) error {
+	// Don't send it if the sender's deadline has passed.
+	if !mts.deadline.IsZero() && !time.Now().Before(mts.deadline) {
+		m.deadLetter(Outbound, mts.hostport, mts.data, mts.msg, context.DeadlineExceeded)
+		return context.DeadlineExceeded
+	}
+
+	m.queued(mts.span, mts.queued)
+	b := mts.data
+	if b == nil {
+		// TODO: Verify message type.
+		var err error
+		codecSpan := m.child(mts.span, spanMarshal)
+		b, err = m.marshal(mts.msg)
+		codecSpan.End(err)
+		if err != nil {
+			m.logger.Warningf("Codec Marshal() error: %v\n", err)
+			m.deadLetter(Outbound, mts.hostport, nil, mts.msg, err)
+			return err
+		}
+	}
+
+	// Fail fast if the peer is unreachable.
+	if !m.breakers.allow(mts.hostport) {
+		m.deadLetter(Outbound, mts.hostport, b, mts.msg, ErrBreakerOpen)
+		return ErrBreakerOpen
+	}
+	start := time.Now()
+	transportSpan := m.child(mts.span, spanTransport)
+	var err error
+	if ct, ok := m.tr.(transporter.ContextTransporter); ok {
+		ctx, cancel := bound(mts.ctx, mts.deadline, mts.sess)
+		err = ct.SendContext(withTraceMetadata(ctx, mts.span), mts.hostport, b)
+		cancel()
+	} else {
+		err = m.tr.Send(mts.hostport, b)
+	}
+	transportSpan.End(err)
+	m.since(metricTransport, metrics.Labels{"op": "send"}, start)
+	m.breakers.record(mts.hostport, err)
+	if err != nil {
+		m.logger.Warningf("Transporter Send() error: %v\n", err)
+		m.deadLetter(Outbound, mts.hostport, b, mts.msg, err)
+		return err
+	}
+	m.tap(Outbound, mts.hostport, b)
+	m.countSent(mts.hostport, mts.msg, len(b))
+	m.debug.record(Outbound, mts.hostport, mts.msg, len(b))
+	return nil
 }
 
 // Send a message.
 func (m *Messenger) Send(hostport string, msg interface{}) error {
+	return m.SendContext(context.Background(), hostport, msg)
+}
+
+// SendContext sends a message. The ctx bounds how long it blocks
+// on a full queue. Once the message is queued, cancelling the ctx
+// has no effect, but its deadline still applies: the message is
+// dropped if it's still in the queue at the deadline, and the
+// deadline and the values of the ctx are passed to the transporter
+// if it supports that.
+func (m *Messenger) SendContext(ctx context.Context, hostport string, msg interface{}) error {
+	m.mu.RLock()
+	chain := m.outboundChain
+	m.mu.RUnlock()
+	return chain(ctx, hostport, msg)
+}
+
+// enqueue puts the message in the outgoing queue of the peer,
+// it's the end of the outbound chain.
+func (m *Messenger) enqueue(ctx context.Context, hostport string, msg interface{}) error {
 	// Verify the message.
 	msgType := reflect.TypeOf(msg)
-	if _, ok := m.registeredMessages[msgType]; !ok {
+	if !m.isRegistered(msgType) {
 		return fmt.Errorf("Unregistered message type: %v\n", msgType)
 	}
 
-	m.outQueue <- &messageToSend{hostport, msg}
-	return nil
+	span := m.startSend(ctx, hostport, msg)
+	deadline, _ := ctx.Deadline()
+	mts := &messageToSend{ctx: detach(ctx), deadline: deadline, hostport: hostport, msg: msg, span: span, queued: time.Now()}
+	if c := collectorFrom(ctx); c != nil {
+		// Multicast, it's queued once all the messages are encoded.
+		c.messages = append(c.messages, mts)
+		return nil
+	}
+	err := m.push(ctx, mts)
+	if err != nil {
+		span.End(err)
+	}
+	return err
 }
 
 // Recv a message.
 func (m *Messenger) Recv() (interface{}, error) {
-	msg, ok := <-m.recvQueue
-	if !ok {
-		return nil, fmt.Errorf("Failed to receive, channel closed\n")
+	return m.RecvContext(context.Background())
+}
+
+// RecvContext receives a message, or returns the ctx's error
+// if it's done before a message arrives.
+// After the messenger is stopped, the queued messages can still
+// be received, then ErrStopped is returned.
+func (m *Messenger) RecvContext(ctx context.Context) (interface{}, error) {
+	select {
+	case msg, ok := <-m.current().recvQueue:
+		if !ok {
+			return nil, ErrStopped
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return msg, nil
 }
 
-// Destroy the messenger.
-func (m *Messenger) Destroy() error {
+// RecvTimeout receives a message, or returns ErrTimeout if
+// no message arrives in time.
+func (m *Messenger) RecvTimeout(timeout time.Duration) (interface{}, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg, ok := <-m.current().recvQueue:
+		if !ok {
+			return nil, ErrStopped
+		}
+		return msg, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// TryRecv receives a message without blocking, it returns
+// ErrNoMessage if there is no message.
+func (m *Messenger) TryRecv() (interface{}, error) {
 	select {
-	case <-m.stop:
+	case msg, ok := <-m.current().recvQueue:
+		if !ok {
+			return nil, ErrStopped
+		}
+		return msg, nil
 	default:
-		// Stop the messenger if not already.
+		return nil, ErrNoMessage
+	}
+}
+
+// RecvChan returns the channel of the received messages, so they can
+// be received in a select. The channel is closed when the messenger
+// is stopped, a new channel is used if it's started again.
+func (m *Messenger) RecvChan() <-chan interface{} {
+	return m.current().recvQueue
+}
+
+// Destroy the messenger.
+func (m *Messenger) Destroy() error {
+	// Stop the messenger if not already.
+	if m.State() != StateStopped {
 		if err := m.Stop(); err != nil {
 			return err
 		}
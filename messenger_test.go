@@ -1,8 +1,11 @@
 package messenger
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,6 +48,101 @@ func (e *echoServer) msgHandler(msg interface{}) {
 	e.m.Send(e.peerAddr, msg)
 }
 
+// A transporter that passes the bytes through channels, used for
+// testing the messenger without touching the network.
+type fakeTransporter struct {
+	sync.Mutex
+	in      chan []byte
+	out     chan []byte
+	sendErr error
+	down    map[string]bool
+	stop    chan struct{}
+}
+
+func newFakeTransporter() *fakeTransporter {
+	return &fakeTransporter{
+		in:   make(chan []byte, 1024),
+		out:  make(chan []byte, 1024),
+		down: make(map[string]bool),
+		stop: make(chan struct{}),
+	}
+}
+
+func (f *fakeTransporter) setSendError(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.sendErr = err
+}
+
+func (f *fakeTransporter) setDown(hostport string, down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down[hostport] = down
+}
+
+func (f *fakeTransporter) Send(hostport string, b []byte) error {
+	f.Lock()
+	err := f.sendErr
+	if f.down[hostport] {
+		err = fmt.Errorf("%v is down", hostport)
+	}
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	f.out <- b
+	return nil
+}
+
+func (f *fakeTransporter) Recv() ([]byte, error) {
+	return <-f.in, nil
+}
+
+func (f *fakeTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	return f.Send(hostport, b)
+}
+
+func (f *fakeTransporter) RecvFromContext(ctx context.Context) (string, []byte, error) {
+	select {
+	case b := <-f.in:
+		return "", b, nil
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+func (f *fakeTransporter) Start() error {
+	f.Lock()
+	stop := f.stop
+	f.Unlock()
+	<-stop
+	return nil
+}
+
+// Stop the transporter, it can be started again.
+func (f *fakeTransporter) Stop() error {
+	f.Lock()
+	defer f.Unlock()
+	close(f.stop)
+	f.stop = make(chan struct{})
+	return nil
+}
+
+func (f *fakeTransporter) Destroy() error {
+	return nil
+}
+
+// Wait until the condition becomes true, or fail after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met after %v", timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func generateMessages(n int) []proto.Message {
 	var m []proto.Message
 
@@ -143,28 +241,19 @@ func TestSendRecv(t *testing.T) {
 	}()
 
 	var recvMessages []interface{}
-
-	wait := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-wait:
-				return
-			default:
-			}
-			msg, err := m.Recv()
-			assert.NoError(t, err)
-
-			recvMessages = append(recvMessages, msg)
-		}
-	}()
-	<-time.After(time.Second * 5)
-
+	for range messages {
+		msg, err := m.RecvTimeout(time.Second * 5)
+		assert.NoError(t, err)
+		recvMessages = append(recvMessages, msg)
+	}
 	for i := range messages {
 		assert.Equal(t, messages[i], recvMessages[i])
-
 	}
 
+	// There should be no more messages.
+	_, err := m.TryRecv()
+	assert.Equal(t, ErrNoMessage, err)
+
 	// Verify that the handlers are called.
 	assert.Equal(t, cnt, count1)
 	assert.Equal(t, cnt, count2)
@@ -177,3 +266,80 @@ func TestSendRecv(t *testing.T) {
 	assert.NoError(t, m.Destroy())
 	assert.NoError(t, n.Destroy())
 }
+
+// Test the interface handlers and the default handler.
+func TestFallbackHandler(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+
+	var exact, all, fallback int
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, func(msg interface{}) {
+		exact++
+	}))
+	assert.NoError(t, m.RegisterHandler((*proto.Message)(nil), func(msg interface{}) {
+		all++
+	}))
+	// Should fail because we have already registered the interface once.
+	assert.Error(t, m.RegisterHandler((*proto.Message)(nil), handler1))
+
+	msg1 := &example.GoGoProtobufTestMessage1{}
+	msg2 := &example.GoGoProtobufTestMessage2{}
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg1), "", msg1))
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg2), "", msg2))
+	assert.Equal(t, 1, exact)
+	assert.Equal(t, 2, all)
+
+	// Without the interface handler, msg2 goes to the default handler.
+	assert.NoError(t, m.UnregisterHandler((*proto.Message)(nil)))
+	assert.Error(t, m.UnregisterHandler((*proto.Message)(nil)))
+	assert.False(t, m.dispatch(context.Background(), reflect.TypeOf(msg2), "", msg2))
+	assert.NoError(t, m.SetDefaultHandler(func(msg interface{}) {
+		fallback++
+	}))
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg1), "", msg1))
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg2), "", msg2))
+	assert.Equal(t, 2, exact)
+	assert.Equal(t, 1, fallback)
+}
+
+// Test TryRecv(), RecvTimeout(), RecvChan(), and that the
+// blocked receivers are woken up by Stop().
+func TestRecvVariants(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	_, err := m.TryRecv()
+	assert.Equal(t, ErrNoMessage, err)
+	_, err = m.RecvTimeout(time.Millisecond * 10)
+	assert.Equal(t, ErrTimeout, err)
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.NoError(t, m.deliver(context.Background(), "", msg))
+	recvMsg, err := m.TryRecv()
+	assert.NoError(t, err)
+	assert.Equal(t, msg, recvMsg)
+
+	assert.NoError(t, m.deliver(context.Background(), "", msg))
+	select {
+	case recvMsg = <-m.RecvChan():
+		assert.Equal(t, msg, recvMsg)
+	case <-time.After(time.Second):
+		t.Fatal("Nothing received from RecvChan()")
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := m.Recv()
+			errs <- err
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	assert.NoError(t, m.Stop())
+	assert.Equal(t, ErrStopped, <-errs)
+	assert.Equal(t, ErrStopped, <-errs)
+	_, err = m.TryRecv()
+	assert.Equal(t, ErrStopped, err)
+	assert.Equal(t, ErrStopped, m.deliver(context.Background(), "", msg))
+}
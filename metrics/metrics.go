@@ -0,0 +1,261 @@
+// Package metrics defines the interface the messenger records its
+// metrics with, and an in-process implementation of it, whose
+// snapshot can be inspected or exported.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels are the dimensions of a metric, e.g. the message type.
+type Labels map[string]string
+
+// String returns the labels in the form of {k1="v1",k2="v2"},
+// sorted by the keys.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + quote(l[k])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// Metrics records the metrics.
+type Metrics interface {
+	// Add adds delta to a counter.
+	Add(name string, labels Labels, delta float64)
+	// Set sets the value of a gauge.
+	Set(name string, labels Labels, value float64)
+	// Observe records a value in a histogram.
+	Observe(name string, labels Labels, value float64)
+}
+
+// Snapshotter is implemented by the metrics that can be inspected.
+type Snapshotter interface {
+	Snapshot() *Snapshot
+}
+
+// Discard is the metrics that records nothing.
+var Discard Metrics = discard{}
+
+type discard struct{}
+
+func (discard) Add(name string, labels Labels, delta float64)     {}
+func (discard) Set(name string, labels Labels, value float64)     {}
+func (discard) Observe(name string, labels Labels, value float64) {}
+
+// DefaultBuckets are the upper bounds of the histogram buckets,
+// in seconds, suitable for the latencies.
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// Sample is the value of a counter or a gauge.
+type Sample struct {
+	Name   string
+	Labels Labels
+	Value  float64
+}
+
+// Bucket is a histogram bucket, the count is cumulative, i.e. the
+// number of the values that are less than or equal to the bound.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// HistogramSample is the state of a histogram.
+type HistogramSample struct {
+	Name    string
+	Labels  Labels
+	Count   uint64
+	Sum     float64
+	Buckets []Bucket
+}
+
+// Snapshot is the state of all the metrics at some point,
+// each kind is sorted by the names and the labels.
+// The labels are shared with the registry, and must not be modified.
+type Snapshot struct {
+	Counters   []Sample
+	Gauges     []Sample
+	Histograms []HistogramSample
+}
+
+// Counter returns the value of a counter, or 0 if it doesn't exist.
+func (s *Snapshot) Counter(name string, labels Labels) float64 {
+	return find(s.Counters, name, labels)
+}
+
+// Gauge returns the value of a gauge, or 0 if it doesn't exist.
+func (s *Snapshot) Gauge(name string, labels Labels) float64 {
+	return find(s.Gauges, name, labels)
+}
+
+// Histogram returns a histogram, or nil if it doesn't exist.
+func (s *Snapshot) Histogram(name string, labels Labels) *HistogramSample {
+	key := labels.String()
+	for i := range s.Histograms {
+		if s.Histograms[i].Name == name && s.Histograms[i].Labels.String() == key {
+			return &s.Histograms[i]
+		}
+	}
+	return nil
+}
+
+func find(samples []Sample, name string, labels Labels) float64 {
+	key := labels.String()
+	for _, sample := range samples {
+		if sample.Name == name && sample.Labels.String() == key {
+			return sample.Value
+		}
+	}
+	return 0
+}
+
+type histogram struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 // Not cumulative.
+}
+
+type series struct {
+	name   string
+	labels Labels
+}
+
+// Registry is the in-process implementation of the Metrics.
+type Registry struct {
+	mu         sync.Mutex
+	buckets    []float64
+	series     map[string]series // Key -> series.
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+// NewRegistry creates a registry, the histograms use DefaultBuckets.
+func NewRegistry() *Registry {
+	return NewRegistryWithBuckets(DefaultBuckets)
+}
+
+// NewRegistryWithBuckets creates a registry, the histograms use
+// the given upper bounds, which must be sorted.
+func NewRegistryWithBuckets(buckets []float64) *Registry {
+	return &Registry{
+		buckets:    append([]float64(nil), buckets...),
+		series:     make(map[string]series),
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// key identifies a series, the labels are copied the first time
+// the series is seen, so the caller can reuse them.
+func (r *Registry) key(name string, labels Labels) string {
+	key := name + labels.String()
+	if _, ok := r.series[key]; !ok {
+		copied := make(Labels, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		r.series[key] = series{name, copied}
+	}
+	return key
+}
+
+// Add adds delta to a counter.
+func (r *Registry) Add(name string, labels Labels, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[r.key(name, labels)] += delta
+}
+
+// Set sets the value of a gauge.
+func (r *Registry) Set(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[r.key(name, labels)] = value
+}
+
+// Observe records a value in a histogram.
+func (r *Registry) Observe(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := r.key(name, labels)
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(r.buckets))}
+		r.histograms[key] = h
+	}
+	h.count++
+	h.sum += value
+	if i := sort.SearchFloat64s(r.buckets, value); i < len(r.buckets) {
+		h.buckets[i]++
+	}
+}
+
+// Snapshot returns the state of all the metrics.
+func (r *Registry) Snapshot() *Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &Snapshot{}
+	for key, value := range r.counters {
+		s.Counters = append(s.Counters, r.sample(key, value))
+	}
+	for key, value := range r.gauges {
+		s.Gauges = append(s.Gauges, r.sample(key, value))
+	}
+	for key, h := range r.histograms {
+		hs := HistogramSample{
+			Name:    r.series[key].name,
+			Labels:  r.series[key].labels,
+			Count:   h.count,
+			Sum:     h.sum,
+			Buckets: make([]Bucket, len(r.buckets)),
+		}
+		var cumulative uint64
+		for i, bound := range r.buckets {
+			cumulative += h.buckets[i]
+			hs.Buckets[i] = Bucket{bound, cumulative}
+		}
+		s.Histograms = append(s.Histograms, hs)
+	}
+	sortSamples(s.Counters)
+	sortSamples(s.Gauges)
+	sort.Slice(s.Histograms, func(i, j int) bool {
+		return less(s.Histograms[i].Name, s.Histograms[i].Labels, s.Histograms[j].Name, s.Histograms[j].Labels)
+	})
+	return s
+}
+
+func (r *Registry) sample(key string, value float64) Sample {
+	return Sample{r.series[key].name, r.series[key].labels, value}
+}
+
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return less(samples[i].Name, samples[i].Labels, samples[j].Name, samples[j].Labels)
+	})
+}
+
+func less(name1 string, labels1 Labels, name2 string, labels2 Labels) bool {
+	if name1 != name2 {
+		return name1 < name2
+	}
+	return labels1.String() < labels2.String()
+}
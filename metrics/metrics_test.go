@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the counters, gauges and histograms of the registry.
+func TestRegistry(t *testing.T) {
+	r := NewRegistryWithBuckets([]float64{1, 2, 5})
+	labels := Labels{"peer": "a:8000"}
+	r.Add("sent_total", labels, 1)
+	r.Add("sent_total", labels, 2)
+	r.Add("sent_total", Labels{"peer": "b:8000"}, 1)
+	// The labels are copied.
+	labels["peer"] = "c:8000"
+	r.Set("queue_depth", nil, 3)
+	r.Set("queue_depth", nil, 1)
+	for _, v := range []float64{0.5, 1, 1.5, 10} {
+		r.Observe("latency_seconds", Labels{"op": "send"}, v)
+	}
+
+	s := r.Snapshot()
+	assert.Equal(t, []Sample{
+		{"sent_total", Labels{"peer": "a:8000"}, 3},
+		{"sent_total", Labels{"peer": "b:8000"}, 1},
+	}, s.Counters)
+	assert.Equal(t, float64(3), s.Counter("sent_total", Labels{"peer": "a:8000"}))
+	assert.Equal(t, float64(0), s.Counter("sent_total", Labels{"peer": "c:8000"}))
+	assert.Equal(t, float64(1), s.Gauge("queue_depth", nil))
+
+	h := s.Histogram("latency_seconds", Labels{"op": "send"})
+	assert.NotNil(t, h)
+	assert.Equal(t, uint64(4), h.Count)
+	assert.Equal(t, 13.0, h.Sum)
+	assert.Equal(t, []Bucket{{1, 2}, {2, 3}, {5, 3}}, h.Buckets)
+	assert.Nil(t, s.Histogram("latency_seconds", nil))
+}
+
+// Test the labels are rendered in order and escaped.
+func TestLabelsString(t *testing.T) {
+	assert.Equal(t, "{}", Labels{}.String())
+	assert.Equal(t, `{a="1",b="x\"y\\z\n"}`, Labels{"b": "x\"y\\z\n", "a": "1"}.String())
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// PrometheusContentType is the content type of the Prometheus
+// text exposition format.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus renders the snapshot in the Prometheus text
+// exposition format.
+func WritePrometheus(w io.Writer, s *Snapshot) error {
+	bw := bufio.NewWriter(w)
+	writeSamples(bw, "counter", s.Counters)
+	writeSamples(bw, "gauge", s.Gauges)
+
+	last := ""
+	for _, h := range s.Histograms {
+		if h.Name != last {
+			writeType(bw, h.Name, "histogram")
+			last = h.Name
+		}
+		for _, b := range h.Buckets {
+			writeLine(bw, h.Name+"_bucket", withLabel(h.Labels, "le", formatFloat(b.UpperBound)), float64(b.Count))
+		}
+		writeLine(bw, h.Name+"_bucket", withLabel(h.Labels, "le", "+Inf"), float64(h.Count))
+		writeLine(bw, h.Name+"_sum", h.Labels, h.Sum)
+		writeLine(bw, h.Name+"_count", h.Labels, float64(h.Count))
+	}
+	return bw.Flush()
+}
+
+// PrometheusHandler returns an http.Handler that serves the
+// snapshots in the Prometheus text exposition format.
+func PrometheusHandler(snapshot func() *Snapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := snapshot()
+		if s == nil {
+			http.Error(w, "Metrics are not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", PrometheusContentType)
+		WritePrometheus(w, s)
+	})
+}
+
+func writeSamples(w *bufio.Writer, kind string, samples []Sample) {
+	last := ""
+	for _, sample := range samples {
+		if sample.Name != last {
+			writeType(w, sample.Name, kind)
+			last = sample.Name
+		}
+		writeLine(w, sample.Name, sample.Labels, sample.Value)
+	}
+}
+
+func writeType(w *bufio.Writer, name, kind string) {
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeLine(w *bufio.Writer, name string, labels Labels, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteString(labels.String())
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func withLabel(labels Labels, key, value string) Labels {
+	l := make(Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[key] = value
+	return l
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
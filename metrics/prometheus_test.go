@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the snapshot is rendered in the Prometheus text format.
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistryWithBuckets([]float64{0.5, 1})
+	r.Add("sent_total", Labels{"peer": "a:8000", "type": `*x."M"`}, 2)
+	r.Add("sent_total", Labels{"peer": "b:8000", "type": "*x.M"}, 1)
+	r.Set("queue_depth", nil, 3)
+	r.Observe("latency_seconds", Labels{"op": "send"}, 0.25)
+	r.Observe("latency_seconds", Labels{"op": "send"}, 2)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WritePrometheus(&buf, r.Snapshot()))
+	assert.Equal(t, `# TYPE sent_total counter
+sent_total{peer="a:8000",type="*x.\"M\""} 2
+sent_total{peer="b:8000",type="*x.M"} 1
+# TYPE queue_depth gauge
+queue_depth 3
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5",op="send"} 1
+latency_seconds_bucket{le="1",op="send"} 1
+latency_seconds_bucket{le="+Inf",op="send"} 2
+latency_seconds_sum{op="send"} 2.25
+latency_seconds_count{op="send"} 2
+`, buf.String())
+}
+
+// Test the Prometheus handler.
+func TestPrometheusHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Add("sent_total", nil, 1)
+
+	w := httptest.NewRecorder()
+	PrometheusHandler(r.Snapshot).ServeHTTP(w, &http.Request{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, PrometheusContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE sent_total counter\nsent_total 1\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	PrometheusHandler(func() *Snapshot { return nil }).ServeHTTP(w, &http.Request{})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,236 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// MembershipSource provides the members of a group.
+type MembershipSource interface {
+	// Members returns the addresses of the members.
+	Members() []string
+}
+
+// StaticGroup is a group with a fixed list of members.
+type StaticGroup []string
+
+// Members returns the members of the group.
+func (g StaticGroup) Members() []string {
+	return g
+}
+
+// MembershipFunc adapts a function to a MembershipSource.
+type MembershipFunc func() []string
+
+// Members returns the members of the group.
+func (f MembershipFunc) Members() []string {
+	return f()
+}
+
+// DefineGroup defines a named group of peers, the members are
+// looked up from the source every time a message is multicast.
+func (m *Messenger) DefineGroup(name string, src MembershipSource) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[name]; ok {
+		return fmt.Errorf("Group %v is already defined", name)
+	}
+	m.groups[name] = src
+	return nil
+}
+
+// RemoveGroup removes a group.
+func (m *Messenger) RemoveGroup(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.groups[name]; !ok {
+		return fmt.Errorf("Unknown group: %v", name)
+	}
+	delete(m.groups, name)
+	return nil
+}
+
+// Groups returns the names of the groups.
+func (m *Messenger) Groups() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names []string
+	for name := range m.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Multicast sends a message to all the members of the group.
+// It blocks until the message is sent to every member, and
+// returns the result for each of them. See MulticastContext.
+func (m *Messenger) Multicast(group string, msg interface{}) (map[string]error, error) {
+	return m.MulticastContext(context.Background(), group, msg)
+}
+
+// MulticastContext sends a message to all the members of the group.
+// Like Send, the message goes through the outbound interceptors for
+// each member. Without interceptors, the message is encoded only once.
+// It blocks until the message is sent to every member, or until
+// the ctx is done, and returns the result for each of them.
+// The messenger must be running.
+func (m *Messenger) MulticastContext(ctx context.Context, group string, msg interface{}) (map[string]error, error) {
+	m.mu.RLock()
+	src, ok := m.groups[group]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown group: %v", group)
+	}
+	return m.sendMany(ctx, src.Members(), msg)
+}
+
+// Broadcast sends a message to the members of all the groups,
+// a peer in several groups only receives it once. See Multicast.
+func (m *Messenger) Broadcast(msg interface{}) (map[string]error, error) {
+	return m.BroadcastContext(context.Background(), msg)
+}
+
+// BroadcastContext is like Broadcast, see MulticastContext.
+func (m *Messenger) BroadcastContext(ctx context.Context, msg interface{}) (map[string]error, error) {
+	m.mu.RLock()
+	var srcs []MembershipSource
+	for _, src := range m.groups {
+		srcs = append(srcs, src)
+	}
+	m.mu.RUnlock()
+
+	var peers []string
+	for _, src := range srcs {
+		peers = append(peers, src.Members()...)
+	}
+	return m.sendMany(ctx, peers, msg)
+}
+
+// collector collects the messages that reach the end of the outbound
+// chain, instead of queueing them, so they are encoded together.
+type collector struct {
+	messages []*messageToSend
+}
+
+type collectorKey struct{}
+
+// collectorFrom returns the collector carried by the ctx, if any.
+func collectorFrom(ctx context.Context) *collector {
+	c, _ := ctx.Value(collectorKey{}).(*collector)
+	return c
+}
+
+// encoder encodes the messages, the same message is encoded only
+// once if cache is set. It must not be set if there is any outbound
+// interceptor, which may change the message for each peer.
+type encoder struct {
+	m     *Messenger
+	cache bool
+	msgs  []interface{}
+	data  [][]byte
+	errs  []error
+}
+
+func (e *encoder) encode(msg interface{}) ([]byte, error) {
+	if !e.cache {
+		return e.m.marshal(msg)
+	}
+	comparable := reflect.TypeOf(msg).Comparable()
+	for i := range e.msgs {
+		if comparable && e.msgs[i] == msg {
+			return e.data[i], e.errs[i]
+		}
+	}
+	b, err := e.m.marshal(msg)
+	e.msgs = append(e.msgs, msg)
+	e.data = append(e.data, b)
+	e.errs = append(e.errs, err)
+	return b, err
+}
+
+// sendMany passes the message to the peers through the outbound
+// chain, encodes the resulting messages once, and sends them.
+func (m *Messenger) sendMany(ctx context.Context, peers []string, msg interface{}) (map[string]error, error) {
+	msgType := reflect.TypeOf(msg)
+	if !m.isRegistered(msgType) {
+		return nil, fmt.Errorf("Unregistered message type: %v", msgType)
+	}
+	if m.State() != StateRunning {
+		return nil, ErrStopped
+	}
+	sess := m.current()
+
+	m.mu.RLock()
+	chain := m.outboundChain
+	intercepted := len(m.outboundInterceptors) > 0
+	m.mu.RUnlock()
+
+	enc := &encoder{m: m, cache: !intercepted}
+	results := make(map[string]error)
+	pending := make(map[string][]chan error)
+	for _, peer := range peers {
+		if _, ok := results[peer]; ok {
+			continue
+		}
+		results[peer] = nil
+		c := new(collector)
+		if err := chain(context.WithValue(ctx, collectorKey{}, c), peer, msg); err != nil {
+			results[peer] = err
+			continue
+		}
+		// The interceptors may have dropped, redirected or
+		// replaced the message.
+		for _, mts := range c.messages {
+			b, err := enc.encode(mts.msg)
+			if err != nil {
+				m.logger.Warningf("Codec Marshal() error: %v\n", err)
+				m.deadLetter(Outbound, mts.hostport, nil, mts.msg, err)
+				m.finish(mts, err)
+				results[peer] = err
+				continue
+			}
+			mts.data = b
+			mts.result = make(chan error, 1)
+			if err := m.push(ctx, mts); err != nil {
+				mts.span.End(err)
+				mts.result <- err
+			}
+			pending[peer] = append(pending[peer], mts.result)
+		}
+	}
+
+	for peer, chans := range pending {
+		for _, result := range chans {
+			if err := m.wait(ctx, sess, result); err != nil && results[peer] == nil {
+				results[peer] = err
+			}
+		}
+	}
+	return results, nil
+}
+
+// wait waits for the result of a message, until the ctx is done
+// or the messenger is stopped.
+func (m *Messenger) wait(ctx context.Context, sess *session, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sess.stop:
+		// The queues are drained by Stop(), the result
+		// might be there already.
+		select {
+		case err := <-result:
+			return err
+		default:
+			return ErrStopped
+		}
+	}
+}
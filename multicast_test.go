@@ -0,0 +1,165 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// A transporter whose sends hang until they are cancelled.
+type hangingTransporter struct {
+	*fakeTransporter
+}
+
+func (h *hangingTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Test Multicast() and Broadcast().
+func TestMulticast(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	members := []string{"localhost:8030", "localhost:8031"}
+	assert.NoError(t, m.DefineGroup("static", StaticGroup{"localhost:8030", "localhost:8032"}))
+	assert.NoError(t, m.DefineGroup("dynamic", MembershipFunc(func() []string {
+		return members
+	})))
+	assert.Error(t, m.DefineGroup("static", StaticGroup{}))
+	assert.Equal(t, []string{"dynamic", "static"}, m.Groups())
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	_, err = m.Multicast("static", msg)
+	assert.Equal(t, ErrStopped, err)
+
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	_, err = m.Multicast("unknown", msg)
+	assert.Error(t, err)
+	_, err = m.Multicast("static", &example.GoGoProtobufTestMessage2{})
+	assert.Error(t, err)
+
+	tr.setDown("localhost:8031", true)
+	results, err := m.Multicast("dynamic", msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.NoError(t, results["localhost:8030"])
+	assert.Error(t, results["localhost:8031"])
+	assert.Equal(t, 1, len(tr.out))
+
+	// Each peer receives the message only once.
+	results, err = m.Broadcast(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.Error(t, results["localhost:8031"])
+	assert.Equal(t, 3, len(tr.out))
+	b1, b2 := <-tr.out, <-tr.out
+	assert.Equal(t, b1, b2)
+	<-tr.out
+
+	assert.NoError(t, m.RemoveGroup("dynamic"))
+	assert.Error(t, m.RemoveGroup("dynamic"))
+}
+
+// Test the multicast messages go through the outbound interceptors.
+func TestMulticastInterceptors(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.DefineGroup("group", StaticGroup{"a:8000", "b:8000", "c:8000", "d:8000"}))
+	m.UseOutbound(func(next OutboundFunc) OutboundFunc {
+		return func(ctx context.Context, hostport string, msg interface{}) error {
+			switch hostport {
+			case "b:8000":
+				return fmt.Errorf("Not allowed to send to %v", hostport)
+			case "c:8000":
+				return next(ctx, hostport, &example.GoGoProtobufTestMessage1{F1: proto.String("signed")})
+			case "d:8000":
+				// Change the shared message, it's encoded again.
+				msg.(*example.GoGoProtobufTestMessage1).F1 = proto.String("changed")
+			}
+			return next(ctx, hostport, msg)
+		}
+	})
+	assert.NoError(t, m.Start())
+	defer m.Stop()
+
+	msg := &example.GoGoProtobufTestMessage1{F1: proto.String("hello")}
+	results, err := m.Multicast("group", msg)
+	assert.NoError(t, err)
+	assert.NoError(t, results["a:8000"])
+	assert.Error(t, results["b:8000"])
+	assert.NoError(t, results["c:8000"])
+	assert.NoError(t, results["d:8000"])
+
+	assert.Equal(t, 3, len(tr.out))
+	var got []string
+	for i := 0; i < 3; i++ {
+		recvMsg, err := m.Codec().Unmarshal(<-tr.out)
+		assert.NoError(t, err)
+		got = append(got, recvMsg.(*example.GoGoProtobufTestMessage1).GetF1())
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"changed", "hello", "signed"}, got)
+}
+
+// Test Multicast doesn't wait forever for the messages that are
+// not sent.
+func TestMulticastNotSent(t *testing.T) {
+	tr := &hangingTransporter{newFakeTransporter()}
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.NoError(t, m.DefineGroup("group", StaticGroup{"a:8000"}))
+	assert.NoError(t, m.Start())
+
+	// The sender of the peer hangs on the first message,
+	// the others wait in the queue.
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.NoError(t, m.Send("a:8000", msg))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	results, err := m.MulticastContext(ctx, "group", msg)
+	assert.NoError(t, err)
+	assert.Equal(t, context.DeadlineExceeded, results["a:8000"])
+
+	done := make(chan map[string]error)
+	go func() {
+		results, _ := m.Multicast("group", msg)
+		done <- results
+	}()
+	waitFor(t, time.Second, func() bool {
+		for _, q := range m.Queues() {
+			if q.Peer == "a:8000" {
+				return q.Len == 2
+			}
+		}
+		return false
+	})
+
+	// The queued messages are failed by Stop.
+	assert.NoError(t, m.Stop())
+	select {
+	case results := <-done:
+		assert.Equal(t, ErrStopped, results["a:8000"])
+	case <-time.After(time.Second):
+		t.Fatal("Multicast is blocked after Stop")
+	}
+	waitFor(t, time.Second, func() bool { return m.DeadLetters().Len() == 3 })
+}
@@ -0,0 +1,252 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// An idle outgoing queue is removed together with its sender after
+// defaultQueueIdleTimeout, so the peers that are gone don't leak.
+const defaultQueueIdleTimeout = time.Minute
+
+// peerQueue is the outgoing queue of a peer, which is drained
+// by its own sender, so a slow peer doesn't delay the others.
+type peerQueue struct {
+	dropped  uint64 // Accessed atomically, keep it 64-bit aligned.
+	hostport string
+	ch       chan *messageToSend
+	pushers  int // Number of the messages being pushed, protected by outMu.
+}
+
+// SetOutgoingQueue sets the size and the overflow policy of the
+// per-peer outgoing queues. The size only applies to the queues
+// created afterwards, the policy applies to all the queues.
+func (m *Messenger) SetOutgoingQueue(size int, policy OverflowPolicy) error {
+	if size <= 0 {
+		return fmt.Errorf("Invalid queue size: %d", size)
+	}
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	m.outQueueSize = size
+	m.overflowPolicy = policy
+	return nil
+}
+
+// peerQueue returns the outgoing queue of the peer, it's created
+// on demand, together with its sender if the messenger is started.
+func (m *Messenger) peerQueue(hostport string) (*peerQueue, OverflowPolicy) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	return m.queue(hostport), m.overflowPolicy
+}
+
+// acquire is like peerQueue, but the queue is not removed until
+// it's released, so a message is not pushed to a removed queue.
+func (m *Messenger) acquire(hostport string) (*peerQueue, OverflowPolicy) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	q := m.queue(hostport)
+	q.pushers++
+	return q, m.overflowPolicy
+}
+
+func (m *Messenger) release(q *peerQueue) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	q.pushers--
+}
+
+func (m *Messenger) queue(hostport string) *peerQueue {
+	q, ok := m.outQueues[hostport]
+	if !ok {
+		q = &peerQueue{hostport: hostport, ch: make(chan *messageToSend, m.outQueueSize)}
+		m.outQueues[hostport] = q
+		if m.sending != nil {
+			go m.senderLoop(q, m.sending)
+		}
+	}
+	return q
+}
+
+// reap removes the queue if it's empty and nothing is being pushed
+// to it, the next message to the peer creates a new queue.
+func (m *Messenger) reap(q *peerQueue) bool {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	if q.pushers > 0 || len(q.ch) > 0 {
+		return false
+	}
+	if m.outQueues[q.hostport] == q {
+		delete(m.outQueues, q.hostport)
+	}
+	return true
+}
+
+// startSenders starts the senders of all the peers, the ones
+// created afterwards are started immediately.
+func (m *Messenger) startSenders(sess *session) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+
+	m.sending = sess
+	for _, q := range m.outQueues {
+		go m.senderLoop(q, sess)
+	}
+}
+
+// stopSenders makes the queues created afterwards not started,
+// the running senders exit when their session is closed.
+func (m *Messenger) stopSenders() {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	m.sending = nil
+}
+
+// drainQueues fails the messages left in the outgoing queues with
+// ErrStopped, so the senders waiting for them are not blocked
+// forever. They are dead lettered, so they can be reinjected.
+func (m *Messenger) drainQueues() {
+	m.outMu.Lock()
+	queues := make([]*peerQueue, 0, len(m.outQueues))
+	for _, q := range m.outQueues {
+		queues = append(queues, q)
+	}
+	m.outMu.Unlock()
+
+	for _, q := range queues {
+		for drained := false; !drained; {
+			select {
+			case mts := <-q.ch:
+				m.deadLetter(Outbound, mts.hostport, mts.data, mts.msg, ErrStopped)
+				m.finish(mts, ErrStopped)
+			default:
+				drained = true
+			}
+		}
+	}
+}
+
+// From the peer's queue to the wire. It exits when the session
+// is closed, or when the queue is reaped after being idle.
+func (m *Messenger) senderLoop(q *peerQueue, sess *session) {
+	ticker := time.NewTicker(m.outIdleTimeout)
+	defer ticker.Stop()
+	lastActive := time.Now()
+	for {
+		select {
+		case <-sess.stop:
+			return
+		case mts := <-q.ch:
+			mts.sess = sess
+			m.finish(mts, m.send(mts))
+			lastActive = time.Now()
+		case <-ticker.C:
+			if time.Since(lastActive) >= m.outIdleTimeout && m.reap(q) {
+				return
+			}
+		}
+	}
+}
+
+// push puts the message in the outgoing queue of its destination,
+// the overflow policy is applied if the queue is full. The ctx bounds
+// how long it blocks on a full queue.
+func (m *Messenger) push(ctx context.Context, mts *messageToSend) error {
+	sess := m.current()
+	select {
+	case <-sess.stop:
+		return ErrStopped
+	default:
+	}
+
+	q, policy := m.acquire(mts.hostport)
+	defer m.release(q)
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.ch <- mts:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				m.overflow(q, old)
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		select {
+		case q.ch <- mts:
+		default:
+			m.overflow(q, mts)
+		}
+		return nil
+	case OverflowError:
+		select {
+		case q.ch <- mts:
+			return nil
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			m.countDropped(Outbound, mts.hostport, mts.msg)
+			return ErrQueueFull
+		}
+	}
+	select {
+	case q.ch <- mts:
+		return nil
+	case <-sess.stop:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// overflow discards a message that doesn't fit in the queue.
+func (m *Messenger) overflow(q *peerQueue, mts *messageToSend) {
+	atomic.AddUint64(&q.dropped, 1)
+	m.deadLetter(Outbound, mts.hostport, mts.data, mts.msg, ErrQueueFull)
+	m.finish(mts, ErrQueueFull)
+}
+
+// finish reports the result to the sender if it's waiting,
+// and ends the message's span.
+func (m *Messenger) finish(mts *messageToSend, err error) {
+	mts.span.End(err)
+	if mts.result != nil {
+		mts.result <- err
+	}
+}
+
+// valueContext has the values of one ctx, and the deadline and
+// the cancellation of another one.
+type valueContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valueContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+// detach returns a ctx that has the values of the ctx, but is
+// never cancelled, so the queued message outlives its sender.
+// The deadline of the ctx is kept in the message, see bound.
+func detach(ctx context.Context) context.Context {
+	return valueContext{context.Background(), ctx}
+}
+
+// bound returns a ctx that has the values of the ctx and the
+// deadline, if it's not zero, and is cancelled when the session
+// is closed, so Stop() doesn't wait for a hanging send.
+func bound(ctx context.Context, deadline time.Time, sess *session) (context.Context, context.CancelFunc) {
+	if sess != nil {
+		ctx = valueContext{sess.ctx, ctx}
+	}
+	if deadline.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
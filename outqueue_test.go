@@ -0,0 +1,142 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/leaktest"
+	"github.com/go-distributed/testify/assert"
+)
+
+// A transporter that blocks sending to a slow peer until it's released.
+type slowTransporter struct {
+	*fakeTransporter
+	slow    string
+	release chan struct{}
+}
+
+func (s *slowTransporter) Send(hostport string, b []byte) error {
+	if hostport == s.slow {
+		<-s.release
+	}
+	return s.fakeTransporter.Send(hostport, b)
+}
+
+func (s *slowTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	return s.Send(hostport, b)
+}
+
+// Test a slow peer doesn't delay the others.
+func TestOutgoingQueuePerPeer(t *testing.T) {
+	tr := &slowTransporter{newFakeTransporter(), "slow:8000", make(chan struct{})}
+	m := New(codec.NewGoGoProtobufCodec(), tr, true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	m.startSenders(m.sess)
+	defer m.Stop()
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.NoError(t, m.Send("slow:8000", msg))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.Send("fast:8000", msg))
+	}
+	waitFor(t, time.Second, func() bool { return len(tr.out) == 3 })
+
+	close(tr.release)
+	waitFor(t, time.Second, func() bool { return len(tr.out) == 4 })
+}
+
+// Test the overflow policies.
+func TestOutgoingQueueOverflow(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), true, false)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	assert.Error(t, m.SetOutgoingQueue(0, OverflowBlock))
+	assert.NoError(t, m.SetOutgoingQueue(2, OverflowError))
+
+	// The senders are not started, so the queues are not drained.
+	msgs := make([]*example.GoGoProtobufTestMessage1, 3)
+	for i := range msgs {
+		msgs[i] = &example.GoGoProtobufTestMessage1{}
+	}
+	assert.NoError(t, m.Send("a:8000", msgs[0]))
+	assert.NoError(t, m.Send("a:8000", msgs[1]))
+	assert.Equal(t, ErrQueueFull, m.Send("a:8000", msgs[2]))
+	assert.Equal(t, 0, m.DeadLetters().Len())
+
+	// Drop the newest.
+	assert.NoError(t, m.SetOutgoingQueue(2, OverflowDropNewest))
+	assert.NoError(t, m.Send("a:8000", msgs[2]))
+	it := m.DeadLetters()
+	assert.Equal(t, 1, it.Len())
+	it.Next()
+	assert.Equal(t, msgs[2], it.DeadLetter().Msg)
+	assert.Equal(t, ErrQueueFull, it.DeadLetter().Reason)
+	m.PurgeDeadLetters()
+
+	// Drop the oldest.
+	assert.NoError(t, m.SetOutgoingQueue(2, OverflowDropOldest))
+	assert.NoError(t, m.Send("a:8000", msgs[2]))
+	it = m.DeadLetters()
+	assert.Equal(t, 1, it.Len())
+	it.Next()
+	assert.Equal(t, msgs[0], it.DeadLetter().Msg)
+	q, _ := m.peerQueue("a:8000")
+	assert.Equal(t, msgs[1], (<-q.ch).msg)
+	assert.Equal(t, msgs[2], (<-q.ch).msg)
+
+	// Block until the messenger is stopped.
+	assert.NoError(t, m.SetOutgoingQueue(2, OverflowBlock))
+	assert.NoError(t, m.Send("a:8000", msgs[0]))
+	assert.NoError(t, m.Send("a:8000", msgs[1]))
+	done := make(chan error)
+	go func() {
+		done <- m.Send("a:8000", msgs[2])
+	}()
+	select {
+	case <-done:
+		t.Fatal("Send() should block")
+	case <-time.After(time.Millisecond * 50):
+	}
+	assert.NoError(t, m.Stop())
+	assert.Error(t, <-done)
+}
+
+// Test the idle queues are removed together with their senders.
+func TestOutgoingQueueReaped(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr,
+		WithRecv(true), WithHandler(false), WithPreparePeriod(time.Millisecond*10))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	m.outIdleTimeout = time.Millisecond * 50
+	assert.NoError(t, m.Start())
+
+	outbound := func() int {
+		n := 0
+		for _, q := range m.Queues() {
+			if q.Name == "outbound" {
+				n++
+			}
+		}
+		return n
+	}
+	msg := &example.GoGoProtobufTestMessage1{}
+	for _, peer := range []string{"a:8000", "b:8000", "c:8000"} {
+		assert.NoError(t, m.Send(peer, msg))
+		<-tr.out
+	}
+	assert.Equal(t, 3, outbound())
+	waitFor(t, time.Second, func() bool { return outbound() == 0 })
+
+	// A new queue is created for the next message.
+	assert.NoError(t, m.Send("a:8000", msg))
+	<-tr.out
+	assert.Equal(t, 1, outbound())
+	assert.NoError(t, m.Destroy())
+}
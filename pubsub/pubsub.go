@@ -0,0 +1,312 @@
+// Package pubsub implements topic based publish/subscribe atop
+// the messenger. Nodes subscribe to named topics, and the
+// subscriptions are propagated to the peers automatically, so
+// Publish() delivers a message to all the current subscribers.
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	log "github.com/golang/glog"
+)
+
+// Handler is a callback that handles the messages published
+// to a topic. The from is the address of the publisher.
+type Handler func(topic, from string, msg interface{})
+
+// Subscription is the handle of a local subscription.
+type Subscription struct {
+	ps    *PubSub
+	topic string
+	h     Handler
+}
+
+// Unsubscribe removes the subscription. The peers are told when
+// there is no more local subscription for the topic.
+func (s *Subscription) Unsubscribe() error {
+	return s.ps.unsubscribe(s)
+}
+
+// PubSub is a topic based publish/subscribe layer atop the messenger.
+type PubSub struct {
+	m    *messenger.Messenger
+	self string // The address the peers use to reach us.
+
+	mu     sync.RWMutex
+	peers  map[string]bool
+	local  map[string][]*Subscription // Topic -> local subscriptions.
+	remote map[string]map[string]bool // Topic -> remote subscribers.
+}
+
+// New creates a pub/sub layer atop the messenger, self is the
+// address of the messenger that the peers can send to.
+// It registers its own messages in the messenger, so the messenger
+// must have the handler enabled.
+func New(m *messenger.Messenger, self string) (*PubSub, error) {
+	ps := &PubSub{
+		m:      m,
+		self:   self,
+		peers:  make(map[string]bool),
+		local:  make(map[string][]*Subscription),
+		remote: make(map[string]map[string]bool),
+	}
+
+	msgs := []interface{}{&Subscribe{}, &Unsubscribe{}, &Sync{}, &Publication{}}
+	handlers := []messenger.MessageHandler{
+		ps.handleSubscribe, ps.handleUnsubscribe, ps.handleSync, ps.handlePublication,
+	}
+	for i := range msgs {
+		if err := m.RegisterMessage(msgs[i]); err != nil {
+			return nil, err
+		}
+		if err := m.RegisterHandler(msgs[i], handlers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// AddPeer adds a peer, the subscriptions are exchanged with it.
+func (ps *PubSub) AddPeer(hostport string) error {
+	if hostport == ps.self {
+		return fmt.Errorf("Cannot add self as a peer")
+	}
+	ps.mu.Lock()
+	ps.peers[hostport] = true
+	ps.mu.Unlock()
+
+	return ps.m.Send(hostport, &Sync{
+		From:   proto.String(ps.self),
+		Topics: ps.localTopics(),
+		Reply:  proto.Bool(true),
+	})
+}
+
+// RemovePeer removes a peer and its subscriptions.
+func (ps *PubSub) RemovePeer(hostport string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.peers, hostport)
+	for _, subscribers := range ps.remote {
+		delete(subscribers, hostport)
+	}
+}
+
+// Peers returns the known peers.
+func (ps *PubSub) Peers() []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var peers []string
+	for peer := range ps.peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Subscribe a handler to a topic.
+func (ps *PubSub) Subscribe(topic string, h Handler) (*Subscription, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("Topic cannot be empty")
+	}
+	s := &Subscription{ps, topic, h}
+
+	ps.mu.Lock()
+	first := len(ps.local[topic]) == 0
+	ps.local[topic] = append(ps.local[topic], s)
+	ps.mu.Unlock()
+
+	if first {
+		ps.announce(&Subscribe{From: proto.String(ps.self), Topics: []string{topic}})
+	}
+	return s, nil
+}
+
+func (ps *PubSub) unsubscribe(s *Subscription) error {
+	ps.mu.Lock()
+	subs := ps.local[s.topic]
+	found := false
+	for i := range subs {
+		if subs[i] == s {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(ps.local, s.topic)
+	} else {
+		ps.local[s.topic] = subs
+	}
+	ps.mu.Unlock()
+
+	if !found {
+		return fmt.Errorf("Not subscribed to topic %v", s.topic)
+	}
+	if len(subs) == 0 {
+		ps.announce(&Unsubscribe{From: proto.String(ps.self), Topics: []string{s.topic}})
+	}
+	return nil
+}
+
+// Subscribers returns the remote subscribers of the topic.
+func (ps *PubSub) Subscribers(topic string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var subscribers []string
+	for hostport := range ps.remote[topic] {
+		subscribers = append(subscribers, hostport)
+	}
+	sort.Strings(subscribers)
+	return subscribers
+}
+
+// Publish a message to the topic. The message is passed to the local
+// subscriptions, and sent to all the remote subscribers. The message
+// must be registered in the messenger.
+func (ps *PubSub) Publish(topic string, msg interface{}) error {
+	data, err := ps.m.Codec().Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ps.deliver(topic, ps.self, msg)
+
+	pub := &Publication{
+		From:  proto.String(ps.self),
+		Topic: proto.String(topic),
+		Data:  data,
+	}
+	var errs []error
+	for _, hostport := range ps.Subscribers(topic) {
+		if err := ps.m.Send(hostport, pub); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to publish to %d subscribers: %v", len(errs), errs[0])
+	}
+	return nil
+}
+
+// deliver passes the message to the local subscriptions.
+func (ps *PubSub) deliver(topic, from string, msg interface{}) {
+	ps.mu.RLock()
+	subs := ps.local[topic]
+	ps.mu.RUnlock()
+
+	for _, s := range subs {
+		s.h(topic, from, msg)
+	}
+}
+
+// announce sends the message to all the peers.
+func (ps *PubSub) announce(msg interface{}) {
+	for _, peer := range ps.Peers() {
+		if err := ps.m.Send(peer, msg); err != nil {
+			log.Warningf("PubSub: Failed to send to %v: %v\n", peer, err)
+		}
+	}
+}
+
+func (ps *PubSub) localTopics() []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var topics []string
+	for topic := range ps.local {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// addPeer adds the peer if it's unknown, so the subscriptions are
+// propagated to the nodes that contact us.
+func (ps *PubSub) addPeer(hostport string) {
+	if hostport == "" || hostport == ps.self {
+		return
+	}
+	ps.mu.Lock()
+	ps.peers[hostport] = true
+	ps.mu.Unlock()
+}
+
+func (ps *PubSub) addRemote(hostport string, topics []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, topic := range topics {
+		if ps.remote[topic] == nil {
+			ps.remote[topic] = make(map[string]bool)
+		}
+		ps.remote[topic][hostport] = true
+	}
+}
+
+func (ps *PubSub) removeRemote(hostport string, topics []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, topic := range topics {
+		delete(ps.remote[topic], hostport)
+		if len(ps.remote[topic]) == 0 {
+			delete(ps.remote, topic)
+		}
+	}
+}
+
+func (ps *PubSub) handleSubscribe(msg interface{}) {
+	sub := msg.(*Subscribe)
+	ps.addPeer(sub.GetFrom())
+	ps.addRemote(sub.GetFrom(), sub.GetTopics())
+}
+
+func (ps *PubSub) handleUnsubscribe(msg interface{}) {
+	unsub := msg.(*Unsubscribe)
+	ps.addPeer(unsub.GetFrom())
+	ps.removeRemote(unsub.GetFrom(), unsub.GetTopics())
+}
+
+func (ps *PubSub) handleSync(msg interface{}) {
+	st := msg.(*Sync)
+	from := st.GetFrom()
+	ps.addPeer(from)
+
+	// Replace all the topics of the peer.
+	ps.mu.Lock()
+	for topic, subscribers := range ps.remote {
+		delete(subscribers, from)
+		if len(subscribers) == 0 {
+			delete(ps.remote, topic)
+		}
+	}
+	ps.mu.Unlock()
+	ps.addRemote(from, st.GetTopics())
+
+	if st.GetReply() {
+		err := ps.m.Send(from, &Sync{
+			From:   proto.String(ps.self),
+			Topics: ps.localTopics(),
+		})
+		if err != nil {
+			log.Warningf("PubSub: Failed to reply sync to %v: %v\n", from, err)
+		}
+	}
+}
+
+func (ps *PubSub) handlePublication(msg interface{}) {
+	pub := msg.(*Publication)
+	m, err := ps.m.Codec().Unmarshal(pub.GetData())
+	if err != nil {
+		log.Warningf("PubSub: Failed to decode message on topic %v: %v\n", pub.GetTopic(), err)
+		return
+	}
+	ps.deliver(pub.GetTopic(), pub.GetFrom(), m)
+}
@@ -0,0 +1,135 @@
+// Code generated by protoc-gen-gogo.
+// source: pubsub.proto
+// DO NOT EDIT!
+
+package pubsub
+
+import proto "code.google.com/p/gogoprotobuf/proto"
+import json "encoding/json"
+import math "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+// Subscribe announces the topics that a node subscribes to.
+type Subscribe struct {
+	From             *string  `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Topics           []string `protobuf:"bytes,2,rep" json:"Topics,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Subscribe) Reset()         { *m = Subscribe{} }
+func (m *Subscribe) String() string { return proto.CompactTextString(m) }
+func (*Subscribe) ProtoMessage()    {}
+
+func (m *Subscribe) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Subscribe) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+// Unsubscribe announces the topics that a node no longer subscribes to.
+type Unsubscribe struct {
+	From             *string  `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Topics           []string `protobuf:"bytes,2,rep" json:"Topics,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Unsubscribe) Reset()         { *m = Unsubscribe{} }
+func (m *Unsubscribe) String() string { return proto.CompactTextString(m) }
+func (*Unsubscribe) ProtoMessage()    {}
+
+func (m *Unsubscribe) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Unsubscribe) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+// Sync carries all the topics that a node subscribes to.
+// If Reply is set, the receiver answers with its own topics.
+type Sync struct {
+	From             *string  `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Topics           []string `protobuf:"bytes,2,rep" json:"Topics,omitempty"`
+	Reply            *bool    `protobuf:"varint,3,opt" json:"Reply,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Sync) Reset()         { *m = Sync{} }
+func (m *Sync) String() string { return proto.CompactTextString(m) }
+func (*Sync) ProtoMessage()    {}
+
+func (m *Sync) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Sync) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+func (m *Sync) GetReply() bool {
+	if m != nil && m.Reply != nil {
+		return *m.Reply
+	}
+	return false
+}
+
+// Publication carries a message published to a topic,
+// the message is encoded by the messenger's codec.
+type Publication struct {
+	From             *string `protobuf:"bytes,1,req" json:"From,omitempty"`
+	Topic            *string `protobuf:"bytes,2,req" json:"Topic,omitempty"`
+	Data             []byte  `protobuf:"bytes,3,req" json:"Data,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Publication) Reset()         { *m = Publication{} }
+func (m *Publication) String() string { return proto.CompactTextString(m) }
+func (*Publication) ProtoMessage()    {}
+
+func (m *Publication) GetFrom() string {
+	if m != nil && m.From != nil {
+		return *m.From
+	}
+	return ""
+}
+
+func (m *Publication) GetTopic() string {
+	if m != nil && m.Topic != nil {
+		return *m.Topic
+	}
+	return ""
+}
+
+func (m *Publication) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func init() {
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// A test node that records the published messages.
+type node struct {
+	sync.Mutex
+	m        *messenger.Messenger
+	ps       *PubSub
+	received []interface{}
+}
+
+func newNode(t *testing.T, hostport string) *node {
+	m := messenger.New(codec.NewGoGoProtobufCodec(),
+		transporter.NewHTTPTransporter(hostport), false, true)
+	assert.NotNil(t, m)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+	ps, err := New(m, hostport)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Start())
+	return &node{m: m, ps: ps}
+}
+
+func (n *node) handler(topic, from string, msg interface{}) {
+	n.Lock()
+	defer n.Unlock()
+	n.received = append(n.received, msg)
+}
+
+func (n *node) count() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.received)
+}
+
+// Wait until the condition becomes true, or fail after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met after %v", timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// Test publishing messages to the subscribers on other nodes.
+func TestPubSub(t *testing.T) {
+	var nodes []*node
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, newNode(t, fmt.Sprintf("localhost:%d", 8020+i)))
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	// b subscribes before knowing any peer, c after.
+	subB, err := b.ps.Subscribe("events", b.handler)
+	assert.NoError(t, err)
+	assert.NoError(t, a.ps.AddPeer("localhost:8021"))
+	assert.NoError(t, a.ps.AddPeer("localhost:8022"))
+	waitFor(t, time.Second*5, func() bool {
+		return len(c.ps.Peers()) == 1 && len(a.ps.Subscribers("events")) == 1
+	})
+	_, err = c.ps.Subscribe("events", c.handler)
+	assert.NoError(t, err)
+	_, err = c.ps.Subscribe("other", c.handler)
+	assert.NoError(t, err)
+	waitFor(t, time.Second*5, func() bool {
+		return len(a.ps.Subscribers("events")) == 2
+	})
+	assert.Equal(t, []string{"localhost:8021", "localhost:8022"}, a.ps.Subscribers("events"))
+
+	msg := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	assert.NoError(t, a.ps.Publish("events", msg))
+	waitFor(t, time.Second*5, func() bool {
+		return b.count() == 1 && c.count() == 1
+	})
+	assert.Equal(t, msg, b.received[0])
+
+	// b unsubscribes, only c should get the message.
+	assert.NoError(t, subB.Unsubscribe())
+	assert.Error(t, subB.Unsubscribe())
+	waitFor(t, time.Second*5, func() bool {
+		return len(a.ps.Subscribers("events")) == 1
+	})
+	assert.NoError(t, a.ps.Publish("events", msg))
+	waitFor(t, time.Second*5, func() bool {
+		return c.count() == 2
+	})
+	assert.Equal(t, 1, b.count())
+
+	for _, n := range nodes {
+		assert.NoError(t, n.m.Destroy())
+	}
+}
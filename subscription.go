@@ -0,0 +1,65 @@
+package messenger
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	// Subscriptions with higher priority are called first,
+	// the ones with the same priority are called in the order
+	// they subscribe. The handlers registered by RegisterHandler
+	// have priority 0.
+	Priority int
+
+	// If set, only the messages that pass the filter are
+	// passed to the subscription.
+	Filter func(msg interface{}) bool
+}
+
+// Subscription is the handle of a subscribed handler.
+type Subscription struct {
+	m       *Messenger
+	msgType reflect.Type
+	h       *handler
+}
+
+// Name returns the name of the subscription.
+func (s *Subscription) Name() string {
+	return s.h.name
+}
+
+// Unsubscribe removes the subscription, the other subscriptions
+// of the same message type are not affected.
+func (s *Subscription) Unsubscribe() error {
+	return s.m.removeHandler(s.msgType, func(h *handler) bool {
+		return h == s.h
+	})
+}
+
+// Subscribe adds a named handler for a message. Unlike RegisterHandler,
+// a message can have many subscriptions, as long as their names are
+// different. Like RegisterHandler, pass a nil pointer to an interface
+// to subscribe all the messages that implement the interface.
+// The opts can be nil.
+func (m *Messenger) Subscribe(name string, msg interface{},
+	msgHandler MessageHandler, opts *SubscribeOptions) (*Subscription, error) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil {
+		return nil, fmt.Errorf("Cannot subscribe to nil")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Subscription name cannot be empty")
+	}
+
+	h := newHandler(name, wrapHandler(msgHandler))
+	if opts != nil {
+		h.priority = opts.Priority
+		h.filter = opts.Filter
+	}
+	if err := m.addHandler(msgType, h, false); err != nil {
+		return nil, err
+	}
+	return &Subscription{m, msgType, h}, nil
+}
@@ -0,0 +1,86 @@
+package messenger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test multiple subscriptions for the same message type.
+func TestSubscribe(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+
+	var calls []string
+	record := func(name string) MessageHandler {
+		return func(msg interface{}) {
+			calls = append(calls, name)
+		}
+	}
+
+	assert.NoError(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, record("handler")))
+	low, err := m.Subscribe("low", &example.GoGoProtobufTestMessage1{}, record("low"),
+		&SubscribeOptions{Priority: -1})
+	assert.NoError(t, err)
+	high, err := m.Subscribe("high", &example.GoGoProtobufTestMessage1{}, record("high"),
+		&SubscribeOptions{Priority: 1})
+	assert.NoError(t, err)
+	_, err = m.Subscribe("filtered", (*proto.Message)(nil), record("filtered"),
+		&SubscribeOptions{
+			Priority: 1,
+			Filter: func(msg interface{}) bool {
+				return msg.(*example.GoGoProtobufTestMessage1).GetF0() > 0
+			},
+		})
+	assert.NoError(t, err)
+	_, err = m.Subscribe("plain", &example.GoGoProtobufTestMessage1{}, record("plain"), nil)
+	assert.NoError(t, err)
+
+	// The names must be unique per type.
+	_, err = m.Subscribe("high", &example.GoGoProtobufTestMessage1{}, record("high"), nil)
+	assert.Error(t, err)
+	assert.Error(t, m.RegisterHandler(&example.GoGoProtobufTestMessage1{}, record("handler")))
+
+	msg := &example.GoGoProtobufTestMessage1{F0: proto.Int32(0)}
+	msgType := reflect.TypeOf(msg)
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, []string{"high", "handler", "plain", "low"}, calls)
+
+	calls = nil
+	msg.F0 = proto.Int32(1)
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, []string{"high", "filtered", "handler", "plain", "low"}, calls)
+
+	// Unsubscribing doesn't affect the others.
+	assert.Equal(t, "high", high.Name())
+	assert.NoError(t, high.Unsubscribe())
+	assert.Error(t, high.Unsubscribe())
+	assert.NoError(t, low.Unsubscribe())
+	assert.NoError(t, m.UnregisterHandler(&example.GoGoProtobufTestMessage1{}))
+	calls = nil
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, []string{"filtered", "plain"}, calls)
+
+	// A panicking filter doesn't match, and doesn't affect the others.
+	var errs []error
+	m.SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	_, err = m.Subscribe("panicky", &example.GoGoProtobufTestMessage1{}, record("panicky"),
+		&SubscribeOptions{
+			Filter: func(msg interface{}) bool {
+				panic("boom")
+			},
+		})
+	assert.NoError(t, err)
+	calls = nil
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+	assert.Equal(t, []string{"filtered", "plain"}, calls)
+	assert.Equal(t, 1, len(errs))
+	assert.IsType(t, &PanicError{}, errs[0])
+}
@@ -0,0 +1,88 @@
+package messenger
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-distributed/messenger/tracing"
+	"github.com/go-distributed/messenger/transporter"
+)
+
+// The names of the spans recorded by the messenger.
+//
+// A sent message has a "send" span, which is the child of the span
+// carried by the ctx passed to SendContext, or the root of a new
+// trace. A received message has a "receive" span, which is the child
+// of the sender's "send" span. Both of them have the "queue", codec
+// and "transport" or "handler" spans as the children.
+const (
+	spanSend      = "send"
+	spanReceive   = "receive"
+	spanQueue     = "queue"
+	spanMarshal   = "marshal"
+	spanUnmarshal = "unmarshal"
+	spanTransport = "transport"
+	spanHandler   = "handler"
+)
+
+// Tracer returns the tracer of the messenger, which is nil if the
+// tracing is disabled.
+func (m *Messenger) Tracer() *tracing.Tracer {
+	return m.tracer
+}
+
+// child starts a span as the child of the parent,
+// it returns nil if the parent is nil.
+func (m *Messenger) child(parent *tracing.Span, name string) *tracing.Span {
+	if parent == nil {
+		return nil
+	}
+	return m.tracer.Start(parent.Context(), name)
+}
+
+// startSend starts the "send" span of the message, as the child of
+// the span carried by the ctx.
+func (m *Messenger) startSend(ctx context.Context, hostport string, msg interface{}) *tracing.Span {
+	if m.tracer == nil {
+		return nil
+	}
+	parent, _ := tracing.FromContext(ctx)
+	span := m.tracer.Start(parent, spanSend)
+	span.SetAttribute("peer", hostport)
+	span.SetAttribute("type", typeName(msg))
+	return span
+}
+
+// startReceive starts the "receive" span of the message, as the
+// child of the sender's span carried in the metadata.
+func (m *Messenger) startReceive(from string, md transporter.Metadata) *tracing.Span {
+	if m.tracer == nil {
+		return nil
+	}
+	parent, _ := tracing.Extract(md)
+	span := m.tracer.Start(parent, spanReceive)
+	span.SetAttribute("peer", from)
+	return span
+}
+
+// queued records how long the message waited in a queue.
+func (m *Messenger) queued(parent *tracing.Span, since time.Time) {
+	if parent == nil {
+		return
+	}
+	m.tracer.StartAt(parent.Context(), spanQueue, since).End(nil)
+}
+
+// withTraceMetadata returns a copy of the ctx whose metadata carries
+// the span, so the receiver continues the trace.
+func withTraceMetadata(ctx context.Context, span *tracing.Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	md := make(transporter.Metadata)
+	for k, v := range transporter.MetadataFromContext(ctx) {
+		md[k] = v
+	}
+	tracing.Inject(span.Context(), md)
+	return transporter.WithMetadata(ctx, md)
+}
@@ -0,0 +1,93 @@
+package messenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/messenger/tracing"
+	"github.com/go-distributed/messenger/transporter"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test a message that hops across the nodes is traced as one trace.
+func TestTracing(t *testing.T) {
+	network := transporter.NewLocalNetwork()
+	e := tracing.NewMemoryExporter()
+	var nodes []*Messenger
+	for _, addr := range []string{"a:8000", "b:8000", "c:8000"} {
+		m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), transporter.NewLocalTransporter(network, addr),
+			WithPreparePeriod(time.Millisecond*10), WithTracing(e))
+		assert.NoError(t, err)
+		assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+		assert.NoError(t, m.Start())
+		defer m.Destroy()
+		nodes = append(nodes, m)
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	// b forwards to c, c replies to nobody.
+	assert.NoError(t, b.RegisterContextHandler(&example.GoGoProtobufTestMessage1{}, func(ctx context.Context, from string, msg interface{}) {
+		assert.NoError(t, b.SendContext(ctx, "c:8000", msg))
+	}))
+	done := make(chan struct{})
+	assert.NoError(t, c.RegisterContextHandler(&example.GoGoProtobufTestMessage1{}, func(ctx context.Context, from string, msg interface{}) {
+		_, ok := tracing.FromContext(ctx)
+		assert.True(t, ok)
+		close(done)
+	}))
+
+	root := a.Tracer().Start(tracing.SpanContext{}, "request")
+	ctx := tracing.NewContext(context.Background(), root.Context())
+	assert.NoError(t, a.SendContext(ctx, "b:8000", &example.GoGoProtobufTestMessage1{}))
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The message didn't reach c")
+	}
+	root.End(nil)
+
+	// 2 sends, 2 receives, each with the children.
+	waitFor(t, time.Second, func() bool { return len(e.Trace(root.TraceID)) == 1+2*4+2*4 })
+	spans := e.Trace(root.TraceID)
+	byID := make(map[string]*tracing.Span)
+	count := make(map[string]int)
+	for _, s := range spans {
+		byID[s.SpanID] = s
+		count[s.Name]++
+	}
+	assert.Equal(t, map[string]int{
+		"request": 1, spanSend: 2, spanReceive: 2, spanQueue: 4,
+		spanMarshal: 2, spanUnmarshal: 2, spanTransport: 2, spanHandler: 2,
+	}, count)
+
+	// Walk up from c's handler to the root.
+	var path []string
+	var leaf *tracing.Span
+	for _, s := range spans {
+		if s.Name == spanReceive && s.Attributes["peer"] == "b:8000" {
+			leaf = s
+		}
+	}
+	assert.NotNil(t, leaf)
+	for s := leaf; s != nil; s = byID[s.ParentID] {
+		path = append(path, s.Name+"@"+s.Attributes["peer"])
+	}
+	assert.Equal(t, []string{
+		"receive@b:8000", "send@c:8000", "handler@", "receive@a:8000", "send@b:8000", "request@",
+	}, path)
+}
+
+// Test the trace context is not sent without the tracing.
+func TestTracingDisabled(t *testing.T) {
+	tr := newFakeTransporter()
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr)
+	assert.NoError(t, err)
+	assert.Nil(t, m.Tracer())
+	assert.Nil(t, m.startSend(context.Background(), "a:8000", nil))
+	assert.Nil(t, m.startReceive("a:8000", transporter.Metadata{tracing.TraceIDKey: "1", tracing.SpanIDKey: "2"}))
+	ctx := context.Background()
+	assert.Equal(t, ctx, withTraceMetadata(ctx, nil))
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// MemoryExporter keeps the spans in memory, it's useful for
+// testing and for inspecting the traces in process.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewMemoryExporter creates a new in-memory exporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// Export keeps the span.
+func (e *MemoryExporter) Export(span *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// Spans returns the exported spans, in the order they ended.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := make([]*Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+// Trace returns the exported spans of the trace.
+func (e *MemoryExporter) Trace(traceID string) []*Span {
+	var spans []*Span
+	for _, s := range e.Spans() {
+		if s.TraceID == traceID {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// Reset discards the exported spans.
+func (e *MemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// JSONFileExporter appends the spans to a file, one JSON object
+// per line, for the local analysis.
+type JSONFileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewJSONFileExporter creates an exporter that appends to the file
+// at the path, the file is created if it doesn't exist.
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Export writes the span to the file.
+func (e *JSONFileExporter) Export(span *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(span)
+}
+
+// Close closes the file.
+func (e *JSONFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
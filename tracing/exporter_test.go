@@ -0,0 +1,44 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the spans are appended to the file in JSON.
+func TestJSONFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	e, err := NewJSONFileExporter(path)
+	assert.NoError(t, err)
+
+	tracer := NewTracer(e)
+	root := tracer.Start(SpanContext{}, "root")
+	child := tracer.Start(root.Context(), "child")
+	child.SetAttribute("peer", "a:8000")
+	child.End(nil)
+	root.End(nil)
+	assert.NoError(t, e.Close())
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var spans []*Span
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		span := new(Span)
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), span))
+		spans = append(spans, span)
+	}
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, root.SpanID, spans[0].ParentID)
+	assert.Equal(t, "a:8000", spans[0].Attributes["peer"])
+	assert.Equal(t, child.Duration, spans[0].Duration)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Equal(t, root.TraceID, spans[1].TraceID)
+}
@@ -0,0 +1,195 @@
+// Package tracing records the spans of the messages going through
+// the messengers, so a request that hops across several nodes can
+// be stitched together. The trace context is carried along with the
+// messages in the transport metadata, and the finished spans are
+// passed to an Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// The metadata keys of the trace context.
+const (
+	TraceIDKey = "trace-id"
+	SpanIDKey  = "span-id"
+)
+
+// SpanContext identifies a span across the nodes.
+type SpanContext struct {
+	TraceID string // 32 hex digits, shared by all the spans of a trace.
+	SpanID  string // 16 hex digits.
+}
+
+// IsValid tells whether the span context identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return isHex(sc.TraceID, 32) && isHex(sc.SpanID, 16)
+}
+
+// isHex tells whether s is n lower-case hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Inject puts the span context in the metadata.
+func Inject(sc SpanContext, md map[string]string) {
+	if !sc.IsValid() || md == nil {
+		return
+	}
+	md[TraceIDKey] = sc.TraceID
+	md[SpanIDKey] = sc.SpanID
+}
+
+// Extract gets the span context from the metadata,
+// it returns false if there is none, or if it's malformed.
+func Extract(md map[string]string) (SpanContext, bool) {
+	sc := SpanContext{md[TraceIDKey], md[SpanIDKey]}
+	return sc, sc.IsValid()
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of the ctx carrying the span context,
+// the spans started with it are its children.
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by the ctx,
+// it returns false if there is none.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Span is a timed stage of a trace.
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string `json:",omitempty"` // Empty for the root span.
+	Name       string
+	Start      time.Time
+	Duration   time.Duration
+	Attributes map[string]string `json:",omitempty"`
+	Error      string            `json:",omitempty"`
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+// Context returns the span context of the span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{s.TraceID, s.SpanID}
+}
+
+// SetAttribute annotates the span, it must be called
+// before the span ends.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// End finishes the span and passes it to the exporter, the err
+// marks the span as failed if it's not nil. Only the first call
+// takes effect. It's a no-op on a nil span, so the callers don't
+// have to check whether the tracing is enabled.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.Duration = time.Since(s.Start)
+		if err != nil {
+			s.Error = err.Error()
+		}
+		s.tracer.exporter.Export(s)
+	})
+}
+
+// Exporter receives the finished spans.
+type Exporter interface {
+	// Export a finished span, it's called concurrently, and
+	// should not block for long.
+	Export(span *Span) error
+}
+
+// Tracer starts the spans, and passes them to the exporter
+// when they end. A nil tracer starts nil spans, which disables
+// the tracing.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer creates a tracer that exports to the exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter}
+}
+
+// Start starts a span as the child of the parent, or as the root
+// of a new trace if the parent is not valid.
+func (t *Tracer) Start(parent SpanContext, name string) *Span {
+	return t.StartAt(parent, name, time.Now())
+}
+
+// StartAt is like Start, but the span starts at the given time,
+// e.g. when a message was queued.
+func (t *Tracer) StartAt(parent SpanContext, name string, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		TraceID: parent.TraceID,
+		SpanID:  newID(8),
+		Name:    name,
+		Start:   start,
+		tracer:  t,
+	}
+	if parent.IsValid() {
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	return s
+}
+
+// StartFromContext starts a span as the child of the span carried
+// by the ctx, and returns a copy of the ctx carrying the new span.
+func (t *Tracer) StartFromContext(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent, _ := FromContext(ctx)
+	s := t.Start(parent, name)
+	return NewContext(ctx, s.Context()), s
+}
+
+// newID returns n random bytes in hex.
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
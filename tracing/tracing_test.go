@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test the spans and the propagation of the span context.
+func TestTracer(t *testing.T) {
+	e := NewMemoryExporter()
+	tracer := NewTracer(e)
+
+	root := tracer.Start(SpanContext{}, "root")
+	assert.Equal(t, 32, len(root.TraceID))
+	assert.Equal(t, 16, len(root.SpanID))
+	assert.Equal(t, "", root.ParentID)
+
+	ctx := NewContext(context.Background(), root.Context())
+	ctx, child := tracer.StartFromContext(ctx, "child")
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	sc, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, child.Context(), sc)
+
+	// Propagate the span context through the metadata.
+	md := make(map[string]string)
+	Inject(child.Context(), md)
+	sc, ok = Extract(md)
+	assert.True(t, ok)
+	remote := tracer.Start(sc, "remote")
+	assert.Equal(t, root.TraceID, remote.TraceID)
+	assert.Equal(t, child.SpanID, remote.ParentID)
+	_, ok = Extract(map[string]string{})
+	assert.False(t, ok)
+	for _, bad := range []map[string]string{
+		{TraceIDKey: root.TraceID[:31], SpanIDKey: root.SpanID},
+		{TraceIDKey: root.TraceID, SpanIDKey: root.SpanID + "0"},
+		{TraceIDKey: root.TraceID, SpanIDKey: "0123456789abcdeg"},
+		{TraceIDKey: root.TraceID, SpanIDKey: "0123456789ABCDEF"},
+	} {
+		_, ok = Extract(bad)
+		assert.False(t, ok)
+	}
+
+	remote.SetAttribute("peer", "a:8000")
+	remote.End(errors.New("failed"))
+	remote.End(nil)
+	child.End(nil)
+	root.End(nil)
+	spans := e.Spans()
+	assert.Equal(t, []*Span{remote, child, root}, spans)
+	assert.Equal(t, "failed", remote.Error)
+	assert.Equal(t, map[string]string{"peer": "a:8000"}, remote.Attributes)
+	assert.Equal(t, 3, len(e.Trace(root.TraceID)))
+	e.Reset()
+	assert.Equal(t, 0, len(e.Spans()))
+}
+
+// Test a nil tracer disables the tracing.
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start(SpanContext{}, "root")
+	assert.Nil(t, span)
+	span.SetAttribute("peer", "a:8000")
+	span.End(nil)
+	assert.False(t, span.Context().IsValid())
+
+	ctx := context.Background()
+	ctx2, span := tracer.StartFromContext(ctx, "child")
+	assert.Nil(t, span)
+	assert.Equal(t, ctx, ctx2)
+	_, ok := FromContext(ctx2)
+	assert.False(t, ok)
+}
@@ -2,16 +2,23 @@ package transporter
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 )
 
 // For internal message passing.
 type message struct {
+	from string
 	data []byte
+	md   Metadata
 	err  error
 }
 
@@ -21,11 +28,29 @@ type HTTPTransporter struct {
 	messageChan chan *message
 	mux         *http.ServeMux
 	client      *http.Client
+
+	mu         sync.Mutex
+	server     *http.Server // The running server.
+	stop       chan struct{}
+	stopped    bool
+	overloaded func() bool // Nil if the senders are blocked instead.
+	retries    int         // Number of the retries when the peer is overloaded.
 }
 
 const defaultPrefix = "/messenger"
+const fromHeader = "Messenger-From"
+const metadataHeaderPrefix = "Messenger-Meta-"
 const defaultChanSize = 1024
 
+// When a peer is overloaded, the message is sent again after the
+// delay the peer asks for, or after an exponential backoff if it
+// doesn't, up to maxRetryDelay.
+const (
+	defaultOverloadRetries = 5
+	minRetryDelay          = time.Millisecond * 50
+	maxRetryDelay          = time.Second * 5
+)
+
 // NewHTTPTransporter creates a new http transporter.
 func NewHTTPTransporter(hostport string) *HTTPTransporter {
 	t := &HTTPTransporter{
@@ -33,42 +58,189 @@ func NewHTTPTransporter(hostport string) *HTTPTransporter {
 		messageChan: make(chan *message, defaultChanSize),
 		mux:         http.NewServeMux(),
 		client:      new(http.Client),
+		retries:     defaultOverloadRetries,
+		stop:        make(chan struct{}),
 	}
 	t.mux.HandleFunc(defaultPrefix, t.messageHandler)
 	return t
 }
 
 // Send an encoded message to the host:port.
-// This will block.
+// This will block. If the peer is not consuming the messages fast
+// enough, it backs off and tries again, ErrOverloaded is returned
+// if the peer is still overloaded after the retries.
 func (t *HTTPTransporter) Send(hostport string, b []byte) error {
+	return t.SendContext(context.Background(), hostport, b)
+}
+
+// SendContext sends an encoded message to the host:port,
+// the ctx's deadline is applied to the HTTP request and to the
+// retries, and the ctx's metadata is sent in the headers.
+func (t *HTTPTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	t.mu.Lock()
+	retries := t.retries
+	t.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := t.post(ctx, hostport, b)
+		if err != ErrOverloaded || attempt >= retries {
+			return err
+		}
+		log.V(2).Infof("HTTPTransporter: %v is overloaded, retrying\n", hostport)
+		timer := time.NewTimer(retryDelay(attempt, retryAfter))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// retryDelay returns how long to wait before the retry, the peer
+// may ask for a delay.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	d := retryAfter
+	if d <= 0 {
+		d = minRetryDelay << uint(attempt)
+	}
+	if d <= 0 || d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// post sends the message once, it returns ErrOverloaded and the
+// delay the peer asks for if the peer is overloaded.
+func (t *HTTPTransporter) post(ctx context.Context, hostport string, b []byte) (time.Duration, error) {
 	targetURL := fmt.Sprintf("http://%s%s", hostport, defaultPrefix)
 	log.V(2).Infof("Sending message to %v\n", hostport)
-	resp, err := t.client.Post(targetURL, "application/messenger", bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", targetURL, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/messenger")
+	req.Header.Set(fromHeader, t.hostport)
+	for k, v := range MetadataFromContext(ctx) {
+		req.Header.Set(metadataHeaderPrefix+k, v)
+	}
+	resp, err := t.client.Do(req)
 	if resp == nil || err != nil {
 		log.Warningf("HTTPTransporter: Failed to POST: %v\n", err)
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
-	return nil
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, ErrOverloaded
+	case resp.StatusCode/100 != 2:
+		return 0, fmt.Errorf("HTTPTransporter: Unexpected status: %v", resp.Status)
+	}
+	return 0, nil
+}
+
+// SetOverloaded makes the transporter answer 429 Too Many Requests
+// while overloaded returns true, or if the received messages can't
+// be queued right away, so the remote senders back off. By default,
+// the senders are blocked until there is room, so no message is lost.
+func (t *HTTPTransporter) SetOverloaded(overloaded func() bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.overloaded = overloaded
+}
+
+// SetOverloadRetries sets how many times a message is sent again
+// when the peer is overloaded, 0 disables the retries.
+func (t *HTTPTransporter) SetOverloadRetries(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retries = n
 }
 
 // Recv receives a message in bytes from some peer.
 func (t *HTTPTransporter) Recv() (b []byte, err error) {
-	msg := <-t.messageChan
-	return msg.data, msg.err
+	_, b, err = t.RecvFrom()
+	return b, err
 }
 
-// Start the transporter, this will block unless some error happens.
+// RecvFrom receives a message in bytes from some peer,
+// together with the address the peer is listening on.
+func (t *HTTPTransporter) RecvFrom() (from string, b []byte, err error) {
+	return t.RecvFromContext(context.Background())
+}
+
+// RecvFromContext is like RecvFrom, but gives up when the ctx is done.
+func (t *HTTPTransporter) RecvFromContext(ctx context.Context) (from string, b []byte, err error) {
+	from, b, _, err = t.RecvMetadata(ctx)
+	return
+}
+
+// RecvMetadata is like RecvFromContext, but also returns the
+// metadata sent along with the message. It returns ErrStopped
+// once the transporter is stopped.
+func (t *HTTPTransporter) RecvMetadata(ctx context.Context) (from string, b []byte, md Metadata, err error) {
+	select {
+	case msg := <-t.messageChan:
+		return msg.from, msg.data, msg.md, msg.err
+	case <-ctx.Done():
+		return "", nil, nil, ctx.Err()
+	case <-t.stopChan():
+		return "", nil, nil, ErrStopped
+	}
+}
+
+// Start the transporter, this will block until it's stopped
+// or some error happens. It can be started again after it's stopped.
 func (t *HTTPTransporter) Start() error {
-	if err := http.ListenAndServe(t.hostport, t.mux); err != nil {
-		return err
+	t.mu.Lock()
+	if t.server != nil {
+		t.mu.Unlock()
+		return fmt.Errorf("HTTPTransporter: Already started")
 	}
-	return nil
+	server := &http.Server{Addr: t.hostport, Handler: t.mux}
+	t.server = server
+	if t.stopped {
+		t.stop = make(chan struct{})
+		t.stopped = false
+	}
+	t.mu.Unlock()
+
+	err := server.ListenAndServe()
+	t.mu.Lock()
+	if t.server == server {
+		t.server = nil
+	}
+	t.mu.Unlock()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
-// Stop the transporter. No-op for now.
+// Stop the transporter, the server is closed, and the blocked
+// receivers are woken up.
 func (t *HTTPTransporter) Stop() error {
-	return nil
+	t.mu.Lock()
+	server := t.server
+	t.server = nil
+	if !t.stopped {
+		close(t.stop)
+		t.stopped = true
+	}
+	t.mu.Unlock()
+	// Close the keep-alive connections to the peers as well.
+	t.client.CloseIdleConnections()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+func (t *HTTPTransporter) stopChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stop
 }
 
 // Destroy the transporter.
@@ -76,12 +248,56 @@ func (t *HTTPTransporter) Destroy() error {
 	return nil
 }
 
+// Handle registers a handler on the transporter's mux, so it's
+// served along with the messages, e.g. to expose the metrics.
+func (t *HTTPTransporter) Handle(pattern string, handler http.Handler) {
+	t.mux.Handle(pattern, handler)
+}
+
 // Handle incoming messages.
 func (t *HTTPTransporter) messageHandler(w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Warningf("HTTPTransporter: Failed to read HTTP body: %v\n", err)
 	}
-	log.V(2).Infof("Receiving message from %v\n", r.RemoteAddr)
-	t.messageChan <- &message{b, err}
+	// The header is set by the sender, anyone can claim any address.
+	from := r.Header.Get(fromHeader)
+	if from == "" {
+		from = r.RemoteAddr
+	}
+	var md Metadata
+	for k := range r.Header {
+		if strings.HasPrefix(k, metadataHeaderPrefix) {
+			if md == nil {
+				md = make(Metadata)
+			}
+			md[strings.ToLower(k[len(metadataHeaderPrefix):])] = r.Header.Get(k)
+		}
+	}
+	log.V(2).Infof("Receiving message from %v\n", from)
+	msg := &message{from, b, md, err}
+	t.mu.Lock()
+	overloaded := t.overloaded
+	t.mu.Unlock()
+	if overloaded == nil {
+		// Block the sender until the message is queued.
+		select {
+		case t.messageChan <- msg:
+		case <-r.Context().Done():
+			log.Warningf("HTTPTransporter: Sender of %v is gone before the message is queued\n", from)
+		}
+		return
+	}
+	// Tell the sender to back off instead of blocking it,
+	// if the messages are not consumed fast enough.
+	if !overloaded() {
+		select {
+		case t.messageChan <- msg:
+			return
+		default:
+		}
+	}
+	log.Warningf("HTTPTransporter: Overloaded, rejected message from %v\n", from)
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
 }
@@ -0,0 +1,167 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// LocalNetwork connects the LocalTransporters in the same process.
+type LocalNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*LocalTransporter
+}
+
+// NewLocalNetwork creates a new local network.
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{nodes: make(map[string]*LocalTransporter)}
+}
+
+func (n *LocalNetwork) lookup(hostport string) (*LocalTransporter, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	t, ok := n.nodes[hostport]
+	return t, ok
+}
+
+func (n *LocalNetwork) attach(t *LocalTransporter) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.nodes[t.hostport]; ok {
+		return fmt.Errorf("Address %v is already in use", t.hostport)
+	}
+	n.nodes[t.hostport] = t
+	return nil
+}
+
+func (n *LocalNetwork) detach(t *LocalTransporter) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nodes[t.hostport] == t {
+		delete(n.nodes, t.hostport)
+	}
+}
+
+// LocalTransporter implements the Transporter in process,
+// the messages are passed through channels instead of the wire.
+// It's useful for testing the components built atop the messenger.
+type LocalTransporter struct {
+	hostport    string
+	network     *LocalNetwork
+	messageChan chan *message
+
+	mu      sync.Mutex // Protects the stop channel.
+	stop    chan struct{}
+	stopped bool
+}
+
+// NewLocalTransporter creates a new local transporter in the network.
+func NewLocalTransporter(network *LocalNetwork, hostport string) *LocalTransporter {
+	return &LocalTransporter{
+		hostport:    hostport,
+		network:     network,
+		messageChan: make(chan *message, defaultChanSize),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Send an encoded message to the host:port.
+// It fails if there is no started transporter at the host:port.
+func (t *LocalTransporter) Send(hostport string, b []byte) error {
+	return t.SendContext(context.Background(), hostport, b)
+}
+
+// SendContext is like Send, but gives up when the ctx is done.
+// The ctx's metadata is passed along with the message.
+func (t *LocalTransporter) SendContext(ctx context.Context, hostport string, b []byte) error {
+	target, ok := t.network.lookup(hostport)
+	if !ok {
+		return fmt.Errorf("LocalTransporter: %v is unreachable", hostport)
+	}
+	log.V(2).Infof("Sending message to %v\n", hostport)
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case target.messageChan <- &message{t.hostport, data, MetadataFromContext(ctx).normalize(), nil}:
+		return nil
+	case <-target.stopChan():
+		return fmt.Errorf("LocalTransporter: %v is unreachable", hostport)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Recv receives a message in bytes from some peer.
+func (t *LocalTransporter) Recv() (b []byte, err error) {
+	_, b, err = t.RecvFrom()
+	return b, err
+}
+
+// RecvFrom receives a message in bytes from some peer,
+// together with the address of the peer.
+func (t *LocalTransporter) RecvFrom() (from string, b []byte, err error) {
+	return t.RecvFromContext(context.Background())
+}
+
+// RecvFromContext is like RecvFrom, but gives up when the ctx is done.
+func (t *LocalTransporter) RecvFromContext(ctx context.Context) (from string, b []byte, err error) {
+	from, b, _, err = t.RecvMetadata(ctx)
+	return
+}
+
+// RecvMetadata is like RecvFromContext, but also returns the
+// metadata sent along with the message. It returns ErrStopped
+// once the transporter is stopped.
+func (t *LocalTransporter) RecvMetadata(ctx context.Context) (from string, b []byte, md Metadata, err error) {
+	select {
+	case msg := <-t.messageChan:
+		return msg.from, msg.data, msg.md, msg.err
+	case <-ctx.Done():
+		return "", nil, nil, ctx.Err()
+	case <-t.stopChan():
+		return "", nil, nil, ErrStopped
+	}
+}
+
+func (t *LocalTransporter) stopChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stop
+}
+
+// Start the transporter, this will block until it's stopped.
+// It can be started again after it's stopped.
+func (t *LocalTransporter) Start() error {
+	t.mu.Lock()
+	if t.stopped {
+		t.stop = make(chan struct{})
+		t.stopped = false
+	}
+	stop := t.stop
+	t.mu.Unlock()
+
+	if err := t.network.attach(t); err != nil {
+		return err
+	}
+	<-stop
+	return nil
+}
+
+// Stop the transporter, the peers can no longer reach it.
+func (t *LocalTransporter) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.stopped {
+		t.network.detach(t)
+		close(t.stop)
+		t.stopped = true
+	}
+	return nil
+}
+
+// Destroy the transporter.
+func (t *LocalTransporter) Destroy() error {
+	return nil
+}
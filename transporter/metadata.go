@@ -0,0 +1,96 @@
+package transporter
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// Metadata is carried along with an encoded message, such as the
+// trace context. The keys are case-insensitive, and they are
+// received in lower case. As they are sent in HTTP headers, the
+// keys must be HTTP tokens, and the values must not contain
+// control characters.
+type Metadata map[string]string
+
+type metadataKey struct{}
+
+// WithMetadata returns a copy of the ctx carrying a copy of the
+// metadata, which is sent along with the message by SendContext.
+// The invalid entries are dropped.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md.valid())
+}
+
+// MetadataFromContext returns the metadata carried by the ctx,
+// or nil if there is none.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// MetadataRecver is implemented by the transporters that carry
+// the metadata along with the messages.
+type MetadataRecver interface {
+	// Receive an encoded message from some peer, together with
+	// the address of the peer and the metadata sent along with it.
+	// It returns the ctx's error if the ctx is done before a
+	// message arrives.
+	RecvMetadata(ctx context.Context) (from string, b []byte, md Metadata, err error)
+}
+
+// normalize lower-cases the keys.
+func (md Metadata) normalize() Metadata {
+	if len(md) == 0 {
+		return nil
+	}
+	n := make(Metadata, len(md))
+	for k, v := range md {
+		n[strings.ToLower(k)] = v
+	}
+	return n
+}
+
+// valid returns a copy of the metadata without the invalid entries.
+func (md Metadata) valid() Metadata {
+	if md == nil {
+		return nil
+	}
+	v := make(Metadata, len(md))
+	for key, value := range md {
+		if !validKey(key) || !validValue(value) {
+			log.Warningf("Dropped invalid metadata %q: %q\n", key, value)
+			continue
+		}
+		v[key] = value
+	}
+	return v
+}
+
+// validKey tells whether the key is an HTTP token.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue tells whether the value has no control characters.
+func validValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -1,5 +1,19 @@
 package transporter
 
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrOverloaded is returned by Send when the peer is receiving
+// messages faster than it can handle them, and it's still the case
+// after the sender has backed off and tried again.
+var ErrOverloaded = errors.New("Peer is overloaded")
+
+// ErrStopped is returned by Recv when the transporter is stopped.
+var ErrStopped = errors.New("Transporter is stopped")
+
 // Transporter defines interfaces of a transporter, including
 // Send and Recv.
 type Transporter interface {
@@ -21,3 +35,46 @@ type Transporter interface {
 	// Destroy the transporter.
 	Destroy() error
 }
+
+// FromRecver is implemented by the transporters that know
+// where the messages come from. The address is the one claimed
+// by the sender, it's not authenticated, so it must not be
+// trusted for anything but routing the replies.
+type FromRecver interface {
+	// Receive an encoded message from some peer.
+	// Return the bytes form of the message, and the
+	// address of the peer.
+	RecvFrom() (from string, b []byte, err error)
+}
+
+// ContextTransporter is implemented by the transporters whose
+// operations can be bounded by a context.
+type ContextTransporter interface {
+	// Send an encoded message to the host:port, it gives up
+	// when the ctx is done.
+	SendContext(ctx context.Context, hostport string, b []byte) error
+
+	// Receive an encoded message from some peer, together with
+	// the address of the peer. It returns the ctx's error if the
+	// ctx is done before a message arrives.
+	RecvFromContext(ctx context.Context) (from string, b []byte, err error)
+}
+
+// Rejecter is implemented by the transporters that can tell the
+// remote senders to back off when the received messages are not
+// consumed fast enough, instead of blocking them.
+type Rejecter interface {
+	// SetOverloaded sets the function that tells whether the
+	// receiver of the messages is overloaded. While it returns
+	// true, the incoming messages are rejected, and the senders
+	// get ErrOverloaded. If it's nil, which is the default, the
+	// senders are blocked until the messages can be queued.
+	SetOverloaded(overloaded func() bool)
+}
+
+// HTTPMuxer is implemented by the transporters that serve HTTP,
+// so other handlers can be served along with the messages.
+type HTTPMuxer interface {
+	// Handle registers the handler for the pattern.
+	Handle(pattern string, handler http.Handler)
+}
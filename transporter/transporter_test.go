@@ -1,8 +1,10 @@
 package transporter
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -106,6 +108,226 @@ func TestHTTPTransporter(t *testing.T) {
 	testTransporter(t, sender, receiver, "localhost:8081")
 }
 
+// Test that the HTTPTransporter knows where the messages come from.
+func TestHTTPTransporterRecvFrom(t *testing.T) {
+	sender := NewHTTPTransporter("localhost:8082")
+	receiver := NewHTTPTransporter("localhost:8083")
+
+	go func() {
+		assert.NoError(t, sender.Start())
+	}()
+	go func() {
+		assert.NoError(t, receiver.Start())
+	}()
+
+	time.Sleep(time.Second)
+
+	assert.NoError(t, sender.Send("localhost:8083", []byte("hello")))
+	from, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8082", from)
+	assert.Equal(t, []byte("hello"), b)
+}
+
+// Test that the HTTPTransporter blocks the sender by default when
+// the messages are not consumed, or tells it to back off if it's
+// configured to reject them.
+func TestHTTPTransporterOverloaded(t *testing.T) {
+	sender := NewHTTPTransporter("localhost:8084")
+	receiver := NewHTTPTransporter("localhost:8085")
+	receiver.messageChan = make(chan *message, 1)
+
+	go func() {
+		assert.NoError(t, receiver.Start())
+	}()
+
+	time.Sleep(time.Second)
+
+	// Blocked until the message is consumed.
+	assert.NoError(t, sender.Send("localhost:8085", []byte("hello")))
+	sent := make(chan error)
+	go func() {
+		sent <- sender.Send("localhost:8085", []byte("hello"))
+	}()
+	select {
+	case <-sent:
+		t.Fatal("The sender is not blocked")
+	case <-time.After(time.Millisecond * 100):
+	}
+	_, err := receiver.Recv()
+	assert.NoError(t, err)
+	assert.NoError(t, <-sent)
+	_, err = receiver.Recv()
+	assert.NoError(t, err)
+
+	// Rejected without retries while the receiver is overloaded.
+	var overloaded int32 = 1
+	receiver.SetOverloaded(func() bool { return atomic.LoadInt32(&overloaded) == 1 })
+	sender.SetOverloadRetries(0)
+	assert.Equal(t, ErrOverloaded, sender.Send("localhost:8085", []byte("hello")))
+
+	// Sent again after the delay the receiver asks for.
+	sender.SetOverloadRetries(1)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		atomic.StoreInt32(&overloaded, 0)
+	}()
+	start := time.Now()
+	assert.NoError(t, sender.Send("localhost:8085", []byte("hello")))
+	assert.True(t, time.Since(start) >= time.Second)
+
+	// Also rejected if the messages are not consumed.
+	sender.SetOverloadRetries(0)
+	assert.Equal(t, ErrOverloaded, sender.Send("localhost:8085", []byte("hello")))
+	_, err = receiver.Recv()
+	assert.NoError(t, err)
+	assert.NoError(t, receiver.Stop())
+}
+
+// Test the retry delays.
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, minRetryDelay, retryDelay(0, 0))
+	assert.Equal(t, minRetryDelay*4, retryDelay(2, 0))
+	assert.Equal(t, maxRetryDelay, retryDelay(20, 0))
+	assert.Equal(t, maxRetryDelay, retryDelay(100, 0))
+	assert.Equal(t, time.Second, retryDelay(0, time.Second))
+	assert.Equal(t, maxRetryDelay, retryDelay(0, time.Minute))
+}
+
+// Test the transporters give up when the ctx is done.
+func TestTransporterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := NewHTTPTransporter("localhost:8086").SendContext(ctx, "localhost:8087", []byte("hello"))
+	assert.Error(t, err)
+
+	network := NewLocalNetwork()
+	receiver := NewLocalTransporter(network, "receiver:1")
+	go func() {
+		assert.NoError(t, receiver.Start())
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, _, err = receiver.RecvFromContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NoError(t, receiver.Stop())
+}
+
+// Test the metadata is carried along with the messages.
+func TestTransporterMetadata(t *testing.T) {
+	network := NewLocalNetwork()
+	receivers := []*struct {
+		tr       Transporter
+		hostport string
+	}{
+		{NewHTTPTransporter("localhost:8088"), "localhost:8088"},
+		{NewLocalTransporter(network, "receiver:1"), "receiver:1"},
+	}
+	senders := []ContextTransporter{NewHTTPTransporter("localhost:8089"), NewLocalTransporter(network, "sender:1")}
+	for _, r := range receivers {
+		go func(tr Transporter) {
+			assert.NoError(t, tr.Start())
+		}(r.tr)
+	}
+	time.Sleep(time.Second)
+
+	for i, r := range receivers {
+		ctx := WithMetadata(context.Background(), Metadata{
+			"Trace-ID":  "abc",
+			"Bad Key":   "value",
+			"bad-value": "a\r\nX-Injected: 1",
+		})
+		assert.NoError(t, senders[i].SendContext(ctx, r.hostport, []byte("hello")))
+		_, b, md, err := r.tr.(MetadataRecver).RecvMetadata(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), b)
+		assert.Equal(t, Metadata{"trace-id": "abc"}, md)
+
+		// No metadata.
+		assert.NoError(t, senders[i].SendContext(context.Background(), r.hostport, []byte("hello")))
+		_, _, md, err = r.tr.(MetadataRecver).RecvMetadata(context.Background())
+		assert.NoError(t, err)
+		assert.Nil(t, md)
+		assert.NoError(t, r.tr.Stop())
+	}
+}
+
+// Test the invalid metadata entries are dropped.
+func TestMetadataValid(t *testing.T) {
+	md := Metadata{"trace-id": "abc", "": "a", "a:b": "c", "tab": "a\tb", "nul": "\x00"}
+	ctx := WithMetadata(context.Background(), md)
+	assert.Equal(t, Metadata{"trace-id": "abc", "tab": "a\tb"}, MetadataFromContext(ctx))
+	assert.Nil(t, MetadataFromContext(WithMetadata(context.Background(), nil)))
+}
+
+// Test a blocked Recv is woken up when the transporter is stopped.
+func TestTransporterStopRecv(t *testing.T) {
+	network := NewLocalNetwork()
+	for _, tr := range []Transporter{NewHTTPTransporter("localhost:8090"), NewLocalTransporter(network, "receiver:1")} {
+		for i := 0; i < 2; i++ {
+			started := make(chan error, 1)
+			go func() {
+				started <- tr.Start()
+			}()
+			time.Sleep(time.Millisecond * 100)
+
+			recvd := make(chan error, 1)
+			go func() {
+				_, err := tr.Recv()
+				recvd <- err
+			}()
+			select {
+			case <-recvd:
+				t.Fatal("Recv doesn't block")
+			case <-time.After(time.Millisecond * 50):
+			}
+			assert.NoError(t, tr.Stop())
+			select {
+			case err := <-recvd:
+				assert.Equal(t, ErrStopped, err)
+			case <-time.After(time.Second):
+				t.Fatal("Recv is not woken up by Stop")
+			}
+			assert.NoError(t, <-started)
+		}
+	}
+}
+
+// Test the LocalTransporter.
+func TestLocalTransporter(t *testing.T) {
+	network := NewLocalNetwork()
+	sender := NewLocalTransporter(network, "sender:1")
+	receiver := NewLocalTransporter(network, "receiver:1")
+
+	// Not started yet.
+	assert.Error(t, sender.Send("receiver:1", []byte("hello")))
+
+	go func() {
+		assert.NoError(t, sender.Start())
+	}()
+	go func() {
+		assert.NoError(t, receiver.Start())
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	// The address is in use.
+	assert.Error(t, NewLocalTransporter(network, "receiver:1").Start())
+
+	assert.NoError(t, sender.Send("receiver:1", []byte("hello")))
+	from, b, err := receiver.RecvFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "sender:1", from)
+	assert.Equal(t, []byte("hello"), b)
+
+	testTransporter(t, sender, receiver, "receiver:1")
+
+	// The stopped receiver is unreachable.
+	assert.Error(t, sender.Send("receiver:1", []byte("hello")))
+}
+
 // Benchmark the HTTPTransporter.
 func BenchmarkHTTPTransporter(b *testing.B) {
 	// Use random port to avoid port collision (hopefully).
@@ -0,0 +1,167 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// Handle registers the message type T together with a handler
+// for it, so the handler gets the message without type assertion.
+// The message type is registered if it's not registered yet.
+// The from is the address claimed by the sender, it's empty if
+// the transporter doesn't know it, and it's not verified. The ctx
+// is cancelled when the messenger is stopped.
+func Handle[T proto.Message](m *Messenger, fn func(ctx context.Context, from string, msg T)) error {
+	msgType, err := registerTyped[T](m)
+	if err != nil {
+		return err
+	}
+	return m.registerHandler(msgType, func(ctx context.Context, from string, msg interface{}) {
+		fn(ctx, from, msg.(T))
+	}, false)
+}
+
+// Receiver receives the messages of type T.
+type Receiver[T proto.Message] struct {
+	m       *Messenger
+	msgType reflect.Type
+	h       *handler
+	queue   chan T
+	done    chan struct{} // Closed when the receiver is closed.
+
+	// Protects the queue from being closed while sending to it.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Recv a message of type T. After the receiver is closed, the
+// queued messages can still be received, then an error is returned.
+func (r *Receiver[T]) Recv() (T, error) {
+	msg, ok := <-r.queue
+	if !ok {
+		return msg, fmt.Errorf("Failed to receive, receiver is closed")
+	}
+	return msg, nil
+}
+
+// Close unregisters the receiver's handler, so the messages of
+// type T are no longer queued, and wakes up the blocked Recv().
+func (r *Receiver[T]) Close() error {
+	return r.m.removeHandler(r.msgType, func(h *handler) bool {
+		return h == r.h
+	})
+}
+
+// close closes the queue, it's called when the handler is removed.
+func (r *Receiver[T]) close() {
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	close(r.queue)
+}
+
+// push puts the message in the queue, the messenger's receive
+// policy is applied if the queue is full. It gives up when the
+// messenger is stopped, so the reading is not blocked forever.
+func (r *Receiver[T]) push(ctx context.Context, from string, msg T) {
+	r.m.mu.RLock()
+	policy := r.m.recvPolicy
+	r.m.mu.RUnlock()
+
+	if !r.enqueue(ctx, from, msg, policy) && policy == OverflowError {
+		r.m.reportError(fmt.Errorf("Receive queue of %v is full, dropped message from %v", r.msgType, from))
+	}
+}
+
+// enqueue returns false if the message is dropped.
+func (r *Receiver[T]) enqueue(ctx context.Context, from string, msg T, policy OverflowPolicy) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return true
+	}
+
+	switch policy {
+	case OverflowDropOldest:
+		for {
+			select {
+			case r.queue <- msg:
+				return true
+			default:
+			}
+			select {
+			case old := <-r.queue:
+				r.m.dropRecv(from, old)
+			default:
+			}
+		}
+	case OverflowDropNewest, OverflowError:
+		select {
+		case r.queue <- msg:
+			return true
+		default:
+		}
+		r.m.dropRecv(from, msg)
+		return false
+	}
+	select {
+	case r.queue <- msg:
+	case <-ctx.Done():
+	case <-r.done:
+	}
+	return true
+}
+
+// RecvTyped registers the message type T, and returns a receiver
+// that receives all the messages of that type. Like Recv(), the
+// user is responsible to consume the messages, the queue has the
+// size and the overflow policy of the receive queue. When the
+// policy blocks, the reading stops until there is room, or until
+// the messenger is stopped.
+// It's built on the handlers, so the handler must be enabled, and
+// the receiver is closed when its handler is unregistered.
+func RecvTyped[T proto.Message](m *Messenger) (*Receiver[T], error) {
+	msgType, err := registerTyped[T](m)
+	if err != nil {
+		return nil, err
+	}
+	r := &Receiver[T]{
+		m:       m,
+		msgType: msgType,
+		queue:   make(chan T, m.recvQueueSize),
+		done:    make(chan struct{}),
+	}
+	r.h = newHandler(handlerName(msgType), func(ctx context.Context, from string, msg interface{}) {
+		r.push(ctx, from, msg.(T))
+	})
+	r.h.removed = r.close
+	if err := m.addHandler(msgType, r.h, false); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// registerTyped registers the message type T if it's not registered yet.
+func registerTyped[T proto.Message](m *Messenger) (reflect.Type, error) {
+	var zero T
+	msgType := reflect.TypeOf(zero)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("Message type must be a pointer type")
+	}
+	if m.isRegistered(msgType) {
+		return msgType, nil
+	}
+	if err := m.RegisterMessage(reflect.New(msgType.Elem()).Interface()); err != nil {
+		// Someone else might have registered it in the meantime.
+		if m.isRegistered(msgType) {
+			return msgType, nil
+		}
+		return nil, err
+	}
+	return msgType, nil
+}
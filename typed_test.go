@@ -0,0 +1,116 @@
+package messenger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+// Test Handle() and RecvTyped().
+func TestTypedHandlers(t *testing.T) {
+	m := New(codec.NewGoGoProtobufCodec(), newFakeTransporter(), false, true)
+	assert.NotNil(t, m)
+
+	var got []*example.GoGoProtobufTestMessage1
+	var froms []string
+	assert.NoError(t, Handle(m, func(ctx context.Context, from string, msg *example.GoGoProtobufTestMessage1) {
+		got = append(got, msg)
+		froms = append(froms, from)
+	}))
+	// The handler is already registered.
+	assert.Error(t, Handle(m, func(ctx context.Context, from string, msg *example.GoGoProtobufTestMessage1) {}))
+	// Not a concrete message type.
+	assert.Error(t, Handle(m, func(ctx context.Context, from string, msg proto.Message) {}))
+
+	r, err := RecvTyped[*example.GoGoProtobufTestMessage2](m)
+	assert.NoError(t, err)
+
+	// Both types are registered in the messenger and the codec.
+	msg1 := &example.GoGoProtobufTestMessage1{
+		F0: proto.Int32(1),
+		F1: proto.String("hello"),
+		F2: proto.Float32(4.2),
+	}
+	msg2 := &example.GoGoProtobufTestMessage2{
+		F0: proto.Int32(2),
+		F1: proto.String("world"),
+		F2: proto.Float32(2.4),
+	}
+	_, err = m.codec.Marshal(msg1)
+	assert.NoError(t, err)
+	_, err = m.codec.Marshal(msg2)
+	assert.NoError(t, err)
+
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg1), "localhost:8011", msg1))
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg2), "localhost:8011", msg2))
+	assert.Equal(t, []*example.GoGoProtobufTestMessage1{msg1}, got)
+	assert.Equal(t, []string{"localhost:8011"}, froms)
+
+	recvMsg, err := r.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, msg2, recvMsg)
+}
+
+// Test the typed receiver doesn't block the reading forever, and is
+// closed when it's unregistered.
+func TestReceiverClose(t *testing.T) {
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), newFakeTransporter(), WithQueueSizes(1, 1, 1))
+	assert.NoError(t, err)
+	r, err := RecvTyped[*example.GoGoProtobufTestMessage1](m)
+	assert.NoError(t, err)
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	msgType := reflect.TypeOf(msg)
+	assert.True(t, m.dispatch(context.Background(), msgType, "", msg))
+
+	// The queue is full, the handler gives up when the ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		done <- m.dispatch(ctx, msgType, "", msg)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The handler is blocked on the full queue")
+	}
+
+	// With a dropping policy, the message is dead lettered.
+	m.SetRecvPolicy(OverflowDropNewest)
+	assert.True(t, m.dispatch(context.Background(), msgType, "localhost:8011", msg))
+	assert.Equal(t, 1, m.DeadLetters().Len())
+
+	// The queued message is still received after Close.
+	assert.NoError(t, r.Close())
+	assert.Error(t, r.Close())
+	recvMsg, err := r.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, msg, recvMsg)
+	_, err = r.Recv()
+	assert.Error(t, err)
+	assert.False(t, m.dispatch(context.Background(), msgType, "", msg))
+}
+
+// Test closing a replaced receiver doesn't remove the replacement.
+func TestReceiverCloseReplaced(t *testing.T) {
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), newFakeTransporter())
+	assert.NoError(t, err)
+	r, err := RecvTyped[*example.GoGoProtobufTestMessage1](m)
+	assert.NoError(t, err)
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	handled := 0
+	assert.NoError(t, m.ReplaceHandler(msg, func(msg interface{}) { handled++ }))
+	_, err = r.Recv()
+	assert.Error(t, err)
+	assert.Error(t, r.Close())
+	assert.True(t, m.dispatch(context.Background(), reflect.TypeOf(msg), "", msg))
+	assert.Equal(t, 1, handled)
+}
@@ -0,0 +1,45 @@
+package messenger
+
+import "errors"
+
+// ErrEmptyMessage is returned when an encoded message is empty,
+// e.g. a damaged capture record.
+var ErrEmptyMessage = errors.New("Empty message")
+
+// WireTap sees the raw bytes of the messages on the wire, e.g. to
+// capture the traffic. The inbound messages are tapped when they are
+// received, before they are decoded, and the outbound messages after
+// they are sent successfully. The b must not be modified or retained.
+type WireTap interface {
+	Tap(d Direction, peer string, b []byte)
+}
+
+// SetWireTap sets the wire tap, passing nil removes it.
+func (m *Messenger) SetWireTap(tap WireTap) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wireTap = tap
+}
+
+// Inject passes an encoded message to the messenger as if it was
+// received from the peer, e.g. to replay the captured traffic. The
+// messenger must be running. It's not passed to the wire tap.
+// It returns ErrEmptyMessage if the b is empty.
+func (m *Messenger) Inject(from string, b []byte) error {
+	if m.State() != StateRunning {
+		return ErrStopped
+	}
+	if len(b) == 0 {
+		return ErrEmptyMessage
+	}
+	return m.receive(from, b, nil)
+}
+
+func (m *Messenger) tap(d Direction, peer string, b []byte) {
+	m.mu.RLock()
+	tap := m.wireTap
+	m.mu.RUnlock()
+	if tap != nil {
+		tap.Tap(d, peer, b)
+	}
+}
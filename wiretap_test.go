@@ -0,0 +1,80 @@
+package messenger
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-distributed/messenger/codec"
+	example "github.com/go-distributed/messenger/codec/testexample"
+	"github.com/go-distributed/testify/assert"
+)
+
+type tapRecord struct {
+	d    Direction
+	peer string
+	b    []byte
+}
+
+// A wire tap that keeps what it sees.
+type memoryTap struct {
+	sync.Mutex
+	records []tapRecord
+}
+
+func (t *memoryTap) Tap(d Direction, peer string, b []byte) {
+	t.Lock()
+	defer t.Unlock()
+	t.records = append(t.records, tapRecord{d, peer, b})
+}
+
+func (t *memoryTap) snapshot() []tapRecord {
+	t.Lock()
+	defer t.Unlock()
+	return append([]tapRecord(nil), t.records...)
+}
+
+// Test the wire tap sees the raw bytes, and Inject() replays them.
+func TestWireTap(t *testing.T) {
+	tr := newFakeTransporter()
+	tap := new(memoryTap)
+	m, err := NewWithOptions(codec.NewGoGoProtobufCodec(), tr, WithRecv(true),
+		WithPreparePeriod(time.Millisecond*10), WithWireTap(tap))
+	assert.NoError(t, err)
+	assert.NoError(t, m.RegisterMessage(&example.GoGoProtobufTestMessage1{}))
+
+	msg := &example.GoGoProtobufTestMessage1{}
+	assert.Equal(t, ErrStopped, m.Inject("a:8000", []byte{0}))
+	assert.NoError(t, m.Start())
+	defer m.Destroy()
+
+	assert.NoError(t, m.Send("a:8000", msg))
+	b := <-tr.out
+	tr.in <- b
+	recvMsg, err := m.RecvTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, recvMsg)
+	waitFor(t, time.Second, func() bool { return len(tap.snapshot()) == 2 })
+	records := tap.snapshot()
+	assert.Equal(t, tapRecord{Outbound, "a:8000", b}, records[0])
+	assert.Equal(t, tapRecord{Inbound, "", b}, records[1])
+
+	// The injected messages are not tapped.
+	assert.NoError(t, m.Inject("b:8000", b))
+	recvMsg, err = m.RecvTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, recvMsg)
+	assert.Error(t, m.Inject("b:8000", []byte{0xff}))
+	assert.Equal(t, ErrEmptyMessage, m.Inject("b:8000", nil))
+	assert.Equal(t, 2, len(tap.snapshot()))
+
+	m.SetWireTap(nil)
+	assert.NoError(t, m.Send("a:8000", msg))
+	<-tr.out
+	assert.Equal(t, 2, len(tap.snapshot()))
+
+	// An empty message from the wire is dead-lettered.
+	n := m.DeadLetters().Len()
+	tr.in <- []byte{}
+	waitFor(t, time.Second, func() bool { return m.DeadLetters().Len() == n+1 })
+}